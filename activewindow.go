@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// The image lacks the time zone database the windows are given in.
+	_ "time/tzdata"
+)
+
+// defaultActiveWindowAnnotation is the default of -active-window.annotation.
+const defaultActiveWindowAnnotation = "syncer.io/active-window"
+
+// weekdays maps the abbreviations of the days of the week the windows are given with.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// activeWindow is a recurring window of time, e.g. Mon-Fri 09:00-17:00 Europe/Berlin.
+type activeWindow struct {
+	// days are the days the window starts on, every day if none is set.
+	days [7]bool
+	// start and end are the minutes since midnight the window starts and ends at. A window ending before it starts ends the next day.
+	start, end int
+	loc        *time.Location
+}
+
+// parseActiveWindows parses windows separated by semicolons. A window is made of days, as a comma-separated list of days
+// or ranges of days like Mon-Fri, times, as a range like 09:00-17:00 or 22:00-06:00, and a time zone, UTC unless given.
+// Either days or times may be left out.
+func parseActiveWindows(s string) ([]activeWindow, error) {
+	var windows []activeWindow
+	for _, spec := range strings.Split(s, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		w, err := parseActiveWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid active window %q: %w", spec, err)
+		}
+		windows = append(windows, w)
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("no active window in %q", s)
+	}
+
+	return windows, nil
+}
+
+func parseActiveWindow(spec string) (activeWindow, error) {
+	w := activeWindow{end: 24 * 60, loc: time.UTC}
+	fields := strings.Fields(spec)
+	hasDays, hasTimes := false, false
+	for i, f := range fields {
+		switch {
+		case strings.Contains(f, ":"):
+			if hasTimes {
+				return w, fmt.Errorf("more than one range of times")
+			}
+			start, end, err := parseTimeRange(f)
+			if err != nil {
+				return w, err
+			}
+			w.start, w.end, hasTimes = start, end, true
+		case i == len(fields)-1 && (hasDays || hasTimes):
+			loc, err := time.LoadLocation(f)
+			if err != nil {
+				return w, fmt.Errorf("unknown time zone %s", f)
+			}
+			w.loc = loc
+		default:
+			if hasDays || hasTimes {
+				return w, fmt.Errorf("unexpected %q, days come first and the time zone last", f)
+			}
+			if err := w.parseDays(f); err != nil {
+				return w, err
+			}
+			hasDays = true
+		}
+	}
+	if !hasDays && !hasTimes {
+		return w, fmt.Errorf("days or times must be given")
+	}
+	if !hasDays {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	}
+
+	return w, nil
+}
+
+func (w *activeWindow) parseDays(s string) error {
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return fmt.Errorf("unknown day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[strings.ToLower(bounds[1])]; !ok {
+				return fmt.Errorf("unknown day %q", bounds[1])
+			}
+		}
+		// Ranges like Sat-Mon wrap around the end of the week.
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseTimeRange returns the minutes since midnight of a range of times like 09:00-17:30.
+func parseTimeRange(s string) (int, int, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid range of times %q, must be like 09:00-17:00", s)
+	}
+	start, err := parseClock(bounds[0], false)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(bounds[1], true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("empty range of times %q", s)
+	}
+
+	return start, end, nil
+}
+
+// parseClock returns the minutes since midnight of a time like 09:30. 24:00 is only allowed as the end of a range.
+func parseClock(s string, end bool) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q, must be like 09:00", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, must be like 09:00", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && (m != 0 || !end) {
+		return 0, fmt.Errorf("invalid time %q, must be like 09:00", s)
+	}
+
+	return h*60 + m, nil
+}
+
+// contains tells whether the time is within the window.
+func (w activeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+
+	// The window ends the day after it starts.
+	yesterday := (t.Weekday() + 6) % 7
+	return w.days[t.Weekday()] && minute >= w.start || w.days[yesterday] && minute < w.end
+}
+
+// activeWindows includes the alerts carrying the annotation only while the time is within one of the windows it gives,
+// e.g. to alert on business hours only. The annotation is removed from the written rules, as its name is not valid in Prometheus.
+// The windows are checked every cycle, so rules come and go within -interval of the bounds of the windows.
+type activeWindows struct {
+	annotation string
+	now        func() time.Time
+	logPrefix  string
+}
+
+func (a activeWindows) transform(rgs *ruleGroups) (bool, error) {
+	now := a.now()
+	var invalid []string
+	inactive := 0
+	changed := false
+	dropRules(rgs, func(g *ruleGroup, r *rule) bool {
+		spec, ok := r.Annotations[a.annotation]
+		if !ok {
+			return true
+		}
+		windows, err := parseActiveWindows(spec)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s in group %q: %v", ruleKind(*r), g.Name, err))
+			return true
+		}
+
+		// The annotations may be shared with a copy of the rule.
+		annotations := make(map[string]string, len(r.Annotations))
+		for k, v := range r.Annotations {
+			if k != a.annotation {
+				annotations[k] = v
+			}
+		}
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		r.Annotations = annotations
+		changed = true
+
+		for _, w := range windows {
+			if w.contains(now) {
+				return true
+			}
+		}
+		inactive++
+
+		return false
+	})
+
+	if len(invalid) > 0 {
+		return false, fmt.Errorf("rules with invalid %s annotations: %s", a.annotation, strings.Join(invalid, "; "))
+	}
+	if inactive > 0 {
+		debugf("%sleft out %d rules outside of their active windows", a.logPrefix, inactive)
+	}
+
+	return changed, nil
+}
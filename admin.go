@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/observatorium/thanos-rule-syncer/adminpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// adminConfig configures the gRPC admin server, which requires mTLS.
+type adminConfig struct {
+	listen       string
+	tls          tlsFiles
+	clientCAFile string
+}
+
+// load reads the TLS configuration of the admin server, which requires a client certificate signed by the client CA.
+func (c adminConfig) load() (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(c.tls.certFile, c.tls.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate of the gRPC admin server: %w", err)
+	}
+
+	ca, err := os.ReadFile(c.clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA file of the gRPC admin server: %w", err)
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in the client CA file %s", c.clientCAFile)
+	}
+
+	//nolint:exhaustivestruct
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    certPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// adminServer implements the Admin service of adminpb, driving the syncer of the pipeline named in every request.
+type adminServer struct {
+	adminpb.UnimplementedAdminServer
+	lookup func(pipeline string) (*syncer, error)
+}
+
+func (a *adminServer) syncer(pipeline string) (*syncer, error) {
+	syn, err := a.lookup(pipeline)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return syn, nil
+}
+
+func (a *adminServer) SyncNow(_ context.Context, req *adminpb.SyncNowRequest) (*adminpb.SyncNowResponse, error) {
+	syn, err := a.syncer(req.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if syn.isPaused() {
+		return nil, status.Error(codes.FailedPrecondition, "syncing is paused, resume it first")
+	}
+	syn.syncNow.fire()
+
+	return &adminpb.SyncNowResponse{}, nil
+}
+
+func (a *adminServer) Pause(_ context.Context, req *adminpb.PauseRequest) (*adminpb.PauseResponse, error) {
+	syn, err := a.syncer(req.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	syn.setPaused(true)
+
+	return &adminpb.PauseResponse{}, nil
+}
+
+func (a *adminServer) Resume(_ context.Context, req *adminpb.ResumeRequest) (*adminpb.ResumeResponse, error) {
+	syn, err := a.syncer(req.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	syn.setPaused(false)
+
+	return &adminpb.ResumeResponse{}, nil
+}
+
+func (a *adminServer) Status(_ context.Context, req *adminpb.StatusRequest) (*adminpb.StatusResponse, error) {
+	syn, err := a.syncer(req.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	s := syn.status.snapshot()
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to marshal status: %v", err)
+	}
+	res := &adminpb.StatusResponse{
+		Paused:     s.Paused,
+		Hash:       s.Hash,
+		Groups:     int32(s.Groups),
+		Rules:      int32(s.Rules),
+		StatusJson: b,
+	}
+	if s.LastSync != nil {
+		res.LastSync = timestamppb.New(*s.LastSync)
+	}
+	if s.LastSuccess != nil {
+		res.LastSuccess = timestamppb.New(*s.LastSuccess)
+	}
+	if s.LastError != nil {
+		res.LastError = s.LastError.Message
+	}
+
+	return res, nil
+}
+
+func (a *adminServer) Rollback(ctx context.Context, req *adminpb.RollbackRequest) (*adminpb.RollbackResponse, error) {
+	syn, err := a.syncer(req.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if req.Hash == "" {
+		return nil, status.Error(codes.InvalidArgument, "the hash of the rules to roll back to is required")
+	}
+
+	if err := syn.rollback(ctx, req.Hash); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to roll back to %s: %s", req.Hash, redact(err.Error()))
+	}
+
+	return &adminpb.RollbackResponse{}, nil
+}
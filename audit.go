@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditSyslogLocal sends the audit records to the local syslog daemon.
+const auditSyslogLocal = "local"
+
+// auditSyslogTag is the tag of the audit records sent to syslog.
+const auditSyslogTag = "thanos-rule-syncer"
+
+type auditConfig struct {
+	file string
+	// syslogAddress is either auditSyslogLocal or a URL like udp://syslog:514.
+	syslogAddress string
+}
+
+// auditRecord is a record of the audit log, a line of the audit file.
+type auditRecord struct {
+	Time     time.Time  `json:"time"`
+	Pipeline string     `json:"pipeline,omitempty"`
+	Tenant   string     `json:"tenant,omitempty"`
+	OldHash  string     `json:"oldHash"`
+	NewHash  string     `json:"newHash"`
+	Groups   groupDelta `json:"groups"`
+	// Source is where the rules were synced from, without credentials.
+	Source string `json:"source"`
+	// Headers are the headers of the response the rules came with, see -fetch.capture-headers.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// auditLog records every applied change of the rules, appending to a JSONL file and or sending to syslog.
+// It is shared by the pipelines.
+type auditLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	syslog io.Writer
+}
+
+func newAuditLog(cfg auditConfig) (*auditLog, error) {
+	a := &auditLog{}
+	if cfg.file != "" {
+		f, err := os.OpenFile(cfg.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the audit file: %w", err)
+		}
+		a.file = f
+	}
+
+	switch cfg.syslogAddress {
+	case "":
+	case auditSyslogLocal:
+		w, err := dialSyslog("", "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the local syslog daemon: %w", err)
+		}
+		a.syslog = w
+	default:
+		u, err := url.Parse(cfg.syslogAddress)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid -audit.syslog-address %q, must be %s or a URL like udp://syslog:514", cfg.syslogAddress, auditSyslogLocal)
+		}
+		w, err := dialSyslog(u.Scheme, u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog at %s: %w", u.Host, err)
+		}
+		a.syslog = w
+	}
+
+	return a, nil
+}
+
+// record writes the record to every destination, syncing the file so that an applied change is never missing from it.
+func (a *auditLog) record(r auditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil {
+		if _, err := a.file.Write(append(b, '\n')); err != nil {
+			return fmt.Errorf("failed to write the audit file: %w", err)
+		}
+		if err := a.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync the audit file: %w", err)
+		}
+	}
+	if a.syslog != nil {
+		// The writer reconnects if the connection was lost.
+		if _, err := a.syslog.Write(b); err != nil {
+			return fmt.Errorf("failed to send the audit record to syslog: %w", err)
+		}
+	}
+
+	return nil
+}
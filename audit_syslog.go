@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to the syslog daemon at the address, the local one if the network is empty.
+// The writer reconnects if the connection is lost.
+func dialSyslog(network, address string) (io.Writer, error) {
+	return syslog.Dial(network, address, syslog.LOG_NOTICE|syslog.LOG_DAEMON, auditSyslogTag) //nolint:wrapcheck
+}
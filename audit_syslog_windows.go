@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslog fails, as there is no syslog on Windows.
+func dialSyslog(network, address string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// azureStorageVersion is the version of the Blob Storage REST API, which must support OAuth.
+	azureStorageVersion = "2020-10-02"
+	azureStorageScope   = "https://storage.azure.com/.default"
+	// azureDefaultAuthority is the Azure AD authority used unless AZURE_AUTHORITY_HOST says otherwise.
+	azureDefaultAuthority = "https://login.microsoftonline.com/"
+	azureTokenTimeout     = 30 * time.Second
+	// azureDefaultTokenLifetime is how long a token answered without a valid expires_in is used before a new one is requested,
+	// short as its actual lifetime is unknown.
+	azureDefaultTokenLifetime = 5 * time.Minute
+	// azureAssertionType is the type of the JWTs authenticating clients, federated tokens and certificate credentials alike.
+	azureAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+type azureBlobConfig struct {
+	container        string
+	prefix           string
+	connectionString string
+	account          string
+}
+
+// azureCredentials are either the account key or the SAS of a connection string, or else a token source of workload identity.
+type azureCredentials struct {
+	accountKey []byte
+	sas        url.Values
+	tokens     oauth2.TokenSource
+}
+
+// azureBlobStore reads the blobs of an Azure Blob Storage container.
+type azureBlobStore struct {
+	// endpoint is the blob endpoint of the account, e.g. https://account.blob.core.windows.net.
+	endpoint  *url.URL
+	account   string
+	container string
+	creds     azureCredentials
+	client    *http.Client
+}
+
+// newAzureBlobStore authenticates with the connection string if given, and with Azure AD workload identity otherwise,
+// as configured by the AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE environment variables.
+func newAzureBlobStore(cfg azureBlobConfig, client *http.Client) (*azureBlobStore, error) {
+	s := &azureBlobStore{account: cfg.account, container: cfg.container, client: client}
+
+	endpoint := ""
+	if cfg.connectionString != "" {
+		settings := parseAzureConnectionString(cfg.connectionString)
+		if name := settings["AccountName"]; name != "" {
+			s.account = name
+		}
+		if key := settings["AccountKey"]; key != "" {
+			b, err := base64.StdEncoding.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid AccountKey in the Azure connection string: %w", err)
+			}
+			s.creds.accountKey = b
+		}
+		if sas := settings["SharedAccessSignature"]; sas != "" {
+			v, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid SharedAccessSignature in the Azure connection string: %w", err)
+			}
+			s.creds.sas = v
+		}
+		if s.creds.accountKey == nil && s.creds.sas == nil {
+			return nil, fmt.Errorf("the Azure connection string holds neither an AccountKey nor a SharedAccessSignature")
+		}
+		endpoint = settings["BlobEndpoint"]
+		if endpoint == "" {
+			protocol, suffix := settings["DefaultEndpointsProtocol"], settings["EndpointSuffix"]
+			if protocol == "" {
+				protocol = "https"
+			}
+			if suffix == "" {
+				suffix = "core.windows.net"
+			}
+			endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, s.account, suffix)
+		}
+	} else {
+		tokens, err := newAzureWorkloadIdentity(client)
+		if err != nil {
+			return nil, err
+		}
+		s.creds.tokens = tokens
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", s.account)
+	}
+	if s.account == "" {
+		return nil, fmt.Errorf("the Azure storage account is unknown, give AccountName in the connection string or -azure.account")
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the Azure blob endpoint: %w", err)
+	}
+	s.endpoint = u
+
+	return s, nil
+}
+
+// parseAzureConnectionString splits a connection string like AccountName=a;AccountKey=k;EndpointSuffix=core.windows.net.
+func parseAzureConnectionString(s string) map[string]string {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		if i := strings.Index(part, "="); i > 0 {
+			settings[strings.TrimSpace(part[:i])] = strings.TrimSpace(part[i+1:])
+		}
+	}
+
+	return settings
+}
+
+// url returns the URL of a blob, or of the container if name is empty.
+func (s *azureBlobStore) url(name string, query url.Values) *url.URL {
+	u := *s.endpoint
+	segments := []string{u.Path, url.PathEscape(s.container)}
+	if name != "" {
+		for _, seg := range strings.Split(name, "/") {
+			segments = append(segments, url.PathEscape(seg))
+		}
+	}
+	u.RawPath = strings.Join(segments, "/")
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	for k, v := range s.creds.sas {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+
+	return &u
+}
+
+func (s *azureBlobStore) do(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureStorageVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	switch {
+	case s.creds.accountKey != nil:
+		req.Header.Set("Authorization", "SharedKey "+s.account+":"+s.sign(req))
+	case s.creds.tokens != nil:
+		token, err := s.creds.tokens.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get an Azure AD token: %w", err)
+		}
+		token.SetAuthHeader(req)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		if err := throttled(res); err != nil {
+			return nil, err
+		}
+		return nil, &unexpectedStatusError{from: "Azure Blob Storage", code: res.StatusCode}
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return b, nil
+}
+
+// sign computes the Shared Key signature of a GET request without a body.
+func (s *azureBlobStore) sign(req *http.Request) string {
+	var headers []string
+	for name := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+
+	var b strings.Builder
+	// The verb followed by the empty standard headers, from Content-Encoding to Range.
+	b.WriteString(req.Method + strings.Repeat("\n", 12))
+	for _, name := range headers {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	b.WriteString("/" + s.account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, s.creds.accountKey)
+	mac.Write([]byte(b.String()))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *azureBlobStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		query := url.Values{"restype": []string{"container"}, "comp": []string{"list"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		b, err := s.do(ctx, s.url("", query))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list blobs of container %s: %w", s.container, err)
+		}
+
+		var res struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		if err := xml.Unmarshal(b, &res); err != nil {
+			return nil, fmt.Errorf("failed to decode blobs of container %s: %w", s.container, err)
+		}
+		for _, blob := range res.Blobs {
+			names = append(names, blob.Name)
+		}
+		if res.NextMarker == "" {
+			return names, nil
+		}
+		marker = res.NextMarker
+	}
+}
+
+func (s *azureBlobStore) get(ctx context.Context, name string) ([]byte, error) {
+	b, err := s.do(ctx, s.url(name, url.Values{}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", name, err)
+	}
+
+	return b, nil
+}
+
+// source describes the container and prefix, as shown on the status page.
+func (s *azureBlobStore) source(prefix string) string {
+	return "azure://" + s.account + "/" + s.container + "/" + prefix
+}
+
+// azureWorkloadIdentity exchanges the federated token projected into the pod for Azure AD tokens.
+// The token file is read again for every exchange, as it is rotated.
+type azureWorkloadIdentity struct {
+	tokenURL  string
+	clientID  string
+	tokenFile string
+	client    *http.Client
+}
+
+func newAzureWorkloadIdentity(client *http.Client) (oauth2.TokenSource, error) {
+	clientID, tenantID, tokenFile := os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if clientID == "" || tenantID == "" || tokenFile == "" {
+		return nil, fmt.Errorf("give an Azure connection string or run with workload identity, setting AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE")
+	}
+	authority := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = azureDefaultAuthority
+	}
+
+	w := &azureWorkloadIdentity{
+		tokenURL:  strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token",
+		clientID:  clientID,
+		tokenFile: tokenFile,
+		client:    client,
+	}
+
+	return oauth2.ReuseTokenSource(nil, w), nil
+}
+
+func (w *azureWorkloadIdentity) Token() (*oauth2.Token, error) {
+	assertion, err := os.ReadFile(w.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the federated token: %w", err)
+	}
+
+	return azureToken(w.client, w.tokenURL, url.Values{
+		"grant_type":            []string{"client_credentials"},
+		"client_id":             []string{w.clientID},
+		"client_assertion_type": []string{azureAssertionType},
+		"client_assertion":      []string{strings.TrimSpace(string(assertion))},
+		"scope":                 []string{azureStorageScope},
+	})
+}
+
+// azureToken requests a token from the token endpoint of Azure AD with the given form.
+func azureToken(client *http.Client, tokenURL string, form url.Values) (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), azureTokenTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		err := error(&unexpectedStatusError{from: "Azure AD", code: res.StatusCode})
+		// Azure AD tells why it refused the request, e.g. an expired client secret, in error and error_description.
+		var status struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if b, rerr := io.ReadAll(io.LimitReader(res.Body, 4096)); rerr == nil && json.Unmarshal(b, &status) == nil && status.Error != "" {
+			err = fmt.Errorf("%s: %s: %w", status.Error, status.Description, err)
+		}
+		return nil, err
+	}
+
+	// The v1.0 endpoint returns expires_in as a string.
+	var body struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresIn   json.RawMessage `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode the Azure AD token: %w", err)
+	}
+	if body.AccessToken == "" {
+		return nil, fmt.Errorf("the Azure AD token response lacks an access_token")
+	}
+	// A token without an expiry would be used forever by oauth2.
+	lifetime := azureDefaultTokenLifetime
+	raw := strings.Trim(string(body.ExpiresIn), `"`)
+	if expiresIn, err := strconv.ParseInt(raw, 10, 64); err == nil && expiresIn > 0 {
+		lifetime = time.Duration(expiresIn) * time.Second
+	} else {
+		warnf("the Azure AD token response has no valid expires_in %q, requesting a new token in %s", raw, lifetime)
+	}
+
+	return &oauth2.Token{
+		AccessToken: body.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(lifetime),
+	}, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Versions of the token endpoint of Azure AD.
+const (
+	// azureADv1 is the v1.0 endpoint, which takes the resource of the rules backend, e.g. as configured in Azure API Management.
+	azureADv1 = "v1.0"
+	// azureADv2 is the v2.0 endpoint, which takes scopes.
+	azureADv2 = "v2.0"
+)
+
+// azureAssertionLifetime is the validity of the JWTs proving the possession of the client certificate.
+const azureAssertionLifetime = 10 * time.Minute
+
+type azureADConfig struct {
+	tenantID     string
+	clientID     string
+	clientSecret string
+	certFile     string
+	keyFile      string
+	// scope is requested from the v2.0 endpoint, resource from the v1.0 endpoint.
+	scope           string
+	resource        string
+	endpointVersion string
+	authorityHost   string
+}
+
+func (c azureADConfig) validate() error {
+	if c.tenantID == "" {
+		return nil
+	}
+	if c.clientID == "" {
+		return fmt.Errorf("-azure-ad.client-id is required with -azure-ad.tenant-id")
+	}
+	if (c.clientSecret == "") == (c.certFile == "") {
+		return fmt.Errorf("exactly one of -azure-ad.client-secret and -azure-ad.client-cert-file must be given with -azure-ad.tenant-id")
+	}
+	if (c.certFile == "") != (c.keyFile == "") {
+		return fmt.Errorf("both -azure-ad.client-cert-file and -azure-ad.client-key-file must be given to authenticate with a certificate")
+	}
+	switch c.endpointVersion {
+	case azureADv1:
+		if c.resource == "" {
+			return fmt.Errorf("-azure-ad.resource is required with -azure-ad.endpoint-version=%s", azureADv1)
+		}
+	case azureADv2:
+		if c.scope == "" {
+			return fmt.Errorf("-azure-ad.scope is required with -azure-ad.endpoint-version=%s", azureADv2)
+		}
+	default:
+		return fmt.Errorf("invalid -azure-ad.endpoint-version %q, must be %s or %s", c.endpointVersion, azureADv1, azureADv2)
+	}
+	if u, err := url.Parse(c.authorityHost); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid -azure-ad.authority-host %q, must be a URL like %s", c.authorityHost, azureDefaultAuthority)
+	}
+
+	return nil
+}
+
+// tokenURL is the token endpoint of the tenant.
+func (c azureADConfig) tokenURL() string {
+	path := "/oauth2/token"
+	if c.endpointVersion == azureADv2 {
+		path = "/oauth2/v2.0/token"
+	}
+
+	return strings.TrimSuffix(c.authorityHost, "/") + "/" + url.PathEscape(c.tenantID) + path
+}
+
+// azureADClientCredentials gets tokens for the rules backend with the client credentials flow of Azure AD,
+// authenticating with a client secret or with a JWT signed by the key of the client certificate.
+// The certificate and key are read again for every token, as they are rotated.
+type azureADClientCredentials struct {
+	cfg    azureADConfig
+	client *http.Client
+}
+
+func newAzureADTokenSource(cfg azureADConfig, client *http.Client) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &azureADClientCredentials{cfg: cfg, client: client})
+}
+
+func (a *azureADClientCredentials) Token() (*oauth2.Token, error) {
+	tokenURL := a.cfg.tokenURL()
+	form := url.Values{
+		"grant_type": []string{"client_credentials"},
+		"client_id":  []string{a.cfg.clientID},
+	}
+	if a.cfg.endpointVersion == azureADv2 {
+		form.Set("scope", a.cfg.scope)
+	} else {
+		form.Set("resource", a.cfg.resource)
+	}
+
+	if a.cfg.clientSecret != "" {
+		form.Set("client_secret", a.cfg.clientSecret)
+	} else {
+		assertion, err := a.assertion(tokenURL, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		form.Set("client_assertion_type", azureAssertionType)
+		form.Set("client_assertion", assertion)
+	}
+
+	return azureToken(a.client, tokenURL, form)
+}
+
+// assertion returns a JWT proving the possession of the client certificate,
+// see https://learn.microsoft.com/en-us/entra/identity-platform/certificate-credentials.
+func (a *azureADClientCredentials) assertion(audience string, now time.Time) (string, error) {
+	pair, err := tls.LoadX509KeyPair(a.cfg.certFile, a.cfg.keyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to load the Azure AD client certificate: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("the key of the Azure AD client certificate must be an RSA key")
+	}
+
+	thumbprint := sha1.Sum(pair.Certificate[0]) //nolint:gosec
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	if err != nil {
+		return "", err
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": a.cfg.clientID,
+		"sub": a.cfg.clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(azureAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the Azure AD client assertion: %w", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// maxBacktestPoints is the most points per series Prometheus and Thanos Query return for a range query.
+const maxBacktestPoints = 11000
+
+type backtestConfig struct {
+	queryURL  string
+	rulesFile string
+	alerts    listValue
+	lookback  time.Duration
+	step      time.Duration
+}
+
+// firing is a period a backtested alert would have fired for, from and to the first and last step it fired at.
+type firing struct {
+	alert    string
+	labels   model.LabelSet
+	from, to time.Time
+}
+
+// queryResponse is the response of the query API of Prometheus and Thanos Query.
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+		// Stats are only returned with stats=all.
+		Stats *struct {
+			Samples struct {
+				TotalQueryableSamples int64 `json:"totalQueryableSamples"`
+			} `json:"samples"`
+		} `json:"stats"`
+	} `json:"data"`
+}
+
+// runBacktest evaluates the expressions of the alerting rules over the last -backtest.range against Thanos Query, and prints
+// when the alerts would have fired, honoring their 'for' duration. The rules are those of -backtest.rules-file, or else the ones
+// the syncer would write, fetched and transformed as configured by the same flags as the syncer, whose credentials the queries present too.
+// It fails if any of the queries failed.
+func runBacktest(cfg *config, stdout io.Writer) error {
+	if cfg.configFile != "" {
+		return fmt.Errorf("the pipelines of -config.file are not backtested, give the flags of a single pipeline")
+	}
+	if cfg.backtest.step <= 0 || cfg.backtest.lookback <= 0 {
+		return fmt.Errorf("-backtest.range and -backtest.step must be positive")
+	}
+	if points := int64(cfg.backtest.lookback/cfg.backtest.step) + 1; points > maxBacktestPoints {
+		return fmt.Errorf("-backtest.range of %s with -backtest.step of %s makes %d points per series, more than the %d Thanos Query returns, raise the step", cfg.backtest.lookback, cfg.backtest.step, points, maxBacktestPoints)
+	}
+	queryURL, err := backtestQueryURL(cfg)
+	if err != nil {
+		return err
+	}
+
+	var rulesFile []byte
+	if cfg.backtest.rulesFile != "" {
+		if rulesFile, err = os.ReadFile(cfg.backtest.rulesFile); err != nil {
+			return fmt.Errorf("failed to read -backtest.rules-file: %w", err)
+		}
+	}
+
+	// Backtesting writes nothing, so it neither touches the state of the syncer nor tells anyone about it.
+	cfg.record.dir = ""
+	cfg.dataDir = ""
+	cfg.eventsSinkURL = ""
+	cfg.notify.webhookURL = ""
+	cfg.chaos = chaosConfig{}
+	if cfg.thanosRuleURL == "" {
+		ruler := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		defer ruler.Close()
+		cfg.thanosRuleURL = ruler.URL
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	syn, err := newSyncer(ctx, cfg, newRoundTripperInstrumenter(nil), prometheus.NewRegistry())
+	if err != nil {
+		return err
+	}
+	if rulesFile != nil {
+		contentType := "application/yaml"
+		if filepath.Ext(cfg.backtest.rulesFile) == ".json" {
+			contentType = "application/json"
+		}
+		syn.fetcher = &replayFetcher{payload: rulesFile, contentType: contentType}
+		// Like the raw rules of the Observatorium API, the rules of a file are those of -tenant, if given, lacking the tenant label.
+		syn.injectTenantLabel = cfg.tenant != ""
+	}
+
+	rules, err := syn.backtestRules(ctx, cfg.backtest.alerts)
+	if err != nil {
+		return err
+	}
+
+	end := time.Now().Truncate(cfg.backtest.step)
+	start := end.Add(-cfg.backtest.lookback)
+	var (
+		firings []firing
+		fired   = make(map[string]bool)
+		failed  int
+	)
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ALERT\tLABELS\tFROM\tTO\tDURATION")
+	for _, r := range rules {
+		qctx, qcancel := withStageTimeout(ctx, cfg.timeouts.fetch)
+		matrix, err := queryRange(qctx, syn.client, queryURL, r.Expr, start, end, cfg.backtest.step)
+		qcancel()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\tFAIL\t%v\t\t\n", r.Alert, err)
+			continue
+		}
+		// The 'for' duration was validated with the rules.
+		holdDuration, _ := model.ParseDuration(r.For)
+		for _, f := range backtestAlert(r, matrix, cfg.backtest.step, time.Duration(holdDuration)) {
+			firings = append(firings, f)
+			fired[f.alert] = true
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.alert, f.labels, f.from.UTC().Format(time.RFC3339), f.to.UTC().Format(time.RFC3339), f.to.Sub(f.from)+cfg.backtest.step)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Fprintf(stdout, "%d of %d alerts would have fired %d times between %s and %s\n", len(fired), len(rules), len(firings), start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d backtested alerts failed", failed, len(rules))
+	}
+
+	return nil
+}
+
+// backtestQueryURL returns the URL the range query API is under, -backtest.query-url or else the metrics API of the tenant
+// on the Observatorium API the rules are fetched from.
+func backtestQueryURL(cfg *config) (*url.URL, error) {
+	if cfg.backtest.queryURL != "" {
+		u, err := url.Parse(cfg.backtest.queryURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid -backtest.query-url %q, must be a URL like http://thanos-query:9090", redactURL(cfg.backtest.queryURL))
+		}
+		return u, nil
+	}
+	if cfg.observatoriumURL == "" || cfg.tenant == "" {
+		return nil, fmt.Errorf("-backtest.query-url is required unless the rules of a -tenant are fetched from -observatorium-api-url")
+	}
+	u, err := url.Parse(cfg.observatoriumURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Observatorium API URL: %w", err)
+	}
+	u.Path = path.Join("/", u.Path, "api/metrics/v1", cfg.tenant)
+
+	return u, nil
+}
+
+// backtestRules returns the alerting rules the syncer would write, only those with the given names if any.
+// Nothing is recorded about the fetched rules, like for a preview.
+func (s *syncer) backtestRules(ctx context.Context, names []string) ([]rule, error) {
+	rgs, _, err := s.previewRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, n := range names {
+		wanted[n] = true
+	}
+	var rules []rule
+	for _, g := range rgs.Groups {
+		for _, r := range g.Rules {
+			if r.Alert != "" && (len(wanted) == 0 || wanted[r.Alert]) {
+				rules = append(rules, r)
+			}
+		}
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no alerting rules to backtest")
+	}
+
+	return rules, nil
+}
+
+// queryRange evaluates the expression at every step from start to end with the range query API under base.
+func queryRange(ctx context.Context, client *http.Client, base *url.URL, expr string, start, end time.Time, step time.Duration) (model.Matrix, error) {
+	qr, err := queryAPI(ctx, client, base, "api/v1/query_range", url.Values{
+		"query": []string{expr},
+		"start": []string{strconv.FormatInt(start.Unix(), 10)},
+		"end":   []string{strconv.FormatInt(end.Unix(), 10)},
+		"step":  []string{strconv.FormatFloat(step.Seconds(), 'f', -1, 64)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if qr.Data.ResultType != model.ValMatrix.String() {
+		return nil, fmt.Errorf("unexpected result type %q of range query", qr.Data.ResultType)
+	}
+	var matrix model.Matrix
+	if err := json.Unmarshal(qr.Data.Result, &matrix); err != nil {
+		return nil, fmt.Errorf("failed to decode range query result: %w", err)
+	}
+
+	return matrix, nil
+}
+
+// queryAPI requests an endpoint of the query API of Prometheus and Thanos Query under base.
+func queryAPI(ctx context.Context, client *http.Client, base *url.URL, endpoint string, params url.Values) (*queryResponse, error) {
+	u := *base
+	u.Path = path.Join("/", u.Path, endpoint)
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	qr := &queryResponse{}
+	// Failed queries are answered with the error in the body, which is more telling than the status.
+	if err := json.NewDecoder(res.Body).Decode(qr); err != nil {
+		if res.StatusCode/100 != 2 {
+			return nil, &unexpectedStatusError{from: "Thanos Query", code: res.StatusCode}
+		}
+		return nil, fmt.Errorf("failed to decode query response: %w", err)
+	}
+	if qr.Status != "success" {
+		return nil, fmt.Errorf("query failed: %s", qr.Error)
+	}
+
+	return qr, nil
+}
+
+// backtestAlert returns when the alert would have fired for the series its expression returned at every step.
+// Like Thanos Ruler evaluating it every step, a series is pending from the first step it is returned at, and fires once it is
+// returned for the 'for' duration without a gap.
+func backtestAlert(r rule, matrix model.Matrix, step, holdDuration time.Duration) []firing {
+	var firings []firing
+	for _, series := range matrix {
+		labels := make(model.LabelSet, len(series.Metric)+len(r.Labels))
+		for k, v := range series.Metric {
+			if k != model.MetricNameLabel {
+				labels[k] = v
+			}
+		}
+		for k, v := range r.Labels {
+			labels[model.LabelName(k)] = model.LabelValue(v)
+		}
+
+		var active, firingFrom, last time.Time
+		flush := func() {
+			if !firingFrom.IsZero() {
+				firings = append(firings, firing{alert: r.Alert, labels: labels, from: firingFrom, to: last})
+			}
+			firingFrom = time.Time{}
+		}
+		for _, p := range series.Values {
+			t := p.Timestamp.Time()
+			if !last.IsZero() && t.Sub(last) > step {
+				flush()
+				active = time.Time{}
+			}
+			if active.IsZero() {
+				active = t
+			}
+			if firingFrom.IsZero() && t.Sub(active) >= holdDuration {
+				firingFrom = t
+			}
+			last = t
+		}
+		flush()
+	}
+
+	sort.SliceStable(firings, func(i, j int) bool { return firings[i].from.Before(firings[j].from) })
+
+	return firings
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Modes of -fetch.bundle-mode.
+const (
+	// bundleMerge merges the rules files of a bundle like those of an object store.
+	bundleMerge = "merge"
+	// bundlePerTenant takes every rules file of a bundle as the rules of a tenant.
+	bundlePerTenant = "per-tenant"
+)
+
+// maxBundleSize bounds the unpacked size of a bundle, as it is unpacked in memory.
+const maxBundleSize = 256 << 20
+
+// bundleFile is a rules file of a bundle.
+type bundleFile struct {
+	name    string
+	content []byte
+}
+
+// isBundle tells whether the payload is a zip or gzip-compressed archive, by its Content-Type or else its first bytes,
+// as backends often serve archives as application/octet-stream.
+func isBundle(payload []byte, contentType string) bool {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mt {
+		case "application/zip", "application/x-zip-compressed", "application/gzip", "application/x-gzip", "application/x-gtar", "application/x-tar+gzip":
+			return true
+		}
+	}
+
+	return bytes.HasPrefix(payload, []byte("PK\x03\x04")) || bytes.HasPrefix(payload, []byte{0x1f, 0x8b})
+}
+
+// unpackBundle returns the rules files of a zip, tar.gz or gzip-compressed bundle as a multi-document YAML,
+// whose documents are merged into a single one when the rules are validated.
+// With bundlePerTenant, the rules of every file get the tenant label set to its tenant, see bundleTenant.
+func unpackBundle(payload []byte, mode, tenantLabel string) ([]byte, int, error) {
+	var (
+		files []bundleFile
+		err   error
+	)
+	if bytes.HasPrefix(payload, []byte("PK\x03\x04")) {
+		files, err = unzipBundle(payload)
+	} else {
+		files, err = untarBundle(payload)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to unpack bundle: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, 0, fmt.Errorf("no rules files found in the bundle")
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	var buf bytes.Buffer
+	for _, f := range files {
+		content := f.content
+		if mode == bundlePerTenant {
+			tenant := bundleTenant(f.name)
+			rgs, _, err := decodeRuleGroups(content, "")
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to parse %s of the bundle: %w", f.name, err)
+			}
+			injectTenantLabel(rgs, tenantLabel, tenant)
+			if content, err = yaml.Marshal(rgs); err != nil {
+				return nil, 0, fmt.Errorf("failed to marshal the rules of %s of the bundle: %w", f.name, err)
+			}
+		}
+		buf.WriteString("---\n")
+		buf.Write(content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+
+	return buf.Bytes(), len(files), nil
+}
+
+// bundleTenant returns the tenant of a rules file of a bundle, named by the directory at the top of the bundle it is in,
+// e.g. team-a/alerts.yaml, or else by its name without extension, e.g. team-a.yaml.
+func bundleTenant(name string) string {
+	if i := strings.Index(name, "/"); i > 0 {
+		return name[:i]
+	}
+
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// isBundledRulesFile tells whether a file of a bundle is a rules file, skipping other files and those hidden, e.g. by macOS.
+func isBundledRulesFile(name string) bool {
+	return isRulesObject(name) && !strings.HasPrefix(path.Base(name), ".") && !strings.HasPrefix(name, "__MACOSX/")
+}
+
+func unzipBundle(payload []byte) ([]bundleFile, error) {
+	zr, err := zip.NewReader(bytes.NewReader(payload), int64(len(payload)))
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	var (
+		files []bundleFile
+		size  int64
+	)
+	for _, zf := range zr.File {
+		name := strings.TrimPrefix(path.Clean(zf.Name), "/")
+		if zf.FileInfo().IsDir() || !isBundledRulesFile(name) {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		content, err := readBundled(r, &size)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		files = append(files, bundleFile{name: name, content: content})
+	}
+
+	return files, nil
+}
+
+// untarBundle reads a gzip-compressed tar archive, or a single gzip-compressed rules file.
+func untarBundle(payload []byte) ([]bundleFile, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	defer gz.Close()
+
+	var size int64
+	content, err := readBundled(gz, &size)
+	if err != nil {
+		return nil, err
+	}
+	// The magic of tar archives is at an offset of 257 bytes.
+	if len(content) < 262 || string(content[257:262]) != "ustar" {
+		name := gz.Name
+		if name == "" {
+			name = "rules.yaml"
+		}
+		return []bundleFile{{name: name, content: content}}, nil
+	}
+
+	var files []bundleFile
+	tr := tar.NewReader(bytes.NewReader(content))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "/")
+		if hdr.Typeflag != tar.TypeReg || !isBundledRulesFile(name) {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		files = append(files, bundleFile{name: name, content: b})
+	}
+
+	return files, nil
+}
+
+// readBundled reads a file of a bundle, adding its size to that of the bundle read so far, which must not exceed maxBundleSize.
+func readBundled(r io.Reader, size *int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxBundleSize-*size+1))
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	if *size += int64(len(b)); *size > maxBundleSize {
+		return nil, fmt.Errorf("the bundle unpacks to more than %d bytes", maxBundleSize)
+	}
+
+	return b, nil
+}
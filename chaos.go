@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// errInjected is a failure injected by the chaos settings, counted under the injected code.
+var errInjected = errors.New("injected failure")
+
+// chaosConfig injects failures to validate the alerting on the metrics of the syncer before trusting it in production.
+// It is deliberately hidden from the flags and only set in the environment, e.g. TRS_CHAOS_FETCH_FAILURE_RATE=0.5.
+type chaosConfig struct {
+	fetchFailureRate  float64
+	writeDelay        time.Duration
+	writeDelayRate    float64
+	reloadFailureRate float64
+}
+
+// chaosFromEnv reads the chaos settings of the environment, named like the variables of the flags.
+func chaosFromEnv(lookup func(string) (string, bool)) (chaosConfig, error) {
+	c := chaosConfig{writeDelayRate: 1}
+	rates := map[string]*float64{
+		"chaos.fetch-failure-rate":  &c.fetchFailureRate,
+		"chaos.write-delay-rate":    &c.writeDelayRate,
+		"chaos.reload-failure-rate": &c.reloadFailureRate,
+	}
+	for name, rate := range rates {
+		value, ok := lookup(envName(name))
+		if !ok {
+			continue
+		}
+		r, err := strconv.ParseFloat(value, 64)
+		if err != nil || r < 0 || r > 1 {
+			return c, fmt.Errorf("invalid %s %q, must be a rate between 0 and 1", envName(name), value)
+		}
+		*rate = r
+	}
+	if value, ok := lookup(envName("chaos.write-delay")); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return c, fmt.Errorf("invalid %s %q, must be a duration", envName("chaos.write-delay"), value)
+		}
+		c.writeDelay = d
+	}
+
+	return c, nil
+}
+
+func (c chaosConfig) enabled() bool {
+	return c.fetchFailureRate > 0 || (c.writeDelay > 0 && c.writeDelayRate > 0) || c.reloadFailureRate > 0
+}
+
+func (c chaosConfig) String() string {
+	return fmt.Sprintf("fetch failure rate %v, write delay %s at rate %v, reload failure rate %v", c.fetchFailureRate, c.writeDelay, c.writeDelayRate, c.reloadFailureRate)
+}
+
+func (c chaosConfig) fetch() error {
+	if chance(c.fetchFailureRate) {
+		return fmt.Errorf("failed to fetch rules: %w", errInjected)
+	}
+
+	return nil
+}
+
+// write delays the write, failing if its deadline is exceeded meanwhile.
+func (c chaosConfig) write(ctx context.Context) error {
+	if c.writeDelay <= 0 || !chance(c.writeDelayRate) {
+		return nil
+	}
+	t := time.NewTimer(c.writeDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err() //nolint:wrapcheck
+	}
+}
+
+func (c chaosConfig) reload() error {
+	if chance(c.reloadFailureRate) {
+		return fmt.Errorf("failed to reload Thanos Ruler: %w", errInjected)
+	}
+
+	return nil
+}
+
+func chance(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate //nolint:gosec
+}
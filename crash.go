@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// crashReport is written to -diagnostics.crash-file when the syncer exits on a fatal error,
+// so that fleet tooling can harvest why terminated pods failed, e.g. with /dev/termination-log.
+type crashReport struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	ExitCode int       `json:"exitCode"`
+	// ConfigFingerprint tells apart the configurations of the fleet, see configFingerprint.
+	ConfigFingerprint string               `json:"configFingerprint"`
+	Pipelines         []crashPipelineState `json:"pipelines,omitempty"`
+}
+
+// crashPipelineState is the state of a syncer at the time of the crash, the pipeline being empty without -config.file.
+type crashPipelineState struct {
+	Pipeline    string       `json:"pipeline,omitempty"`
+	LastSync    *time.Time   `json:"lastSync,omitempty"`
+	LastSuccess *time.Time   `json:"lastSuccess,omitempty"`
+	LastError   *statusError `json:"lastError,omitempty"`
+	Hash        string       `json:"hash,omitempty"`
+}
+
+// crashReporter holds what the crash report is made of. It is safe for concurrent use.
+type crashReporter struct {
+	mu          sync.Mutex
+	file        string
+	fingerprint string
+	// syncers returns the syncers running, once they are.
+	syncers func() []*syncer
+}
+
+var crashes crashReporter
+
+func (c *crashReporter) configure(file, fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file, c.fingerprint = file, fingerprint
+}
+
+func (c *crashReporter) setSyncers(syncers func() []*syncer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.syncers = syncers
+}
+
+// write writes the crash report, if -diagnostics.crash-file is given. Failing to is logged, as the syncer exits anyway.
+func (c *crashReporter) write(reason string, code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == "" {
+		return
+	}
+
+	report := crashReport{
+		Time:              time.Now().UTC(),
+		Reason:            redact(reason),
+		ExitCode:          code,
+		ConfigFingerprint: c.fingerprint,
+	}
+	if c.syncers != nil {
+		for _, s := range c.syncers() {
+			st := s.status.snapshot()
+			report.Pipelines = append(report.Pipelines, crashPipelineState{
+				Pipeline:    s.pipeline,
+				LastSync:    st.LastSync,
+				LastSuccess: st.LastSuccess,
+				LastError:   st.LastError,
+				Hash:        st.Hash,
+			})
+		}
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		errorf("failed to marshal the crash report: %v", err)
+		return
+	}
+	if err := os.WriteFile(c.file, append(b, '\n'), 0o644); err != nil { //nolint:gosec
+		errorf("failed to write the crash report to %s: %v", c.file, err)
+	}
+}
+
+// fatal logs like log.Fatal, writes the crash report and exits with 1.
+func fatal(v ...interface{}) {
+	msg := fmt.Sprint(v...)
+	_ = log.Output(2, redact(msg))
+	crashes.write(msg, 1)
+	os.Exit(1)
+}
+
+// fatalf logs like log.Fatalf, writes the crash report and exits with 1.
+func fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	_ = log.Output(2, redact(msg))
+	crashes.write(msg, 1)
+	os.Exit(1)
+}
+
+// configFingerprint hashes the values of all flags, and the content of -config.file if given, so that the crash reports
+// of syncers running the same configuration can be grouped. Secrets are redacted before hashing, so they cannot be guessed from it.
+func configFingerprint(configFile string) string {
+	h := sha256.New()
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(h, "%s=%s\n", f.Name, redact(f.Value.String()))
+	})
+	if configFile != "" {
+		if b, err := os.ReadFile(configFile); err == nil {
+			h.Write([]byte(redact(string(b))))
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Run modes of the syncer.
+const (
+	// runModeDaemon syncs every -interval until stopped.
+	runModeDaemon = "daemon"
+	// runModeCron syncs once and exits, e.g. in a Kubernetes CronJob.
+	runModeCron = "cron"
+)
+
+// Exit codes of the cron run mode, telling which stage failed. Both a change and no change exit with 0.
+const (
+	exitFailed         = 1
+	exitFetchFailed    = 2
+	exitAuthFailed     = 3
+	exitValidateFailed = 4
+	exitWriteFailed    = 5
+	exitReloadFailed   = 6
+)
+
+// cronExitCodes maps the stages of a sync cycle to the exit codes their failures exit with.
+var cronExitCodes = map[string]int{
+	stageFetch:    exitFetchFailed,
+	stageAuth:     exitAuthFailed,
+	stageValidate: exitValidateFailed,
+	stageWrite:    exitWriteFailed,
+	stageReload:   exitReloadFailed,
+}
+
+// runCron runs a single sync cycle and returns the exit code of its outcome. The outcome is logged with a marker
+// automation can match on: "outcome=changed" once the changed rules were written and Thanos Ruler reloaded,
+// "outcome=unchanged" if the rules were already up to date, and "outcome=failed" with the failing stage otherwise.
+func runCron(s *syncer) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	before := s.hash
+	start := time.Now()
+	cycleCtx, cancel := s.cycleContext(ctx)
+	err := s.sync(cycleCtx)
+	cancel()
+	s.status.finished(start, time.Since(start), err)
+	if s.notifier != nil {
+		s.notifier.cycleFinished(ctx, err)
+	}
+
+	if err != nil {
+		stage, code := classify(err)
+		errorf("%soutcome=failed stage=%s code=%s: %v", s.logPrefix(), stage, code, err)
+		if exit, ok := cronExitCodes[stage]; ok {
+			return exit
+		}
+		return exitFailed
+	}
+	if s.hash == before {
+		infof("%soutcome=unchanged: the rules are up to date, took %s", s.logPrefix(), time.Since(start).Round(time.Millisecond))
+		return 0
+	}
+	infof("%soutcome=changed: the rules were written and Thanos Ruler reloaded, took %s", s.logPrefix(), time.Since(start).Round(time.Millisecond))
+
+	return 0
+}
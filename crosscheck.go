@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// crossChecker compares the rules fetched from the Rules Storage Backend with those rendered by the Observatorium API,
+// to validate a migration between the two. It only reports divergences, the synced rules always come from the backend.
+// Its state is only accessed by the goroutine running the sync cycles.
+type crossChecker struct {
+	fetcher  fetcher
+	interval time.Duration
+	tenant   string
+	// tenantLabel is injected into the raw rules of the Observatorium API, and selects the rules of the tenant from the backend.
+	tenantLabel       string
+	injectTenantLabel bool
+	logPrefix         string
+
+	last time.Time
+	// divergent is the last divergence logged, so that it is logged once rather than every check.
+	divergent string
+}
+
+// due tells whether the interval passed since the last check.
+func (c *crossChecker) due(now time.Time) bool {
+	return now.Sub(c.last) >= c.interval
+}
+
+// check fetches the rules of the tenant from the Observatorium API and returns the names of the groups that differ
+// from those of the backend, missing from either of them included.
+func (c *crossChecker) check(ctx context.Context, backend *ruleGroups, now time.Time) ([]string, error) {
+	c.last = now
+
+	res, err := c.fetcher.getRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rules from the Observatorium API: %w", err)
+	}
+	defer res.body.Close()
+	payload, err := io.ReadAll(res.body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules from the Observatorium API: %w", err)
+	}
+	api, _, err := decodeRuleGroups(payload, res.contentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the rules of the Observatorium API: %w", err)
+	}
+	if c.injectTenantLabel {
+		injectTenantLabel(api, c.tenantLabel, c.tenant)
+	}
+
+	want := backend
+	if c.tenant != "" {
+		want = splitByTenant(backend, c.tenantLabel)[c.tenant]
+		if want == nil {
+			want = &ruleGroups{}
+		}
+	}
+
+	return divergentGroups(want, api)
+}
+
+// divergentGroups returns the sorted names of the groups that are not equal in both, ignoring the order of the groups.
+func divergentGroups(a, b *ruleGroups) ([]string, error) {
+	ha, err := groupHashes(a)
+	if err != nil {
+		return nil, err
+	}
+	hb, err := groupHashes(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name, h := range ha {
+		if hb[name] != h {
+			names = append(names, name)
+		}
+	}
+	for name := range hb {
+		if _, ok := ha[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func groupHashes(rgs *ruleGroups) (map[string]string, error) {
+	hashes := make(map[string]string, len(rgs.Groups))
+	for _, g := range rgs.Groups {
+		b, err := yaml.Marshal(g)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal group %q: %w", g.Name, err)
+		}
+		hashes[g.Name] = contentHash(b)
+	}
+
+	return hashes, nil
+}
+
+// report logs the divergence when it changes.
+func (c *crossChecker) report(names []string) {
+	divergent := strings.Join(names, ", ")
+	if divergent == c.divergent {
+		return
+	}
+	c.divergent = divergent
+	if len(names) == 0 {
+		infof("%sthe rules of the Rules Storage Backend and the Observatorium API agree again", c.logPrefix)
+		return
+	}
+	warnf("%sthe rules of the Rules Storage Backend and the Observatorium API differ in %d groups: %s", c.logPrefix, len(names), divergent)
+}
+
+// crossCheckRules cross-checks the rules of the backend under the deadline of the fetch. Failures do not fail the cycle.
+func (s *syncer) crossCheckRules(ctx context.Context, rgs *ruleGroups) {
+	ctx, cancel := withStageTimeout(ctx, s.timeouts.fetch)
+	defer cancel()
+
+	names, err := s.crossCheck.check(ctx, rgs, time.Now())
+	if err != nil {
+		s.metrics.crossCheckErrors.Inc()
+		warnf("%sfailed to cross-check the rules: %v", s.logPrefix(), err)
+		return
+	}
+	s.metrics.crossCheckDivergent.Set(float64(len(names)))
+	s.crossCheck.report(names)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// checkSpace fails with ENOSPC unless the file systems of the rules files have the space to write them.
+// As a file is written next to the file it replaces, the space of the new content is needed on top of the existing file.
+func (o *output) checkSpace(files []ruleFile) error {
+	if o.resources != nil {
+		return nil
+	}
+
+	needed := make(map[string]uint64)
+	for _, f := range files {
+		needed[filepath.Dir(f.path)] += uint64(len(f.content))
+	}
+	for dir, n := range needed {
+		available, bsize, err := availableSpace(dir)
+		if err != nil {
+			// The write reports the actual problem, e.g. a missing directory.
+			debugf("%sfailed to check the available space in %s: %v", o.logPrefix, dir, err)
+			continue
+		}
+		// A block more per file, as files take up whole blocks.
+		n += bsize * uint64(len(files))
+		if available < n {
+			return fmt.Errorf("not enough space to write the rules files to %s, %d bytes are needed and %d available: %w", dir, n, available, syscall.ENOSPC)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// availableSpace returns the bytes available to unprivileged users in the file system of the directory, and the size of its blocks.
+func availableSpace(dir string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err //nolint:wrapcheck
+	}
+	bsize := uint64(st.Bsize)
+
+	return uint64(st.Bavail) * bsize, bsize, nil
+}
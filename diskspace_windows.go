@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// availableSpace fails, as the available space is not checked on Windows.
+func availableSpace(dir string) (uint64, uint64, error) {
+	return 0, 0, errors.New("checking the available space is not supported on Windows")
+}
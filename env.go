@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix prefixes the environment variables flags fall back to, e.g. TRS_OIDC_CLIENT_SECRET for -oidc.client-secret.
+const envPrefix = "TRS_"
+
+// envFileSuffix marks an environment variable naming a file that holds the value of the flag, e.g. a mounted Secret.
+const envFileSuffix = "_FILE"
+
+// secretFlags take their value from the environment even if given on the command line,
+// so that a secret injected by the environment is not overridden by a placeholder in the arguments.
+var secretFlags = map[string]struct{}{
+	"azure-ad.client-secret":           {},
+	"azure.connection-string":          {},
+	"notify.webhook-url":               {},
+	"oidc.client-secret":               {},
+	"web.internal.bearer-token":        {},
+	"web.internal.basic-auth-password": {},
+}
+
+// envName returns the environment variable of a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+// applyEnv sets the flags that were not given on the command line from the environment.
+// A flag is read from TRS_<NAME>, or from the file named by TRS_<NAME>_FILE.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	given := make(map[string]struct{})
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = struct{}{}
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if _, ok := given[f.Name]; ok {
+			if _, secret := secretFlags[f.Name]; !secret {
+				return
+			}
+		}
+
+		value, ok, verr := envValue(envName(f.Name), lookup)
+		if verr != nil {
+			err = verr
+			return
+		}
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("invalid value of %s for -%s: %w", envName(f.Name), f.Name, serr)
+		}
+	})
+
+	return err
+}
+
+// envValue returns the value of the environment variable, or else the content of the file named by its _FILE variant.
+func envValue(name string, lookup func(string) (string, bool)) (string, bool, error) {
+	if value, ok := lookup(name); ok {
+		return value, true, nil
+	}
+
+	path, ok := lookup(name + envFileSuffix)
+	if !ok {
+		return "", false, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", name+envFileSuffix, err)
+	}
+
+	// Files commonly end with a newline that is not part of the value.
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/oauth2"
+)
+
+// Stages of a sync cycle failures are attributed to.
+const (
+	stageFetch    = "fetch"
+	stageAuth     = "auth"
+	stageValidate = "validate"
+	stageWrite    = "write"
+	stageReload   = "reload"
+)
+
+// Codes of failures that are not identified by an HTTP status or an errno.
+const (
+	codeTimeout = "timeout"
+	codeNetwork = "network"
+	codeParse   = "parse"
+	codeInvalid = "invalid"
+	// codeUnhealthy is a write deferred as Thanos Ruler was not healthy.
+	codeUnhealthy = "unhealthy"
+	// codeInjected is a failure injected by the chaos settings, see chaosConfig.
+	codeInjected = "injected"
+	// codeNotOwned is a rules file not written by the syncer, see errNotOwned.
+	codeNotOwned = "not_owned"
+	codeUnknown  = "unknown"
+)
+
+// stageError is the failure of a stage of a sync cycle.
+type stageError struct {
+	stage string
+	// code is optional, see classify.
+	code string
+	err  error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// errnoCodes names the errnos most likely to fail writing rules files.
+var errnoCodes = map[syscall.Errno]string{
+	syscall.ENOSPC: "ENOSPC",
+	syscall.EDQUOT: "EDQUOT",
+	syscall.EACCES: "EACCES",
+	syscall.EPERM:  "EPERM",
+	syscall.EROFS:  "EROFS",
+	syscall.ENOENT: "ENOENT",
+	syscall.EIO:    "EIO",
+}
+
+// classify returns the stage and code a failed sync cycle is counted under by rule_syncer_errors_total.
+// The code is the HTTP status for errors answered by a server, the errno for file system errors,
+// and timeout, network, parse, invalid or unknown otherwise.
+// Fetches rejected with 401 or 403, or failing to get a token, are attributed to the auth stage.
+func classify(err error) (string, string) {
+	stage := codeUnknown
+	var se *stageError
+	if errors.As(err, &se) {
+		stage = se.stage
+		if se.code != "" {
+			return stage, se.code
+		}
+	}
+
+	var (
+		statusErr   *unexpectedStatusError
+		throttleErr *throttledError
+		tokenErr    *oauth2.RetrieveError
+		errno       syscall.Errno
+		netErr      *net.OpError
+	)
+	switch {
+	case errors.Is(err, errInjected):
+		return stage, codeInjected
+	case errors.Is(err, errNotOwned):
+		return stage, codeNotOwned
+	case errors.As(err, &tokenErr):
+		code := codeUnknown
+		if tokenErr.Response != nil {
+			code = strconv.Itoa(tokenErr.Response.StatusCode)
+		}
+		return stageAuth, code
+	case errors.As(err, &statusErr):
+		if stage == stageFetch && (statusErr.code == http.StatusUnauthorized || statusErr.code == http.StatusForbidden) {
+			stage = stageAuth
+		}
+		return stage, strconv.Itoa(statusErr.code)
+	case errors.As(err, &throttleErr):
+		return stage, strconv.Itoa(throttleErr.code)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return stage, codeTimeout
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return stage, codeTimeout
+		}
+		return stage, codeNetwork
+	case errors.As(err, &errno):
+		if code, ok := errnoCodes[errno]; ok {
+			return stage, code
+		}
+		return stage, "errno_" + strconv.Itoa(int(errno))
+	}
+
+	return stage, codeUnknown
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// rulesChangedEventType is the CloudEvents type of the event emitted when the synced rules change.
+	rulesChangedEventType = "io.observatorium.thanos-rule-syncer.rules.changed"
+	// eventTimeout bounds the delivery of a single event to the sink.
+	eventTimeout = 10 * time.Second
+)
+
+// cloudEvent is a CloudEvent in the structured JSON format, see https://github.com/cloudevents/spec/blob/v1.0.1/json-format.md.
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// rulesChange is the data of a rules changed event.
+type rulesChange struct {
+	Tenant  string     `json:"tenant,omitempty"`
+	OldHash string     `json:"oldHash"`
+	NewHash string     `json:"newHash"`
+	Groups  groupDelta `json:"groups"`
+}
+
+// eventEmitter delivers CloudEvents to an HTTP sink.
+type eventEmitter struct {
+	client  *http.Client
+	sinkURL string
+	source  string
+}
+
+func newEventEmitter(sinkURL, source string, client *http.Client) *eventEmitter {
+	return &eventEmitter{
+		client:  client,
+		sinkURL: sinkURL,
+		source:  source,
+	}
+}
+
+func (e *eventEmitter) emitRulesChanged(ctx context.Context, change rulesChange) error {
+	id, err := newEventID()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              id,
+		Source:          e.source,
+		Type:            rulesChangedEventType,
+		Subject:         change.Tenant,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            change,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, e.sinkURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("got unexpected status from event sink: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate event ID: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// parseExpiresAt parses the time an alert expires at, in RFC 3339, e.g. 2024-05-01T18:00:00Z, or as a date, expiring at its start in UTC.
+func parseExpiresAt(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid expiry %q, must be a time in RFC 3339 like 2024-05-01T18:00:00Z or a date like 2024-05-01", s)
+}
+
+// expiredRules leaves out the alerts whose annotation tells they expired, e.g. temporary alerts of an incident, and counts
+// those still in the backend with rule_syncer_expired_rules, so that teams find what to remove. The annotation is removed
+// from the written rules, as its name is not valid in Prometheus.
+type expiredRules struct {
+	annotation string
+	now        func() time.Time
+	expired    prometheus.Gauge
+	logPrefix  string
+}
+
+func (e expiredRules) transform(rgs *ruleGroups) (bool, error) {
+	return e.apply(rgs, true)
+}
+
+// preview leaves out the expired alerts without counting them, as the rules of a preview are not synced.
+func (e expiredRules) preview(rgs *ruleGroups) (bool, error) {
+	return e.apply(rgs, false)
+}
+
+func (e expiredRules) apply(rgs *ruleGroups, count bool) (bool, error) {
+	now := e.now()
+	var invalid []string
+	expired := 0
+	changed := false
+	dropRules(rgs, func(g *ruleGroup, r *rule) bool {
+		spec, ok := r.Annotations[e.annotation]
+		if !ok {
+			return true
+		}
+		expiresAt, err := parseExpiresAt(spec)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s in group %q: %v", ruleKind(*r), g.Name, err))
+			return true
+		}
+
+		// The annotations may be shared with a copy of the rule.
+		annotations := make(map[string]string, len(r.Annotations))
+		for k, v := range r.Annotations {
+			if k != e.annotation {
+				annotations[k] = v
+			}
+		}
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		r.Annotations = annotations
+		changed = true
+
+		if now.Before(expiresAt) {
+			return true
+		}
+		expired++
+
+		return false
+	})
+
+	if len(invalid) > 0 {
+		return false, fmt.Errorf("rules with invalid %s annotations: %s", e.annotation, strings.Join(invalid, "; "))
+	}
+	if !count {
+		return changed, nil
+	}
+	e.expired.Set(float64(expired))
+	if expired > 0 {
+		debugf("%sleft out %d expired rules still in the backend", e.logPrefix, expired)
+	}
+
+	return changed, nil
+}
@@ -7,58 +7,165 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	rulesspec "github.com/observatorium/api/rules"
 )
 
 type fetcher interface {
-	getRules(ctx context.Context) (rules io.ReadCloser, err error)
+	getRules(ctx context.Context) (rules *rulesPayload, err error)
+}
+
+// rulesPayload is the response of a fetcher. The caller must close the body.
+type rulesPayload struct {
+	body        io.ReadCloser
+	contentType string
+	// header is the header of the HTTP response, if the rules were fetched over HTTP.
+	header http.Header
+}
+
+func newRulesPayload(res *http.Response) *rulesPayload {
+	return &rulesPayload{
+		body:        res.Body,
+		contentType: res.Header.Get("Content-Type"),
+		header:      res.Header,
+	}
+}
+
+// capturedHeaders returns the values of the given headers of the response, see -fetch.capture-headers.
+// Headers missing from the response are left out, and repeated ones joined with commas.
+func capturedHeaders(header http.Header, names []string) map[string]string {
+	var captured map[string]string
+	for _, name := range names {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		if captured == nil {
+			captured = make(map[string]string, len(names))
+		}
+		captured[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+	}
+
+	return captured
+}
+
+// Encodings of the rules payload a fetcher can ask the backend for.
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+)
+
+// acceptHeader returns the value of the Accept header preferring the given format.
+// Backends serving only one of the encodings keep working either way.
+func acceptHeader(format string) string {
+	switch format {
+	case formatJSON:
+		return "application/json, application/yaml;q=0.9, */*;q=0.8"
+	case formatJsonnet:
+		return "application/jsonnet, */*;q=0.8"
+	}
+
+	return "application/yaml, application/json;q=0.9, */*;q=0.8"
+}
+
+// defaultObservatoriumPathTemplate is the path of the rules of a tenant in the Observatorium API.
+const defaultObservatoriumPathTemplate = "/api/metrics/{version}/{tenant}/api/v1/{endpoint}"
+
+// Rules endpoints of the Observatorium API.
+const (
+	// rulesEndpointRendered serves the rules with the tenant label injected by the API.
+	rulesEndpointRendered = "rendered"
+	// rulesEndpointRaw serves the rules as authored by the tenant, the syncer injecting the tenant label instead.
+	rulesEndpointRaw = "raw"
+)
+
+// rulesEndpointPaths are the paths replacing {endpoint} in the path template.
+var rulesEndpointPaths = map[string]string{
+	rulesEndpointRendered: "rules",
+	rulesEndpointRaw:      "rules/raw",
+}
+
+// observatoriumAPIConfig locates the rules in the Observatorium API, for API versions and deployments differing from the default.
+type observatoriumAPIConfig struct {
+	// pathTemplate is the path of the rules relative to the URL of the API, with the {tenant}, {version} and {endpoint} placeholders.
+	pathTemplate  string
+	version       string
+	rulesEndpoint string
+}
+
+func (c observatoriumAPIConfig) path(tenant string) (string, error) {
+	endpoint, ok := rulesEndpointPaths[c.rulesEndpoint]
+	if !ok {
+		return "", fmt.Errorf("invalid -observatorium.rules-endpoint %q, must be %s or %s", c.rulesEndpoint, rulesEndpointRendered, rulesEndpointRaw)
+	}
+	p := strings.NewReplacer("{tenant}", tenant, "{version}", c.version, "{endpoint}", endpoint).Replace(c.pathTemplate)
+	if i := strings.Index(p, "{"); i >= 0 {
+		return "", fmt.Errorf("unknown placeholder in -observatorium.path-template %q, must be {tenant}, {version} or {endpoint}", c.pathTemplate)
+	}
+
+	return p, nil
 }
 
 // observatoriumAPIFetcher fetches rules for a tenant from Observatorium API.
 type observatoriumAPIFetcher struct {
 	endpoint *url.URL
 	client   *http.Client
+	format   string
 }
 
-func newObservatoriumAPIFetcher(baseURL string, tenant string, client *http.Client) (*observatoriumAPIFetcher, error) {
+func newObservatoriumAPIFetcher(baseURL string, tenant string, api observatoriumAPIConfig, format string, client *http.Client) (*observatoriumAPIFetcher, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse Observatorium API URL: %w", err)
 	}
 
-	u.Path = path.Join("/api/metrics/v1", tenant, "/api/v1/rules/raw")
+	p, err := api.path(tenant)
+	if err != nil {
+		return nil, err
+	}
+	// The path of the URL is kept, for an API mounted under a sub-path.
+	u.Path = path.Join("/", u.Path, p)
 
 	return &observatoriumAPIFetcher{
 		endpoint: u,
 		client:   client,
+		format:   format,
 	}, nil
 }
 
-func (f *observatoriumAPIFetcher) getRules(ctx context.Context) (io.ReadCloser, error) {
+func (f *observatoriumAPIFetcher) getRules(ctx context.Context) (*rulesPayload, error) {
 	req, err := http.NewRequest(http.MethodGet, f.endpoint.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req = req.WithContext(ctx)
+	req.Header.Set("Accept", acceptHeader(f.format))
 
 	res, err := f.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to do http request: %w", err)
 	}
 	if res.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("got unexpected status from Observatorium API: %d", res.StatusCode)
+		res.Body.Close()
+		if err := throttled(res); err != nil {
+			return nil, err
+		}
+		return nil, &unexpectedStatusError{from: "Observatorium API", code: res.StatusCode}
 	}
 
-	return res.Body, nil
+	return newRulesPayload(res), nil
 }
 
 // rulesBackendFetcher fetches rules for all tenants from Rules Storage Backend.
 type rulesBackendFetcher struct {
 	client rulesspec.ClientInterface
+	format string
 }
 
-func newRulesBackendFetcher(baseURL string, client *http.Client) (*rulesBackendFetcher, error) {
+func newRulesBackendFetcher(baseURL string, format string, client *http.Client) (*rulesBackendFetcher, error) {
 	rulesClient, err := rulesspec.NewClient(baseURL, rulesspec.WithHTTPClient(client))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create rules backend client: %w", err)
@@ -66,17 +173,104 @@ func newRulesBackendFetcher(baseURL string, client *http.Client) (*rulesBackendF
 
 	return &rulesBackendFetcher{
 		client: rulesClient,
+		format: format,
 	}, nil
 }
 
-func (f *rulesBackendFetcher) getRules(ctx context.Context) (io.ReadCloser, error) {
-	res, err := f.client.ListAllRules(ctx)
+func (f *rulesBackendFetcher) getRules(ctx context.Context) (*rulesPayload, error) {
+	res, err := f.client.ListAllRules(ctx, func(_ context.Context, req *http.Request) error {
+		req.Header.Set("Accept", acceptHeader(f.format))
+		return nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to do http request: %w", err)
 	}
 	if res.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("got unexpected status from rules backend: %d", res.StatusCode)
+		res.Body.Close()
+		if err := throttled(res); err != nil {
+			return nil, err
+		}
+		return nil, &unexpectedStatusError{from: "rules backend", code: res.StatusCode}
+	}
+
+	return newRulesPayload(res), nil
+}
+
+// maxThrottleBackoff caps the backoff applied when a throttled response carries no Retry-After header.
+const maxThrottleBackoff = 10 * time.Minute
+
+// unexpectedStatusError is returned when a server answered with a status other than 2xx.
+type unexpectedStatusError struct {
+	from string
+	code int
+}
+
+func (e *unexpectedStatusError) Error() string {
+	return fmt.Sprintf("got unexpected status from %s: %d", e.from, e.code)
+}
+
+// throttledError is returned when the backend answered with 429 or 503, asking us to slow down.
+type throttledError struct {
+	code       int
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("throttled by backend with status %d, retry after %s", e.code, e.retryAfter)
 	}
+	return fmt.Sprintf("throttled by backend with status %d", e.code)
+}
 
-	return res.Body, nil
+// delay returns how long to wait before the next attempt.
+// The backend's Retry-After is honored but never makes us poll faster than the interval.
+// Without Retry-After, the interval is doubled for every consecutive throttled attempt.
+func (e *throttledError) delay(interval time.Duration, attempt int) time.Duration {
+	if e.retryAfter > 0 {
+		if e.retryAfter < interval {
+			return interval
+		}
+		return e.retryAfter
+	}
+
+	if interval >= maxThrottleBackoff {
+		return interval
+	}
+	d := interval
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= maxThrottleBackoff {
+			return maxThrottleBackoff
+		}
+	}
+	return d
+}
+
+// throttled returns a throttledError if the response is a 429 or 503, nil otherwise.
+func throttled(res *http.Response) error {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+
+	return &throttledError{
+		code:       res.StatusCode,
+		retryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationValue is a flag.Value for Go durations like 60s, 2m or 1h.
+// Bare integers are read as seconds, for compatibility with flags that used to be given in seconds.
+type durationValue time.Duration
+
+func (d *durationValue) Set(s string) error {
+	if secs, err := strconv.ParseUint(s, 10, 64); err == nil {
+		*d = durationValue(time.Duration(secs) * time.Second)
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("must be a duration like 60s or 2m, or an integer number of seconds: %w", err)
+	}
+	*d = durationValue(v)
+
+	return nil
+}
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+// durationVar defines a duration flag that also accepts bare integers as seconds.
+func durationVar(p *time.Duration, name string, value time.Duration, usage string) {
+	*p = value
+	flag.Var((*durationValue)(p), name, usage)
+}
+
+// durationBounds is the range a duration flag must be in.
+type durationBounds struct {
+	name     string
+	value    time.Duration
+	min, max time.Duration
+}
+
+// checkDurationBounds returns an error for the first flag out of its bounds.
+func checkDurationBounds(bounds ...durationBounds) error {
+	for _, b := range bounds {
+		if b.value < b.min || b.value > b.max {
+			return fmt.Errorf("-%s must be between %s and %s, got %s", b.name, b.min, b.max, b.value)
+		}
+	}
+
+	return nil
+}
+
+// listValue is a flag.Value collecting a comma-separated list of values or values given by repeating the flag.
+type listValue []string
+
+func (l *listValue) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+
+	return nil
+}
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+// labelsValue is a flag.Value collecting labels given as a comma-separated list of name=value pairs or by repeating the flag.
+type labelsValue map[string]string
+
+func (l *labelsValue) Set(s string) error {
+	if *l == nil {
+		*l = make(labelsValue)
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return fmt.Errorf("must be a list of name=value pairs, got %q", pair)
+		}
+		(*l)[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+
+	return nil
+}
+
+func (l *labelsValue) String() string {
+	pairs := make([]string, 0, len(*l))
+	for name, value := range *l {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
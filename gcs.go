@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcsEndpoint  = "https://storage.googleapis.com"
+	gcsReadScope = "https://www.googleapis.com/auth/devstorage.read_only"
+	// gcsEmulatorHostEnv points at an emulator like fake-gcs-server, which is used without authentication,
+	// the same as with the Google Cloud client libraries.
+	gcsEmulatorHostEnv = "STORAGE_EMULATOR_HOST"
+)
+
+type gcsConfig struct {
+	bucket string
+	prefix string
+}
+
+// gcsStore reads the objects of a Google Cloud Storage bucket with the JSON API.
+type gcsStore struct {
+	endpoint string
+	bucket   string
+	client   *http.Client
+}
+
+// newGCSStore authenticates with Application Default Credentials, e.g. a service account key file given by GOOGLE_APPLICATION_CREDENTIALS
+// or the service account of the GKE workload.
+func newGCSStore(ctx context.Context, cfg gcsConfig, base http.RoundTripper) (*gcsStore, error) {
+	if host := os.Getenv(gcsEmulatorHostEnv); host != "" {
+		return &gcsStore{endpoint: "http://" + host, bucket: cfg.bucket, client: &http.Client{Transport: base}}, nil
+	}
+
+	creds, err := google.FindDefaultCredentials(ctx, gcsReadScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Google Application Default Credentials: %w", err)
+	}
+
+	return &gcsStore{
+		endpoint: gcsEndpoint,
+		bucket:   cfg.bucket,
+		client: &http.Client{
+			Transport: &oauth2.Transport{Base: base, Source: creds.TokenSource},
+		},
+	}, nil
+}
+
+func (s *gcsStore) do(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		if err := throttled(res); err != nil {
+			return nil, err
+		}
+		return nil, &unexpectedStatusError{from: "Google Cloud Storage", code: res.StatusCode}
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return b, nil
+}
+
+func (s *gcsStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	pageToken := ""
+	for {
+		query := url.Values{"fields": []string{"items(name),nextPageToken"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		b, err := s.do(ctx, s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects of bucket %s: %w", s.bucket, err)
+		}
+
+		var res struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			return nil, fmt.Errorf("failed to decode objects of bucket %s: %w", s.bucket, err)
+		}
+		for _, item := range res.Items {
+			names = append(names, item.Name)
+		}
+		if res.NextPageToken == "" {
+			return names, nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+func (s *gcsStore) get(ctx context.Context, name string) ([]byte, error) {
+	// The name is a single path segment of the JSON API, slashes included.
+	b, err := s.do(ctx, s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o/"+url.PathEscape(name)+"?alt=media")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", name, err)
+	}
+
+	return b, nil
+}
+
+// source describes the bucket and prefix, as shown on the status page.
+func (s *gcsStore) source(prefix string) string {
+	return "gs://" + s.bucket + "/" + prefix
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// grafanaRulerPath is the Cortex compatible ruler API of Grafana Alerting serving the Grafana-managed rules, by folder.
+const grafanaRulerPath = "/api/ruler/grafana/api/v1/rules"
+
+// grafanaExprDatasource is the datasource of the server-side expressions of Grafana, e.g. reduce and threshold.
+const grafanaExprDatasource = "__expr__"
+
+// grafanaOrgHeader selects the organization of the rules.
+const grafanaOrgHeader = "X-Grafana-Org-Id"
+
+type grafanaConfig struct {
+	url       string
+	tokenFile string
+	orgID     string
+	// datasourceUIDs are the datasources whose queries are PromQL. If empty, every query with an expr is taken for PromQL.
+	datasourceUIDs listValue
+}
+
+// grafanaRuleGroup is a rule group of the ruler API of Grafana.
+type grafanaRuleGroup struct {
+	Name     string        `json:"name"`
+	Interval string        `json:"interval"`
+	Rules    []grafanaRule `json:"rules"`
+}
+
+type grafanaRule struct {
+	For          string            `json:"for"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	GrafanaAlert struct {
+		Title     string         `json:"title"`
+		Condition string         `json:"condition"`
+		Data      []grafanaQuery `json:"data"`
+		IsPaused  bool           `json:"is_paused"`
+		Record    *struct {
+			Metric string `json:"metric"`
+			From   string `json:"from"`
+		} `json:"record"`
+	} `json:"grafana_alert"`
+}
+
+type grafanaQuery struct {
+	RefID             string `json:"refId"`
+	DatasourceUID     string `json:"datasourceUid"`
+	RelativeTimeRange struct {
+		From int64 `json:"from"`
+		To   int64 `json:"to"`
+	} `json:"relativeTimeRange"`
+	Model struct {
+		Expr       string `json:"expr"`
+		Type       string `json:"type"`
+		Expression string `json:"expression"`
+		Reducer    string `json:"reducer"`
+		Conditions []struct {
+			Evaluator struct {
+				Type   string    `json:"type"`
+				Params []float64 `json:"params"`
+			} `json:"evaluator"`
+		} `json:"conditions"`
+	} `json:"model"`
+}
+
+// grafanaReducers are the reducers of Grafana converted to functions over the relative time range of the query.
+// last is the instant value of the query.
+var grafanaReducers = map[string]string{
+	"mean":  "avg_over_time",
+	"min":   "min_over_time",
+	"max":   "max_over_time",
+	"sum":   "sum_over_time",
+	"count": "count_over_time",
+}
+
+// grafanaOperators are the evaluators of the threshold expressions of Grafana comparing to a single value.
+var grafanaOperators = map[string]string{
+	"gt":  ">",
+	"lt":  "<",
+	"gte": ">=",
+	"lte": "<=",
+	"eq":  "==",
+	"ne":  "!=",
+}
+
+// grafanaFetcher fetches the Grafana-managed rules of Grafana Alerting and converts them to Prometheus rules,
+// so that Thanos Ruler evaluates them. Rules that do not convert, e.g. rules with math expressions
+// or queries of other datasources, are left out and reported. It is safe for concurrent use, e.g. by a preview during a cycle.
+type grafanaFetcher struct {
+	endpoint    *url.URL
+	client      *http.Client
+	cfg         grafanaConfig
+	datasources map[string]struct{}
+	logPrefix   string
+
+	unconvertible prometheus.Gauge
+
+	mu sync.Mutex
+	// skipped are the last unconvertible rules logged, so that they are logged once rather than every cycle.
+	skipped string
+}
+
+func newGrafanaFetcher(cfg grafanaConfig, client *http.Client) (*grafanaFetcher, error) {
+	u, err := url.Parse(cfg.url)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid -grafana.url %q, must be a URL like https://grafana.example.com", redactURL(cfg.url))
+	}
+	// The path of the URL is kept, for a Grafana served from a sub-path.
+	u.Path = path.Join("/", u.Path, grafanaRulerPath)
+
+	datasources := make(map[string]struct{}, len(cfg.datasourceUIDs))
+	for _, uid := range cfg.datasourceUIDs {
+		datasources[uid] = struct{}{}
+	}
+
+	return &grafanaFetcher{endpoint: u, client: client, cfg: cfg, datasources: datasources}, nil
+}
+
+func (f *grafanaFetcher) getRules(ctx context.Context) (*rulesPayload, error) {
+	req, err := http.NewRequest(http.MethodGet, f.endpoint.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if f.cfg.orgID != "" {
+		req.Header.Set(grafanaOrgHeader, f.cfg.orgID)
+	}
+	if f.cfg.tokenFile != "" {
+		// The token is read for every request, as the file of a mounted Secret is updated when it is rotated.
+		token, err := os.ReadFile(f.cfg.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the Grafana token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		if err := throttled(res); err != nil {
+			return nil, err
+		}
+		return nil, &unexpectedStatusError{from: "Grafana", code: res.StatusCode}
+	}
+
+	var folders map[string][]grafanaRuleGroup
+	if err := json.NewDecoder(res.Body).Decode(&folders); err != nil {
+		return nil, fmt.Errorf("failed to decode the rules of Grafana: %w", err)
+	}
+	rgs, skipped := f.convert(folders)
+	f.report(skipped)
+
+	b, err := yaml.Marshal(rgs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the converted rules of Grafana: %w", err)
+	}
+
+	return &rulesPayload{body: io.NopCloser(bytes.NewReader(b)), contentType: "application/yaml"}, nil
+}
+
+// convert converts the rule groups of every folder to groups named <folder>/<group>, the alerts labeled with their folder as Grafana does.
+// It returns the reasons the rules that were left out did not convert.
+func (f *grafanaFetcher) convert(folders map[string][]grafanaRuleGroup) (*ruleGroups, []string) {
+	names := make([]string, 0, len(folders))
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rgs := &ruleGroups{Groups: []ruleGroup{}}
+	var skipped []string
+	for _, folder := range names {
+		for _, g := range folders[folder] {
+			name := folder + "/" + g.Name
+			rg := ruleGroup{Name: name, Interval: g.Interval, Rules: []rule{}}
+			for _, gr := range g.Rules {
+				if gr.GrafanaAlert.IsPaused {
+					continue
+				}
+				r, err := f.convertRule(gr)
+				if err != nil {
+					skipped = append(skipped, fmt.Sprintf("%s of group %q: %v", grafanaRuleName(gr), name, err))
+					continue
+				}
+				if r.Alert != "" {
+					if r.Labels == nil {
+						r.Labels = map[string]string{}
+					}
+					r.Labels["grafana_folder"] = folder
+				}
+				rg.Rules = append(rg.Rules, r)
+			}
+			if len(rg.Rules) > 0 {
+				rgs.Groups = append(rgs.Groups, rg)
+			}
+		}
+	}
+
+	return rgs, skipped
+}
+
+func grafanaRuleName(gr grafanaRule) string {
+	if gr.GrafanaAlert.Record != nil {
+		return "recording rule " + gr.GrafanaAlert.Record.Metric
+	}
+
+	return fmt.Sprintf("alert %q", gr.GrafanaAlert.Title)
+}
+
+func (f *grafanaFetcher) convertRule(gr grafanaRule) (rule, error) {
+	queries := make(map[string]grafanaQuery, len(gr.GrafanaAlert.Data))
+	for _, q := range gr.GrafanaAlert.Data {
+		queries[q.RefID] = q
+	}
+
+	if rec := gr.GrafanaAlert.Record; rec != nil {
+		expr, err := f.value(queries, rec.From)
+		if err != nil {
+			return rule{}, err
+		}
+		return rule{Record: rec.Metric, Expr: expr, Labels: gr.Labels}, nil
+	}
+
+	cond, ok := queries[gr.GrafanaAlert.Condition]
+	if !ok {
+		return rule{}, fmt.Errorf("condition %q is not one of its queries", gr.GrafanaAlert.Condition)
+	}
+	var expr string
+	if cond.DatasourceUID == grafanaExprDatasource && cond.Model.Type == "threshold" {
+		var err error
+		if expr, err = f.threshold(queries, cond); err != nil {
+			return rule{}, err
+		}
+	} else {
+		// Grafana fires for the series of the condition that are not zero.
+		value, err := f.value(queries, cond.RefID)
+		if err != nil {
+			return rule{}, err
+		}
+		expr = "(" + value + ") != 0"
+	}
+
+	return rule{Alert: gr.GrafanaAlert.Title, Expr: expr, For: gr.For, Labels: gr.Labels, Annotations: gr.Annotations}, nil
+}
+
+// threshold converts a threshold expression to a comparison of the value of its input.
+func (f *grafanaFetcher) threshold(queries map[string]grafanaQuery, q grafanaQuery) (string, error) {
+	if len(q.Model.Conditions) != 1 {
+		return "", fmt.Errorf("threshold %s has %d conditions, only a single one converts", q.RefID, len(q.Model.Conditions))
+	}
+	value, err := f.value(queries, q.Model.Expression)
+	if err != nil {
+		return "", err
+	}
+	ev := q.Model.Conditions[0].Evaluator
+	params := make([]string, len(ev.Params))
+	for i, p := range ev.Params {
+		params[i] = strconv.FormatFloat(p, 'g', -1, 64)
+	}
+
+	if op, ok := grafanaOperators[ev.Type]; ok && len(params) >= 1 {
+		return fmt.Sprintf("(%s) %s %s", value, op, params[0]), nil
+	}
+	switch {
+	case ev.Type == "within_range" && len(params) == 2:
+		return fmt.Sprintf("(%s) > %s < %s", value, params[0], params[1]), nil
+	case ev.Type == "outside_range" && len(params) == 2:
+		return fmt.Sprintf("(%s) < %s or (%s) > %s", value, params[0], value, params[1]), nil
+	}
+
+	return "", fmt.Errorf("threshold %s evaluates %s with %d parameters, which does not convert", q.RefID, ev.Type, len(params))
+}
+
+// value converts the query or the reduce expression of the given reference to PromQL.
+func (f *grafanaFetcher) value(queries map[string]grafanaQuery, refID string) (string, error) {
+	q, ok := queries[refID]
+	if !ok {
+		return "", fmt.Errorf("%q is not one of its queries", refID)
+	}
+	if q.DatasourceUID != grafanaExprDatasource {
+		return f.promQL(q)
+	}
+	if q.Model.Type != "reduce" {
+		return "", fmt.Errorf("expression %s is of type %s, only reduce and threshold convert", refID, q.Model.Type)
+	}
+
+	input, ok := queries[q.Model.Expression]
+	if !ok || input.DatasourceUID == grafanaExprDatasource {
+		return "", fmt.Errorf("reduce %s must reduce a query to convert", refID)
+	}
+	expr, err := f.promQL(input)
+	if err != nil {
+		return "", err
+	}
+	if q.Model.Reducer == "last" {
+		return expr, nil
+	}
+	fn, ok := grafanaReducers[q.Model.Reducer]
+	if !ok {
+		return "", fmt.Errorf("reducer %s of %s does not convert", q.Model.Reducer, refID)
+	}
+	if input.RelativeTimeRange.To != 0 || input.RelativeTimeRange.From <= 0 {
+		return "", fmt.Errorf("query %s must end now to reduce it with %s", input.RefID, q.Model.Reducer)
+	}
+
+	return fmt.Sprintf("%s((%s)[%ds:])", fn, expr, input.RelativeTimeRange.From), nil
+}
+
+// promQL returns the PromQL expression of a query, failing for queries of other datasources.
+func (f *grafanaFetcher) promQL(q grafanaQuery) (string, error) {
+	if len(f.datasources) > 0 {
+		if _, ok := f.datasources[q.DatasourceUID]; !ok {
+			return "", fmt.Errorf("query %s is of datasource %s, which is not one of -grafana.datasource-uids", q.RefID, q.DatasourceUID)
+		}
+	}
+	if q.Model.Expr == "" {
+		return "", fmt.Errorf("query %s has no PromQL expression", q.RefID)
+	}
+
+	return q.Model.Expr, nil
+}
+
+// report sets rule_syncer_grafana_unconvertible_rules and logs the unconvertible rules when they change.
+func (f *grafanaFetcher) report(skipped []string) {
+	if f.unconvertible != nil {
+		f.unconvertible.Set(float64(len(skipped)))
+	}
+	joined := strings.Join(skipped, "; ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if joined == f.skipped {
+		return
+	}
+	f.skipped = joined
+	for _, s := range skipped {
+		warnf("%sleaving out the Grafana rule %s", f.logPrefix, s)
+	}
+	if len(skipped) == 0 {
+		infof("%sall Grafana rules convert", f.logPrefix)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/rulespb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// grpcReconnectBackoff is the time to wait before reopening a failed WatchRules stream.
+const grpcReconnectBackoff = 5 * time.Second
+
+// grpcFetcher streams rules from a rules service with the WatchRules RPC of rulespb, instead of polling.
+// It keeps the latest rules received and triggers a sync whenever new rules arrive.
+type grpcFetcher struct {
+	address   string
+	conn      *grpc.ClientConn
+	client    rulespb.RulesClient
+	tenants   []string
+	logPrefix string
+	// updated is fired whenever new rules arrive.
+	updated trigger
+
+	mu     sync.Mutex
+	latest *rulespb.WatchRulesResponse
+	// ready is closed once the first rules arrived.
+	ready chan struct{}
+}
+
+// newGRPCFetcher connects to the rules service lazily, so that it may start after the syncer.
+// Nil credentials connect in plaintext. Connections are dialed like those of the HTTP clients, see -http.ip-family.
+func newGRPCFetcher(address string, creds credentials.TransportCredentials, tenants []string, dial func(context.Context, string, string) (net.Conn, error)) (*grpcFetcher, error) {
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if creds != nil {
+		opts[0] = grpc.WithTransportCredentials(creds)
+	}
+	// gRPC dials unix domain sockets itself.
+	if !strings.HasPrefix(address, "unix:") {
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
+		}))
+	}
+	conn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+
+	return &grpcFetcher{
+		address: address,
+		conn:    conn,
+		client:  rulespb.NewRulesClient(conn),
+		tenants: tenants,
+		ready:   make(chan struct{}),
+	}, nil
+}
+
+// getRules returns the latest rules received, waiting for the first ones.
+// While the stream is reconnecting, the rules received last are returned.
+func (f *grpcFetcher) getRules(ctx context.Context) (*rulesPayload, error) {
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no rules received from %s yet: %w", f.address, ctx.Err())
+	}
+
+	f.mu.Lock()
+	latest := f.latest
+	f.mu.Unlock()
+
+	return &rulesPayload{
+		body:        io.NopCloser(bytes.NewReader(latest.Rules)),
+		contentType: latest.ContentType,
+	}, nil
+}
+
+// run keeps a WatchRules stream open until the context is done, reconnecting after failures.
+func (f *grpcFetcher) run(ctx context.Context) {
+	defer f.conn.Close()
+
+	for {
+		err := f.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		warnf("%sWatchRules stream from %s failed, reconnecting in %s: %v", f.logPrefix, f.address, grpcReconnectBackoff, err)
+
+		select {
+		case <-time.After(grpcReconnectBackoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *grpcFetcher) watch(ctx context.Context) error {
+	req := &rulespb.WatchRulesRequest{Tenants: f.tenants}
+	f.mu.Lock()
+	if f.latest != nil {
+		req.Version = f.latest.Version
+	}
+	f.mu.Unlock()
+
+	stream, err := f.client.WatchRules(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	debugf("%sopened WatchRules stream from %s", f.logPrefix, f.address)
+
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("stream closed by server")
+		}
+		if err != nil {
+			return err
+		}
+		debugf("%sreceived %d bytes of rules of version %q from %s", f.logPrefix, len(res.Rules), res.Version, f.address)
+
+		f.mu.Lock()
+		first := f.latest == nil
+		f.latest = res
+		f.mu.Unlock()
+		if first {
+			close(f.ready)
+		}
+		f.updated.fire()
+	}
+}
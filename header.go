@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// generatedMarker starts the header of the rules files written by the syncer, following the convention of generated files.
+const generatedMarker = "# Code generated by thanos-rule-syncer. DO NOT EDIT."
+
+// Keys of the header of the rules files.
+const (
+	headerGenerator   = "generator"
+	headerSource      = "source"
+	headerTenant      = "tenant"
+	headerTimestamp   = "timestamp"
+	headerContentHash = "content-hash"
+)
+
+// errNotOwned refuses to overwrite or remove a rules file lacking the header of the syncer, counted under the not_owned code.
+var errNotOwned = errors.New("the file lacks the header of the rules files written by thanos-rule-syncer, pass -force to overwrite it")
+
+// renderHeader returns the header the content is written with. The content hash is that of the content without the header,
+// as the hashes the syncer tracks the rules by are.
+func renderHeader(source, tenant string, at time.Time, hash string) []byte {
+	var b bytes.Buffer
+	b.WriteString(generatedMarker + "\n")
+	fmt.Fprintf(&b, "# %s: thanos-rule-syncer\n", headerGenerator)
+	if source != "" {
+		fmt.Fprintf(&b, "# %s: %s\n", headerSource, source)
+	}
+	if tenant != "" {
+		fmt.Fprintf(&b, "# %s: %s\n", headerTenant, tenant)
+	}
+	fmt.Fprintf(&b, "# %s: %s\n", headerTimestamp, at.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "# %s: %s\n", headerContentHash, hash)
+
+	return b.Bytes()
+}
+
+// parseHeader returns the fields of the header and the content following it, and false if the content has no header.
+func parseHeader(content []byte) (map[string]string, []byte, bool) {
+	if !bytes.HasPrefix(content, []byte(generatedMarker+"\n")) {
+		return nil, content, false
+	}
+
+	fields := make(map[string]string)
+	rest := content[len(generatedMarker)+1:]
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(rest[:i])
+		kv := strings.SplitN(strings.TrimPrefix(line, "# "), ": ", 2)
+		if !strings.HasPrefix(line, "# ") || len(kv) != 2 {
+			break
+		}
+		fields[kv[0]] = kv[1]
+		rest = rest[i+1:]
+		// The content hash ends the header, leaving the comments of the rules to them.
+		if kv[0] == headerContentHash {
+			break
+		}
+	}
+
+	return fields, rest, true
+}
+
+// stripHeader returns the content without the header, if any.
+func stripHeader(content []byte) []byte {
+	_, rest, _ := parseHeader(content)
+	return rest
+}
+
+// withHeader returns the content of the file prefixed with its header, after checking that the file on disk,
+// if any, was written by the syncer. The timestamp of the header on disk is kept while the content does not change,
+// so that rewriting unchanged rules leaves the file as it is.
+func (o *output) withHeader(f ruleFile, now time.Time) ([]byte, error) {
+	hash := contentHash(f.content)
+	at := now
+
+	fields, err := o.checkOwned(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if fields[headerContentHash] == hash {
+		if t, err := time.Parse(time.RFC3339, fields[headerTimestamp]); err == nil {
+			at = t
+		}
+	}
+
+	tenant := f.tenant
+	if tenant == "" {
+		tenant = o.tenant
+	}
+	header := renderHeader(o.source, tenant, at, hash)
+
+	return append(header, f.content...), nil
+}
+
+// checkOwned returns the header of the rules file on disk, failing with errNotOwned if the file lacks it, unless forced.
+// Missing and empty files, e.g. mounted ones, are overwritten.
+func (o *output) checkOwned(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file %s: %w", path, err)
+	}
+	fields, _, ok := parseHeader(content)
+	if ok || len(bytes.TrimSpace(content)) == 0 {
+		return fields, nil
+	}
+	if !o.force {
+		return nil, fmt.Errorf("refusing to replace the rules file %s: %w", path, errNotOwned)
+	}
+	warnf("%sreplacing the rules file %s lacking the header of the syncer, as forced", o.logPrefix, path)
+
+	return nil, nil
+}
+
+// truncatedFile tells whether the file on disk was cut short, its header or its content being the beginning of the file written.
+func truncatedFile(f, written ruleFile) bool {
+	raw, err := os.ReadFile(f.path)
+	if err != nil {
+		return false
+	}
+	if fields, _, ok := parseHeader(raw); ok && fields[headerContentHash] == "" {
+		return true
+	}
+
+	return len(f.content) < len(written.content) && bytes.HasPrefix(written.content, f.content)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runHealthcheck checks that the last successful sync is recent enough, for exec liveness probes of images without curl.
+// It asks /-/status of the internal server, or reads the history of -data.dir with the internal server left out.
+func runHealthcheck(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	address := fs.String("web.internal.listen", ":8083", "The address the internal server of the syncer listens on, a unix:///path/to.sock address included.")
+	pipeline := fs.String("pipeline", "", "The pipeline to check, with -config.file.")
+	caFile := fs.String("tls-ca-file", "", "The CA the certificate of the internal server is verified with. If specified, the internal server is asked over TLS.")
+	dataDir := fs.String("data.dir", "", "The data directory of the syncer. If specified, its history is read rather than asking the internal server.")
+	maxAge := fs.Duration("max-age", 0, "The age of the last successful sync above which the check fails. If 0, the -sync.staleness-threshold of the syncer is used.")
+	timeout := fs.Duration("timeout", 5*time.Second, "The deadline for asking the internal server.")
+	_ = fs.Parse(args)
+
+	now := time.Now()
+	if *dataDir != "" {
+		if *maxAge <= 0 {
+			return fmt.Errorf("-max-age is required with -data.dir")
+		}
+		return checkHistoryAge(*dataDir, *pipeline, *maxAge, now, stdout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	status, err := getStatus(ctx, *address, *pipeline, *caFile)
+	if err != nil {
+		return err
+	}
+
+	limit := *maxAge
+	if limit <= 0 && status.Config.Staleness != "" {
+		if limit, err = time.ParseDuration(status.Config.Staleness); err != nil {
+			return fmt.Errorf("invalid staleness threshold %q: %w", status.Config.Staleness, err)
+		}
+	}
+	if limit <= 0 {
+		return fmt.Errorf("no staleness limit, give -max-age or run the syncer with -sync.staleness-threshold")
+	}
+
+	if status.LastSuccess == nil {
+		// Before the first success, the syncer tells whether it has been trying for too long.
+		if status.Stale {
+			return fmt.Errorf("no sync succeeded within %s", limit)
+		}
+		fmt.Fprintln(stdout, "no sync succeeded yet")
+		return nil
+	}
+
+	return checkAge(*status.LastSuccess, limit, now, stdout)
+}
+
+func checkAge(lastSuccess time.Time, limit time.Duration, now time.Time, stdout io.Writer) error {
+	age := now.Sub(lastSuccess).Round(time.Second)
+	if age > limit {
+		return fmt.Errorf("the last successful sync was %s ago, more than %s", age, limit)
+	}
+	fmt.Fprintf(stdout, "the last successful sync was %s ago\n", age)
+
+	return nil
+}
+
+// checkHistoryAge checks the last successful cycle recorded in the data directory.
+func checkHistoryAge(dataDir, pipeline string, limit time.Duration, now time.Time, stdout io.Writer) error {
+	if pipeline != "" {
+		dataDir = filepath.Join(dataDir, tenantFileName(pipeline))
+	}
+	path := filepath.Join(dataDir, historyDBFile)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no history in %s: %w", dataDir, err)
+	}
+
+	s := &historyStore{path: path}
+	cycles, err := s.recent(0)
+	if err != nil {
+		return err
+	}
+	for _, c := range cycles {
+		if c.Error == "" {
+			return checkAge(c.Start.Add(c.Duration), limit, now, stdout)
+		}
+	}
+
+	return fmt.Errorf("no successful sync in the history of %s", dataDir)
+}
+
+// getStatus asks /-/status of the internal server, authenticating with the credentials the syncer takes from the environment.
+func getStatus(ctx context.Context, address, pipeline, caFile string) (*syncStatus, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+
+	scheme := "http"
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read -tls-ca-file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in -tls-ca-file")
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		scheme = "https"
+	}
+
+	host := address
+	if path, ok := unixSocketPath(address); ok {
+		t = unixSocketTransport(t, path)
+		host = "localhost"
+	} else if h, port, err := net.SplitHostPort(address); err == nil {
+		// The internal server listening on all addresses is asked on the loopback address of the family.
+		switch ip := net.ParseIP(h); {
+		case h == "":
+			host = net.JoinHostPort("localhost", port)
+		case ip != nil && ip.IsUnspecified() && ip.To4() == nil:
+			host = net.JoinHostPort("::1", port)
+		case ip != nil && ip.IsUnspecified():
+			host = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+
+	u := url.URL{Scheme: scheme, Host: host, Path: "/-/status"}
+	if pipeline != "" {
+		u.RawQuery = url.Values{"pipeline": []string{pipeline}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := internalAuthFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if auth.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+auth.bearerToken)
+	} else if auth.username != "" {
+		req.SetBasicAuth(auth.username, auth.password)
+	}
+
+	client := &http.Client{Transport: t}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask the internal server: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return nil, &unexpectedStatusError{from: "the internal server", code: res.StatusCode}
+	}
+
+	var status syncStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode the status: %w", err)
+	}
+
+	return &status, nil
+}
+
+// internalAuthFromEnv reads the credentials of the internal server set in the environment of the syncer, see applyEnv.
+func internalAuthFromEnv() (internalAuth, error) {
+	var auth internalAuth
+	for name, v := range map[string]*string{
+		"web.internal.bearer-token":        &auth.bearerToken,
+		"web.internal.basic-auth-username": &auth.username,
+		"web.internal.basic-auth-password": &auth.password,
+	} {
+		value, _, err := envValue(envName(name), os.LookupEnv)
+		if err != nil {
+			return auth, err
+		}
+		*v = value
+	}
+
+	return auth, nil
+}
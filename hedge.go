@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// hedgeWindow is the number of recent latencies the delay of the hedged requests is computed from.
+	hedgeWindow = 100
+	// minHedgeSamples is the number of latencies observed before requests are hedged, so that a cold start does not hedge them all.
+	minHedgeSamples = 20
+)
+
+type hedgeConfig struct {
+	enabled  bool
+	minDelay time.Duration
+}
+
+// hedgingTransport hedges the fetches: if the backend has not answered a request after the 99th percentile of the recent latencies,
+// e.g. as a replica behind the load balancer hangs, the request is sent once more and the first response is taken, the other canceled.
+// Only requests without body are hedged, as they are safe to repeat.
+type hedgingTransport struct {
+	next     http.RoundTripper
+	minDelay time.Duration
+
+	// hedged and won are set once the metrics of the syncer exist.
+	hedged prometheus.Counter
+	won    prometheus.Counter
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	// nextIndex is the index the next latency is recorded at, once the window is full.
+	nextIndex int
+}
+
+type hedgeAttempt struct {
+	res    *http.Response
+	err    error
+	index  int
+	took   time.Duration
+	cancel context.CancelFunc
+}
+
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay, ok := t.delay()
+	if !ok || (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.Body != http.NoBody) {
+		start := time.Now()
+		res, err := t.next.RoundTrip(req)
+		if err == nil {
+			t.observe(time.Since(start))
+		}
+		return res, err //nolint:wrapcheck
+	}
+
+	attempts := make(chan hedgeAttempt, 2)
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			res, err := t.next.RoundTrip(req.Clone(ctx))
+			attempts <- hedgeAttempt{res: res, err: err, index: index, took: time.Since(start), cancel: cancel}
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			send()
+			pending++
+			if t.hedged != nil {
+				t.hedged.Inc()
+			}
+		case a := <-attempts:
+			pending--
+			// A failed attempt waits for the other one, if any is in flight.
+			if a.err != nil && pending > 0 {
+				a.cancel()
+				continue
+			}
+			// The response that came first wins, the attempt still in flight is canceled and its response discarded.
+			for i, cancel := range cancels {
+				if i != a.index {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go discardHedgeAttempts(attempts, pending)
+			}
+			if a.err != nil {
+				return nil, a.err //nolint:wrapcheck
+			}
+			t.observe(a.took)
+			if a.index > 0 && t.won != nil {
+				t.won.Inc()
+			}
+			a.res.Body = &cancelOnClose{ReadCloser: a.res.Body, cancel: a.cancel}
+			return a.res, nil
+		}
+	}
+}
+
+// discardHedgeAttempts closes the responses of the attempts that lost, already canceled.
+func discardHedgeAttempts(attempts <-chan hedgeAttempt, n int) {
+	for i := 0; i < n; i++ {
+		a := <-attempts
+		if a.res != nil {
+			a.res.Body.Close()
+		}
+		a.cancel()
+	}
+}
+
+// delay returns the 99th percentile of the recent latencies, or at least the minimum delay, and false if too few are known yet.
+func (t *hedgingTransport) delay() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.latencies) < minHedgeSamples {
+		return 0, false
+	}
+
+	sorted := make([]time.Duration, len(t.latencies))
+	copy(sorted, t.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p99 := sorted[(len(sorted)*99+99)/100-1]
+	if p99 < t.minDelay {
+		p99 = t.minDelay
+	}
+
+	return p99, true
+}
+
+// observe records the time the backend took to answer.
+func (t *hedgingTransport) observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.latencies) < hedgeWindow {
+		t.latencies = append(t.latencies, d)
+		return
+	}
+	t.latencies[t.nextIndex] = d
+	t.nextIndex = (t.nextIndex + 1) % hedgeWindow
+}
+
+// cancelOnClose cancels the request of the winning attempt once its response is read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+
+	return err //nolint:wrapcheck
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	historyDBFile = "history.db"
+	// historyLockTimeout bounds the wait for the lock of the database, which is only held while reading or recording a cycle.
+	historyLockTimeout = 5 * time.Second
+)
+
+var (
+	cyclesBucket   = []byte("cycles")
+	payloadsBucket = []byte("payloads")
+)
+
+// storedFile is a rules file as kept in the history, so that it can be written again.
+type storedFile struct {
+	Path    string `json:"path"`
+	Tenant  string `json:"tenant,omitempty"`
+	Content []byte `json:"content"`
+}
+
+// historyStore persists the sync cycles and the rules files they wrote in a bbolt database.
+// The database is opened for every access only, so that the history subcommand can read it while the syncer runs.
+type historyStore struct {
+	path string
+	// retention is the number of cycles kept.
+	retention int
+}
+
+func newHistoryStore(dir string, retention int) (*historyStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir %s: %w", dir, err)
+	}
+
+	s := &historyStore{path: filepath.Join(dir, historyDBFile), retention: retention}
+	// Create the database and its buckets right away, so that a broken data dir fails at startup.
+	if err := s.update(func(*bolt.Tx) error { return nil }); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *historyStore) open(readOnly bool) (*bolt.DB, error) {
+	//nolint:exhaustivestruct
+	db, err := bolt.Open(s.path, 0o644, &bolt.Options{Timeout: historyLockTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history database %s: %w", s.path, err)
+	}
+
+	return db, nil
+}
+
+func (s *historyStore) update(fn func(*bolt.Tx) error) error {
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{cyclesBucket, payloadsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %w", b, err)
+			}
+		}
+
+		return fn(tx)
+	})
+}
+
+func (s *historyStore) view(fn func(*bolt.Tx) error) error {
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
+// cycleKey orders cycles by their start time.
+func cycleKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+
+	return k
+}
+
+// record stores a cycle and, if it wrote files, their content keyed by hash.
+// Cycles beyond the retention are removed together with the files no remaining cycle refers to.
+func (s *historyStore) record(c cycleRecord) error {
+	v, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sync cycle: %w", err)
+	}
+
+	return s.update(func(tx *bolt.Tx) error {
+		cycles, payloads := tx.Bucket(cyclesBucket), tx.Bucket(payloadsBucket)
+		if err := cycles.Put(cycleKey(c.Start), v); err != nil {
+			return fmt.Errorf("failed to store sync cycle: %w", err)
+		}
+
+		if c.Hash != "" && c.files != nil && payloads.Get([]byte(c.Hash)) == nil {
+			stored := make([]storedFile, 0, len(c.files))
+			for _, f := range c.files {
+				stored = append(stored, storedFile{Path: f.path, Tenant: f.tenant, Content: f.content})
+			}
+			p, err := json.Marshal(stored)
+			if err != nil {
+				return fmt.Errorf("failed to marshal rules files: %w", err)
+			}
+			if err := payloads.Put([]byte(c.Hash), p); err != nil {
+				return fmt.Errorf("failed to store rules files: %w", err)
+			}
+		}
+
+		return s.prune(cycles, payloads)
+	})
+}
+
+func (s *historyStore) prune(cycles, payloads *bolt.Bucket) error {
+	if s.retention <= 0 {
+		return nil
+	}
+
+	// Stats do not account for the changes of the transaction in progress, so the cycles are counted.
+	excess := -s.retention
+	c := cycles.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		excess++
+	}
+	if excess <= 0 {
+		return nil
+	}
+
+	for k, _ := c.First(); k != nil && excess > 0; k, _ = c.Next() {
+		if err := c.Delete(); err != nil {
+			return fmt.Errorf("failed to remove old sync cycle: %w", err)
+		}
+		excess--
+	}
+
+	referenced := make(map[string]struct{})
+	if err := cycles.ForEach(func(_, v []byte) error {
+		var rc cycleRecord
+		if err := json.Unmarshal(v, &rc); err == nil && rc.Hash != "" {
+			referenced[rc.Hash] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	var stale [][]byte
+	if err := payloads.ForEach(func(k, _ []byte) error {
+		if _, ok := referenced[string(k)]; !ok {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return err //nolint:wrapcheck
+	}
+	for _, k := range stale {
+		if err := payloads.Delete(k); err != nil {
+			return fmt.Errorf("failed to remove old rules files: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// recent returns up to n cycles, the most recent first.
+func (s *historyStore) recent(n int) ([]cycleRecord, error) {
+	var cycles []cycleRecord
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(cyclesBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && (n <= 0 || len(cycles) < n); k, v = c.Prev() {
+			var rc cycleRecord
+			if err := json.Unmarshal(v, &rc); err != nil {
+				return fmt.Errorf("failed to unmarshal sync cycle: %w", err)
+			}
+			cycles = append(cycles, rc)
+		}
+		return nil
+	})
+
+	return cycles, err
+}
+
+// files returns the rules files written by a cycle with the given hash.
+func (s *historyStore) files(hash string) ([]ruleFile, error) {
+	var files []ruleFile
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(payloadsBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(hash))
+		if v == nil {
+			return fmt.Errorf("no rules files stored for hash %s", hash)
+		}
+		var stored []storedFile
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return fmt.Errorf("failed to unmarshal rules files: %w", err)
+		}
+		for _, f := range stored {
+			rf := ruleFile{path: f.Path, tenant: f.Tenant, content: f.Content}
+			if rgs, _, err := parseRuleGroups(f.Content); err == nil {
+				rf.groups = rgs
+			}
+			files = append(files, rf)
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// runHistory implements the history subcommand, printing the recorded sync cycles.
+func runHistory(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	dataDir := fs.String("data.dir", "", "The data directory of the syncer holding the history. Required.")
+	limit := fs.Int("n", 20, "The number of most recent sync cycles to print. 0 prints all of them.")
+	asJSON := fs.Bool("json", false, "Print the sync cycles as JSON lines.")
+	_ = fs.Parse(args)
+
+	if *dataDir == "" {
+		return fmt.Errorf("-data.dir is required")
+	}
+	path := filepath.Join(*dataDir, historyDBFile)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no history in %s: %w", *dataDir, err)
+	}
+
+	s := &historyStore{path: path}
+	cycles, err := s.recent(*limit)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		for _, c := range cycles {
+			if err := enc.Encode(c); err != nil {
+				return err //nolint:wrapcheck
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tDURATION\tRESULT\tHASH\tBYTES\tGROUPS\tRULES\tCHANGES\tRELOAD")
+	for _, c := range cycles {
+		result := "ok"
+		if c.Error != "" {
+			result = "error: " + c.Error
+		}
+		reload := "-"
+		if c.Reloaded {
+			reload = "ok"
+			if c.ReloadError != "" {
+				reload = "error"
+			}
+		}
+		hash := c.Hash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+			c.Start.UTC().Format(time.RFC3339), c.Duration.Round(time.Millisecond), result, hash, c.Bytes, c.Groups, c.Rules, formatChanges(c.Changes), reload)
+	}
+
+	return w.Flush() //nolint:wrapcheck
+}
+
+// formatChanges summarizes the changes of a cycle on a single line, e.g. t1:+1-0~2.
+func formatChanges(changes map[string]deltaSummary) string {
+	if len(changes) == 0 {
+		return "-"
+	}
+
+	tenants := make([]string, 0, len(changes))
+	for t := range changes {
+		tenants = append(tenants, t)
+	}
+	sort.Strings(tenants)
+
+	parts := make([]string, 0, len(tenants))
+	for _, t := range tenants {
+		c := changes[t]
+		s := fmt.Sprintf("+%d-%d~%d", c.Added, c.Removed, c.Changed)
+		if t != "" {
+			s = t + ":" + s
+		}
+		parts = append(parts, s)
+	}
+
+	return strings.Join(parts, ",")
+}
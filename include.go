@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// includeDirective replaces an item of the groups of a payload, or of the rules of a group, by those of the file it refers to.
+	includeDirective = "$include"
+	// maxIncludeSize bounds the size of an included file.
+	maxIncludeSize = 16 << 20
+)
+
+type includeConfig struct {
+	maxDepth     int
+	baseURL      string
+	allowedHosts listValue
+}
+
+// includeResolver resolves the $include directives of fetched rules, e.g. `- $include: shared/slo.yaml` among the groups,
+// so that shared fragments can be composed into the rules of many tenants. Relative references are resolved against the URL
+// of the file they are in, the payload being at the base URL. Files are only included from the hosts allowed, redirects included,
+// over HTTPS if the base URL is, and from the directory of the base URL only if it is a file URL.
+// Only the files at the origin the rules are fetched from are fetched with the credentials of the syncer.
+type includeResolver struct {
+	// client authenticates the requests to the origin, and anonymous those to the other hosts.
+	client, anonymous *http.Client
+	origin            string
+	base              *url.URL
+	allowedHosts      map[string]bool
+	maxDepth          int
+	logPrefix         string
+}
+
+// newIncludeResolver returns a resolver fetching the files at the origin of source with client, and the others with anonymous.
+func newIncludeResolver(cfg includeConfig, source string, client, anonymous *http.Client) (*includeResolver, error) {
+	base, err := url.Parse(cfg.baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -include.base-url: %w", err)
+	}
+	r := &includeResolver{base: base, allowedHosts: map[string]bool{base.Host: true}, maxDepth: cfg.maxDepth}
+	for _, h := range cfg.allowedHosts {
+		r.allowedHosts[h] = true
+	}
+	if u, err := url.Parse(source); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		r.origin = urlOrigin(u)
+	}
+	// The clients are copied, as they must not follow redirects to the locations files are not included from.
+	r.client = &http.Client{Transport: client.Transport, Timeout: client.Timeout, CheckRedirect: r.checkRedirect(true)}
+	r.anonymous = &http.Client{Transport: anonymous.Transport, Timeout: anonymous.Timeout, CheckRedirect: r.checkRedirect(false)}
+
+	return r, nil
+}
+
+// urlOrigin returns the scheme and host of the URL.
+func urlOrigin(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host)
+}
+
+// checkRedirect refuses the redirects to the locations files are not included from, and those of authenticated requests leaving the origin,
+// as the credentials are added by the transport rather than as a header the client drops.
+func (r *includeResolver) checkRedirect(authenticated bool) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if err := r.allowed(req.URL); err != nil {
+			return fmt.Errorf("redirected to %s: %w", redactURL(req.URL.String()), err)
+		}
+		if authenticated && urlOrigin(req.URL) != r.origin {
+			return fmt.Errorf("redirected to %s: authenticated includes must not leave %s", redactURL(req.URL.String()), r.origin)
+		}
+		return nil
+	}
+}
+
+// allowed returns an error unless files are included from the HTTP URL.
+func (r *includeResolver) allowed(u *url.URL) error {
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	case r.base.Scheme == "https" && u.Scheme != "https":
+		return fmt.Errorf("files are only included over https, as -include.base-url is an https URL")
+	case !r.allowedHosts[u.Host]:
+		return fmt.Errorf("host %s is not allowed, see -include.allowed-hosts", u.Host)
+	}
+
+	return nil
+}
+
+// resolve returns the payload with its includes resolved, or as is along with false if it has none.
+func (r *includeResolver) resolve(ctx context.Context, payload []byte) ([]byte, bool, error) {
+	if !bytes.Contains(payload, []byte(includeDirective)) {
+		return payload, false, nil
+	}
+
+	var (
+		buf      bytes.Buffer
+		included int
+	)
+	dec := yaml.NewDecoder(bytes.NewReader(payload))
+	for {
+		var doc interface{}
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse rules: %w", err)
+		}
+		if m, ok := doc.(map[interface{}]interface{}); ok {
+			if groups, ok := m["groups"].([]interface{}); ok {
+				if m["groups"], err = r.expandGroups(ctx, groups, r.base, 0, &included); err != nil {
+					return nil, false, err
+				}
+			}
+		}
+		b, err := yaml.Marshal(doc)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal the rules with their includes: %w", err)
+		}
+		buf.WriteString("---\n")
+		buf.Write(b)
+	}
+	if included == 0 {
+		return payload, false, nil
+	}
+	debugf("%sresolved %d includes", r.logPrefix, included)
+
+	return buf.Bytes(), true, nil
+}
+
+// expandGroups replaces the includes among the groups by the groups of the files they refer to, and resolves the includes among their rules.
+func (r *includeResolver) expandGroups(ctx context.Context, items []interface{}, base *url.URL, depth int, included *int) ([]interface{}, error) {
+	expanded := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		groups, ref, err := r.include(ctx, item, "groups", base, depth, included)
+		if err != nil {
+			return nil, err
+		}
+		if ref == nil {
+			if g, ok := item.(map[interface{}]interface{}); ok {
+				if rules, ok := g["rules"].([]interface{}); ok {
+					if g["rules"], err = r.expandRules(ctx, rules, base, depth, included); err != nil {
+						return nil, err
+					}
+				}
+			}
+			expanded = append(expanded, item)
+			continue
+		}
+		groups, err = r.expandGroups(ctx, groups, ref, depth+1, included)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, groups...)
+	}
+
+	return expanded, nil
+}
+
+// expandRules replaces the includes among the rules of a group by the rules of the files they refer to.
+func (r *includeResolver) expandRules(ctx context.Context, items []interface{}, base *url.URL, depth int, included *int) ([]interface{}, error) {
+	expanded := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		rules, ref, err := r.include(ctx, item, "rules", base, depth, included)
+		if err != nil {
+			return nil, err
+		}
+		if ref == nil {
+			expanded = append(expanded, item)
+			continue
+		}
+		if rules, err = r.expandRules(ctx, rules, ref, depth+1, included); err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, rules...)
+	}
+
+	return expanded, nil
+}
+
+// include returns the items an include directive refers to and the URL they were read from, or a nil URL if the item is no include.
+// The file is a list of the items, or a mapping listing them under the key, e.g. a rules file for groups.
+func (r *includeResolver) include(ctx context.Context, item interface{}, key string, base *url.URL, depth int, included *int) ([]interface{}, *url.URL, error) {
+	m, ok := item.(map[interface{}]interface{})
+	if !ok || len(m) != 1 {
+		return nil, nil, nil
+	}
+	v, ok := m[includeDirective]
+	if !ok {
+		return nil, nil, nil
+	}
+	ref, ok := v.(string)
+	if !ok || ref == "" {
+		return nil, nil, fmt.Errorf("invalid %s %v, must be a relative path or a URL", includeDirective, v)
+	}
+	if depth >= r.maxDepth {
+		return nil, nil, fmt.Errorf("failed to include %s: includes are nested deeper than -include.max-depth %d", ref, r.maxDepth)
+	}
+
+	u, err := base.Parse(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s %q: %w", includeDirective, ref, err)
+	}
+	content, err := r.read(ctx, u)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to include %s: %w", redactURL(u.String()), err)
+	}
+	*included++
+
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", redactURL(u.String()), err)
+	}
+	if m, ok := doc.(map[interface{}]interface{}); ok {
+		doc = m[key]
+	}
+	items, ok := doc.([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("%s included as %s holds neither a list of them nor a mapping listing them under %q", redactURL(u.String()), key, key)
+	}
+
+	return items, u, nil
+}
+
+// read returns the content of an included file, unless its location is not allowed.
+func (r *includeResolver) read(ctx context.Context, u *url.URL) ([]byte, error) {
+	switch u.Scheme {
+	case "file":
+		// Payloads of remote backends must not read the files of the syncer.
+		if r.base.Scheme != "file" {
+			return nil, fmt.Errorf("files are only included from the local file system if -include.base-url is a file URL")
+		}
+		p, err := r.localPath(u)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		defer f.Close()
+		return readInclude(f)
+	case "http", "https":
+		if err := r.allowed(u); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, set -include.base-url to resolve relative paths", u.Scheme)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	client := r.anonymous
+	if r.origin != "" && urlOrigin(u) == r.origin {
+		client = r.client
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return nil, &unexpectedStatusError{from: u.Host, code: res.StatusCode}
+	}
+
+	return readInclude(res.Body)
+}
+
+// localPath returns the path of an included local file, which must be in the directory of the base URL, symbolic links resolved.
+func (r *includeResolver) localPath(u *url.URL) (string, error) {
+	dir := r.base.Path
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	root, err := filepath.EvalSymlinks(filepath.FromSlash(dir))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the directory of -include.base-url: %w", err)
+	}
+	p, err := filepath.EvalSymlinks(filepath.FromSlash(u.Path))
+	if err != nil {
+		return "", err //nolint:wrapcheck
+	}
+	if rel, err := filepath.Rel(root, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("files are only included from the directory of -include.base-url")
+	}
+
+	return p, nil
+}
+
+func readInclude(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxIncludeSize+1))
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	if len(b) > maxIncludeSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxIncludeSize)
+	}
+
+	return b, nil
+}
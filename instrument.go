@@ -1,12 +1,63 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 )
 
+// metricsConfig customizes the names and labels of all metrics, e.g. to aggregate the metrics of a fleet of syncers.
+type metricsConfig struct {
+	prefix      string
+	constLabels labelsValue
+}
+
+// metricLabels are the labels of the metrics of the syncer, which constant labels would clash with.
+var metricLabels = map[string]struct{}{
+	"pipeline": {},
+	"client":   {},
+	"code":     {},
+	"method":   {},
+	"stage":    {},
+	"type":     {},
+	"target":   {},
+	"tenant":   {},
+	"group":    {},
+	"rule":     {},
+	"reason":   {},
+}
+
+func (c metricsConfig) validate() error {
+	if c.prefix != "" && !model.IsValidMetricName(model.LabelValue(c.prefix+"x")) {
+		return fmt.Errorf("invalid -metrics.prefix %q, must be the beginning of a metric name", c.prefix)
+	}
+	for name := range c.constLabels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name %q in -metrics.const-labels", name)
+		}
+		if _, ok := metricLabels[name]; ok {
+			return fmt.Errorf("-metrics.const-labels must not set the %s label of the metrics of the syncer", name)
+		}
+	}
+
+	return nil
+}
+
+// wrap returns a registerer adding the prefix and the constant labels to the metrics registered with r.
+func (c metricsConfig) wrap(r prometheus.Registerer) prometheus.Registerer {
+	if c.prefix != "" {
+		r = prometheus.WrapRegistererWithPrefix(c.prefix, r)
+	}
+	if len(c.constLabels) > 0 {
+		r = prometheus.WrapRegistererWith(prometheus.Labels(c.constLabels), r)
+	}
+
+	return r
+}
+
 type roundTripperInstrumenter struct {
 	requestCounter  *prometheus.CounterVec
 	requestDuration *prometheus.HistogramVec
@@ -50,3 +101,253 @@ func (i *roundTripperInstrumenter) NewRoundTripper(name string, rt http.RoundTri
 		promhttp.InstrumentRoundTripperDuration(duration, rt),
 	)
 }
+
+type syncerMetrics struct {
+	errors             *prometheus.CounterVec
+	throttled          *prometheus.CounterVec
+	rulesBytes         prometheus.Gauge
+	tenantRulesBytes   *prometheus.GaugeVec
+	expiredRules       prometheus.Gauge
+	brokenRunbookLinks *prometheus.GaugeVec
+	ruleGroups         prometheus.Gauge
+	rules              *prometheus.GaugeVec
+	reloadUp           *prometheus.GaugeVec
+	stale              prometheus.Gauge
+	diskFull           prometheus.Gauge
+	// invalidGroupsDropped counts the groups dropped with -validate.policy=drop-invalid.
+	invalidGroupsDropped prometheus.Counter
+	// rejected is set by rejectionTracker.
+	rejected *prometheus.GaugeVec
+	// rulesLastChange is set by observeTenantChanges.
+	rulesLastChange *prometheus.GaugeVec
+
+	crossCheckDivergent prometheus.Gauge
+	crossCheckErrors    prometheus.Counter
+
+	reloadLockWait prometheus.Histogram
+
+	preflightExceeding *prometheus.CounterVec
+	preflightErrors    prometheus.Counter
+
+	grafanaUnconvertible prometheus.Gauge
+
+	hedgedRequests          prometheus.Counter
+	hedgedRequestsWon       prometheus.Counter
+	fetchResumes            prometheus.Counter
+	fetchChecksumMismatches prometheus.Counter
+
+	signedURLRefreshes       *prometheus.CounterVec
+	signedURLRefreshFailures prometheus.Counter
+}
+
+func newSyncerMetrics(r prometheus.Registerer) *syncerMetrics {
+	m := &syncerMetrics{
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_errors_total",
+				Help: "A counter for failed sync cycles by the failed stage, one of fetch, auth, validate, write or reload, and an HTTP status, errno or error class.",
+			},
+			[]string{"stage", "code"},
+		),
+		throttled: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_fetch_throttled_total",
+				Help: "A counter for fetches that were throttled by the backend with a 429 or 503 response.",
+			},
+			[]string{"code"},
+		),
+		rulesBytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_rules_bytes",
+				Help: "The size of the last fetched rules payload in bytes.",
+			},
+		),
+		tenantRulesBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_tenant_rules_bytes",
+				Help: "The size of the rules of a tenant in the rules files written by the last successful sync in bytes, see -limits.max-bytes-per-tenant.",
+			},
+			[]string{"tenant"},
+		),
+		expiredRules: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_expired_rules",
+				Help: "The number of alerts of the last payload past the time of their -expiry.annotation, left out of the rules but still in the backend.",
+			},
+		),
+		brokenRunbookLinks: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_broken_runbook_links",
+				Help: "The number of synced alerts of a tenant whose runbook link is broken, see -runbook.check.",
+			},
+			[]string{"tenant"},
+		),
+		ruleGroups: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_rule_groups",
+				Help: "The number of rule groups in the last fetched rules payload.",
+			},
+		),
+		rules: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_rules",
+				Help: "The number of rules in the last fetched rules payload by type.",
+			},
+			[]string{"type"},
+		),
+		reloadUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_reload_target_up",
+				Help: "Whether the last reload of a Thanos Ruler succeeded, by target.",
+			},
+			[]string{"target"},
+		),
+		stale: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_rules_stale",
+				Help: "Whether the rules are stale, as no sync succeeded within the staleness threshold.",
+			},
+		),
+		diskFull: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_disk_full",
+				Help: "Whether the last write of the rules files was refused, as their file system lacked the space to write them.",
+			},
+		),
+		invalidGroupsDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_invalid_groups_dropped_total",
+				Help: "A counter for invalid rule groups dropped from the fetched rules while applying the others, with -validate.policy=drop-invalid.",
+			},
+		),
+		rejected: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_rule_rejected_info",
+				Help: "The groups and rules refused by the validation of the last validated payload, by tenant, group and rule. The reasons are served by /-/rejections, as free-form text would make a series of every message.",
+			},
+			[]string{"tenant", "group", "rule"},
+		),
+		rulesLastChange: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_rules_last_change_timestamp_seconds",
+				Help: "The Unix time the rules of a tenant last changed, as of the hash of their content.",
+			},
+			[]string{"tenant"},
+		),
+		crossCheckDivergent: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_crosscheck_divergent_groups",
+				Help: "The number of rule groups of the tenant differing between the Rules Storage Backend and the Observatorium API at the last cross-check.",
+			},
+		),
+		crossCheckErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_crosscheck_errors_total",
+				Help: "A counter for cross-checks failing to get the rules of the Observatorium API.",
+			},
+		),
+		reloadLockWait: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "rule_syncer_reload_lock_wait_seconds",
+				Help:    "A histogram of the time waited for the reload lock of -reload.lock-lease before reloading, whether it was taken or not.",
+				Buckets: []float64{0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+			},
+		),
+		preflightExceeding: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_preflight_exceeding_rules_total",
+				Help: "A counter for new or changed recording rules whose expression exceeded a limit of the preflight, series or samples.",
+			},
+			[]string{"limit"},
+		),
+		preflightErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_preflight_errors_total",
+				Help: "A counter for preflight queries of recording rules failing against Thanos Query.",
+			},
+		),
+		grafanaUnconvertible: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rule_syncer_grafana_unconvertible_rules",
+				Help: "The number of Grafana-managed rules left out of the last fetch, as they do not convert to Prometheus rules.",
+			},
+		),
+		hedgedRequests: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_hedged_requests_total",
+				Help: "A counter for fetch requests sent once more as the backend had not answered them in time, see -fetch.hedge.",
+			},
+		),
+		hedgedRequestsWon: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_hedged_requests_won_total",
+				Help: "A counter for hedged fetch requests answered before the requests they hedged.",
+			},
+		),
+		fetchResumes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_fetch_resumes_total",
+				Help: "A counter for downloads of the rules resumed with a Range request after the connection broke, see -fetch.resume-attempts.",
+			},
+		),
+		fetchChecksumMismatches: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_fetch_checksum_mismatches_total",
+				Help: "A counter for downloads of the rules whose payload did not match the checksum of the backend.",
+			},
+		),
+		signedURLRefreshes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_signed_url_refreshes_total",
+				Help: "A counter for pre-signed URLs obtained from the refresh hook, by reason: initial, expiry or refused by the object storage.",
+			},
+			[]string{"reason"},
+		),
+		signedURLRefreshFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rule_syncer_signed_url_refresh_failures_total",
+				Help: "A counter for refresh hooks failing to hand out a pre-signed URL.",
+			},
+		),
+	}
+
+	if r != nil {
+		r.MustRegister(
+			m.errors,
+			m.throttled,
+			m.rulesBytes,
+			m.tenantRulesBytes,
+			m.expiredRules,
+			m.brokenRunbookLinks,
+			m.ruleGroups,
+			m.rules,
+			m.reloadUp,
+			m.stale,
+			m.diskFull,
+			m.invalidGroupsDropped,
+			m.rejected,
+			m.rulesLastChange,
+			m.crossCheckDivergent,
+			m.crossCheckErrors,
+			m.reloadLockWait,
+			m.preflightExceeding,
+			m.preflightErrors,
+			m.grafanaUnconvertible,
+			m.hedgedRequests,
+			m.hedgedRequestsWon,
+			m.fetchResumes,
+			m.fetchChecksumMismatches,
+			m.signedURLRefreshes,
+			m.signedURLRefreshFailures,
+		)
+	}
+
+	return m
+}
+
+func (m *syncerMetrics) observeRuleGroups(rgs *ruleGroups) {
+	alerting, recording := rgs.countRules()
+	m.ruleGroups.Set(float64(len(rgs.Groups)))
+	m.rules.WithLabelValues("alerting").Set(float64(alerting))
+	m.rules.WithLabelValues("recording").Set(float64(recording))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// internalAuth guards the internal server with a bearer token and/or basic auth.
+// When both are configured, either one grants access.
+type internalAuth struct {
+	bearerToken string
+	username    string
+	password    string
+}
+
+func (a internalAuth) enabled() bool {
+	return a.bearerToken != "" || a.username != ""
+}
+
+func (a internalAuth) authorized(r *http.Request) bool {
+	if a.bearerToken != "" {
+		const prefix = "Bearer "
+		if h := r.Header.Get("Authorization"); len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+			if secureCompare(h[len(prefix):], a.bearerToken) {
+				return true
+			}
+		}
+	}
+
+	if a.username != "" {
+		if user, pass, ok := r.BasicAuth(); ok && secureCompare(user, a.username) && secureCompare(pass, a.password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wrap rejects unauthorized requests to the handler.
+func (a internalAuth) wrap(h http.Handler) http.Handler {
+	if !a.enabled() {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			if a.username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="thanos-rule-syncer"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
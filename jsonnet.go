@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-jsonnet"
+)
+
+// formatJsonnet evaluates the payload as Jsonnet, which has no registered media type, whatever its Content-Type.
+const formatJsonnet = "jsonnet"
+
+// jsonnetSource names the payload in evaluation errors.
+const jsonnetSource = "<rules payload>"
+
+type jsonnetConfig struct {
+	importPaths listValue
+	extVars     labelsValue
+}
+
+// jsonnetEvaluator evaluates Jsonnet payloads into the JSON encoding of rule groups.
+type jsonnetEvaluator struct {
+	importPaths []string
+	extVars     map[string]string
+
+	mu sync.Mutex
+	// running is set while an evaluation runs, which may outlive the deadline of its cycle, as the VM cannot be stopped.
+	running bool
+}
+
+// evaluate evaluates the payload until the context is done. An evaluation past its deadline, e.g. of a payload that never
+// terminates, keeps running in the background, and no other evaluation is started until it returns.
+func (e *jsonnetEvaluator) evaluate(ctx context.Context, payload []byte) ([]byte, error) {
+	e.mu.Lock()
+	if e.running {
+		e.mu.Unlock()
+		return nil, errors.New("failed to evaluate Jsonnet rules: the evaluation of an earlier payload is still running past its deadline")
+	}
+	e.running = true
+	e.mu.Unlock()
+
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			e.mu.Lock()
+			e.running = false
+			e.mu.Unlock()
+		}()
+		// A VM per evaluation, as a VM caches the imported files, which may change between cycles.
+		vm := jsonnet.MakeVM()
+		vm.Importer(newJpathImporter(e.importPaths))
+		for name, value := range e.extVars {
+			vm.ExtVar(name, value)
+		}
+		out, err := vm.EvaluateAnonymousSnippet(jsonnetSource, string(payload))
+		done <- result{out: out, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to evaluate Jsonnet rules: %w", ctx.Err())
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to evaluate Jsonnet rules: %w", r.err)
+		}
+		return []byte(r.out), nil
+	}
+}
+
+// jpathImporter imports the files of the payloads from the -jsonnet.jpath directories only, like the FileImporter of Jsonnet
+// without the absolute paths and the paths leaving the directories, as payloads must not read other files of the syncer host,
+// e.g. its tokens and keys, into the rules.
+type jpathImporter struct {
+	// roots are the directories with their symbolic links resolved, those that do not exist left out.
+	roots []string
+	cache map[string]jpathImport
+}
+
+type jpathImport struct {
+	contents jsonnet.Contents
+	foundAt  string
+	err      error
+}
+
+func newJpathImporter(dirs []string) *jpathImporter {
+	i := &jpathImporter{cache: make(map[string]jpathImport)}
+	for _, d := range dirs {
+		root, err := filepath.Abs(d)
+		if err != nil {
+			continue
+		}
+		if root, err = filepath.EvalSymlinks(root); err != nil {
+			continue
+		}
+		i.roots = append(i.roots, root)
+	}
+
+	return i
+}
+
+// Import looks the path up next to the importing file, then in the directories like Jsonnet, the last one first.
+func (i *jpathImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	key := importedFrom + "\x00" + importedPath
+	if r, ok := i.cache[key]; ok {
+		return r.contents, r.foundAt, r.err
+	}
+	r := i.lookup(importedFrom, importedPath)
+	i.cache[key] = r
+
+	return r.contents, r.foundAt, r.err
+}
+
+func (i *jpathImporter) lookup(importedFrom, importedPath string) jpathImport {
+	clean := path.Clean(importedPath)
+	if path.IsAbs(importedPath) || filepath.IsAbs(importedPath) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return jpathImport{err: fmt.Errorf("import %q is not allowed: imports must be relative to the -jsonnet.jpath directories", importedPath)}
+	}
+
+	var dirs []string
+	// The payload itself has no directory.
+	if importedFrom != "" {
+		dirs = append(dirs, filepath.Dir(importedFrom))
+	}
+	for j := len(i.roots) - 1; j >= 0; j-- {
+		dirs = append(dirs, i.roots[j])
+	}
+	for _, dir := range dirs {
+		p := filepath.Join(dir, filepath.FromSlash(clean))
+		resolved, err := filepath.EvalSymlinks(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return jpathImport{err: fmt.Errorf("failed to resolve import %q: %w", importedPath, err)}
+		}
+		// Symbolic links must not leave the directories either.
+		if !i.within(resolved) {
+			return jpathImport{err: fmt.Errorf("import %q is not allowed: it resolves outside of the -jsonnet.jpath directories", importedPath)}
+		}
+		b, err := os.ReadFile(resolved)
+		if err != nil {
+			return jpathImport{err: fmt.Errorf("failed to read import %q: %w", importedPath, err)}
+		}
+		return jpathImport{contents: jsonnet.MakeContents(string(b)), foundAt: resolved}
+	}
+
+	return jpathImport{err: fmt.Errorf("couldn't open import %q: no match in the -jsonnet.jpath directories", importedPath)}
+}
+
+// within tells whether the path is in one of the directories.
+func (i *jpathImporter) within(p string) bool {
+	for _, root := range i.roots {
+		rel, err := filepath.Rel(root, p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Files of the service account mounted into pods.
+const (
+	serviceAccountDir           = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	serviceAccountTokenFile     = serviceAccountDir + "token"
+	serviceAccountCAFile        = serviceAccountDir + "ca.crt"
+	serviceAccountNamespaceFile = serviceAccountDir + "namespace"
+)
+
+type kubernetesConfig struct {
+	apiURL    string
+	tokenFile string
+	caFile    string
+	namespace string
+}
+
+// kubeClient is a minimal client of the Kubernetes API, authenticating with the token of a service account.
+type kubeClient struct {
+	url       *url.URL
+	tokenFile string
+	namespace string
+	client    *http.Client
+}
+
+// newKubeClient returns a client of the API server given by the configuration or, if none is given, of the cluster the syncer runs in.
+func newKubeClient(cfg kubernetesConfig, rt func(http.RoundTripper) http.RoundTripper) (*kubeClient, error) {
+	apiURL := cfg.apiURL
+	if apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes cluster, -kubernetes.api-url must be given")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kubernetes API URL: %w", err)
+	}
+
+	namespace := cfg.namespace
+	if namespace == "" {
+		b, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the namespace of the service account, -kubernetes.namespace must be given: %w", err)
+		}
+		namespace = strings.TrimSpace(string(b))
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.caFile != "" {
+		pem, err := os.ReadFile(cfg.caFile)
+		if err != nil {
+			if !os.IsNotExist(err) || cfg.caFile != serviceAccountCAFile {
+				return nil, fmt.Errorf("failed to read the Kubernetes API CA: %w", err)
+			}
+		} else {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", cfg.caFile)
+			}
+			t.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		}
+	}
+
+	return &kubeClient{
+		url:       u,
+		tokenFile: cfg.tokenFile,
+		namespace: namespace,
+		client:    &http.Client{Transport: rt(t)},
+	}, nil
+}
+
+// kubeStatus is the status object the API server answers with on errors.
+type kubeStatus struct {
+	Message string `json:"message"`
+}
+
+// do sends a request to the API server and returns the body of the response.
+func (c *kubeClient) do(ctx context.Context, method, path string, query url.Values, contentType string, body []byte) ([]byte, error) {
+	res, err := c.send(ctx, method, path, query, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the response of the Kubernetes API: %w", err)
+	}
+
+	return b, nil
+}
+
+// stream sends a GET request to the API server and returns the body of the response as it arrives, e.g. for a watch.
+func (c *kubeClient) stream(ctx context.Context, path string, query url.Values) (io.ReadCloser, error) {
+	res, err := c.send(ctx, http.MethodGet, path, query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// send sends a request to the API server. The response is only returned on success.
+func (c *kubeClient) send(ctx context.Context, method, path string, query url.Values, contentType string, body []byte) (*http.Response, error) {
+	u := *c.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	// The token is read on every request, as projected service account tokens are rotated.
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read the Kubernetes API token: %w", err)
+		}
+		if t := strings.TrimSpace(string(token)); t != "" {
+			req.Header.Set("Authorization", "Bearer "+t)
+		}
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to the Kubernetes API: %w", err)
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		err := error(&unexpectedStatusError{from: "Kubernetes API", code: res.StatusCode})
+		var status kubeStatus
+		if b, rerr := io.ReadAll(res.Body); rerr == nil && json.Unmarshal(b, &status) == nil && status.Message != "" {
+			err = fmt.Errorf("%s %s: %s: %w", method, path, status.Message, err)
+		}
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// secretWatchBackoff is the delay before watching a Secret again after the watch failed.
+const secretWatchBackoff = 5 * time.Second
+
+// minRedactedLength is the length below which the values of Secrets are not redacted, as they would rather be e.g. flags
+// or names than credentials, and redacting them would mangle unrelated log lines.
+const minRedactedLength = 8
+
+// secretRefsConfig are the credentials read from Kubernetes Secrets rather than from flags or mounted files.
+// Every reference is given as namespace/name/key, or name/key for the namespace of -kubernetes.namespace.
+type secretRefsConfig struct {
+	oidcClientSecret string
+	bearerToken      string
+	ca               string
+	clientCert       string
+	clientKey        string
+}
+
+func (c secretRefsConfig) refs() map[string]string {
+	return map[string]string{
+		"oidc.client-secret-ref":         c.oidcClientSecret,
+		"observatorium-bearer-token-ref": c.bearerToken,
+		"observatorium-ca-ref":           c.ca,
+		"observatorium-client-cert-ref":  c.clientCert,
+		"observatorium-client-key-ref":   c.clientKey,
+	}
+}
+
+// credentials returns the references whose values are credentials, to redact, leaving out the certificates, which are public.
+func (c secretRefsConfig) credentials() []string {
+	return []string{c.oidcClientSecret, c.bearerToken, c.clientKey}
+}
+
+func (c secretRefsConfig) enabled() bool {
+	for _, ref := range c.refs() {
+		if ref != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c secretRefsConfig) validate() error {
+	for name, ref := range c.refs() {
+		if ref == "" {
+			continue
+		}
+		if _, err := parseSecretRef(ref, "default"); err != nil {
+			return fmt.Errorf("invalid -%s: %w", name, err)
+		}
+	}
+	if (c.clientCert == "") != (c.clientKey == "") {
+		return fmt.Errorf("both -observatorium-client-cert-ref and -observatorium-client-key-ref must be given to present a client certificate")
+	}
+
+	return nil
+}
+
+// secretRef references a key of a Kubernetes Secret.
+type secretRef struct {
+	namespace string
+	name      string
+	key       string
+}
+
+func parseSecretRef(s, namespace string) (secretRef, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) == 2 {
+		parts = append([]string{namespace}, parts...)
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return secretRef{}, fmt.Errorf("%q must be namespace/name/key or name/key", s)
+	}
+
+	return secretRef{namespace: parts[0], name: parts[1], key: parts[2]}, nil
+}
+
+// kubeSecret is a Secret as returned by the Kubernetes API. Its data is base64 encoded, which []byte decodes.
+type kubeSecret struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string][]byte `json:"data"`
+}
+
+// kubeWatchEvent is an event of a watch of the Kubernetes API.
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeSecrets keeps the Secrets credentials are referenced from up to date by watching them,
+// so that rotated credentials are used without mounting the Secrets or restarting the syncer.
+type kubeSecrets struct {
+	client *kubeClient
+	// changed is fired whenever the data of a watched Secret changes.
+	changed trigger
+
+	mu      sync.RWMutex
+	secrets map[string]*kubeSecret
+	// redacted are the values of the referenced credentials registered for redaction, by their reference.
+	redacted map[secretRef]string
+}
+
+// newKubeSecrets reads the referenced Secrets, failing if a key is missing, and watches them until the context is done.
+func newKubeSecrets(ctx context.Context, client *kubeClient, cfg secretRefsConfig) (*kubeSecrets, error) {
+	s := &kubeSecrets{client: client, changed: newTrigger(), secrets: make(map[string]*kubeSecret), redacted: make(map[secretRef]string)}
+	for _, r := range cfg.credentials() {
+		if ref := s.ref(r); ref != nil {
+			s.redacted[*ref] = ""
+		}
+	}
+	for _, r := range cfg.refs() {
+		ref := s.ref(r)
+		if ref == nil {
+			continue
+		}
+		id := ref.namespace + "/" + ref.name
+		if _, ok := s.secrets[id]; !ok {
+			secret, err := s.read(ctx, ref.namespace, ref.name)
+			if err != nil {
+				return nil, err
+			}
+			s.secrets[id] = secret
+			s.register(ref.namespace, secret)
+			go s.watch(ctx, ref.namespace, ref.name)
+		}
+		if _, err := s.get(*ref); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// ref parses a validated reference, the namespace defaulting to that of the client. It is nil for an empty reference.
+func (s *kubeSecrets) ref(r string) *secretRef {
+	if r == "" {
+		return nil
+	}
+	ref, err := parseSecretRef(r, s.client.namespace)
+	if err != nil {
+		return nil
+	}
+
+	return &ref
+}
+
+func (s *kubeSecrets) read(ctx context.Context, namespace, name string) (*kubeSecret, error) {
+	b, err := s.client.do(ctx, http.MethodGet, secretPath(namespace, name), nil, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Secret %s/%s: %w", namespace, name, err)
+	}
+	var secret kubeSecret
+	if err := json.Unmarshal(b, &secret); err != nil {
+		return nil, fmt.Errorf("failed to decode Secret %s/%s: %w", namespace, name, err)
+	}
+
+	return &secret, nil
+}
+
+func secretPath(namespace, name string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets/" + url.PathEscape(name)
+}
+
+// register makes sure the values of the referenced credentials of the Secret never appear in logs.
+// The values they replace are no longer redacted, so that rotations do not pile them up.
+func (s *kubeSecrets) register(namespace string, secret *kubeSecret) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ref, old := range s.redacted {
+		if ref.namespace != namespace || ref.name != secret.Metadata.Name {
+			continue
+		}
+		v := strings.TrimRight(string(secret.Data[ref.key]), "\r\n")
+		if v == old {
+			continue
+		}
+		if len(old) >= minRedactedLength {
+			unregisterSecret(old)
+		}
+		if len(v) >= minRedactedLength {
+			registerSecret(v)
+		}
+		s.redacted[ref] = v
+	}
+}
+
+// get returns the value of the referenced key, without the trailing newline files commonly end with.
+func (s *kubeSecrets) get(ref secretRef) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	secret, ok := s.secrets[ref.namespace+"/"+ref.name]
+	if !ok {
+		return nil, fmt.Errorf("Secret %s/%s is not watched", ref.namespace, ref.name)
+	}
+	v, ok := secret.Data[ref.key]
+	if !ok {
+		return nil, fmt.Errorf("Secret %s/%s has no key %s", ref.namespace, ref.name, ref.key)
+	}
+
+	return []byte(strings.TrimRight(string(v), "\r\n")), nil
+}
+
+// watch watches the Secret until the context is done, rewatching from its latest version once the API server closes the
+// watch, and after failures.
+func (s *kubeSecrets) watch(ctx context.Context, namespace, name string) {
+	for {
+		err := s.watchOnce(ctx, namespace, name)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// The API server closed the watch, as it does routinely, so it continues from the latest version.
+			continue
+		}
+		warnf("watch of the Secret %s/%s failed, rewatching in %s: %v", namespace, name, secretWatchBackoff, err)
+
+		select {
+		case <-time.After(secretWatchBackoff):
+		case <-ctx.Done():
+			return
+		}
+
+		// Changes missed while not watching are picked up by reading the Secret again.
+		secret, err := s.read(ctx, namespace, name)
+		if err != nil {
+			continue
+		}
+		s.update(namespace, secret)
+	}
+}
+
+// watchOnce watches the Secret from its latest version, returning nil once the API server ends the watch.
+func (s *kubeSecrets) watchOnce(ctx context.Context, namespace, name string) error {
+	s.mu.RLock()
+	version := s.secrets[namespace+"/"+name].Metadata.ResourceVersion
+	s.mu.RUnlock()
+
+	body, err := s.client.stream(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/secrets", url.Values{
+		"watch":           []string{"true"},
+		"fieldSelector":   []string{"metadata.name=" + name},
+		"resourceVersion": []string{version},
+	})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var ev kubeWatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to decode watch event: %w", err)
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			var secret kubeSecret
+			if err := json.Unmarshal(ev.Object, &secret); err != nil {
+				return fmt.Errorf("failed to decode Secret: %w", err)
+			}
+			s.update(namespace, &secret)
+		case "DELETED":
+			warnf("the Secret %s/%s was deleted, keeping its last values", namespace, name)
+		case "ERROR":
+			// E.g. the version watched from expired, which reading the Secret again resolves.
+			var status kubeStatus
+			_ = json.Unmarshal(ev.Object, &status)
+			return errors.New(status.Message)
+		}
+	}
+}
+
+// update replaces the Secret, firing changed if its data changed.
+func (s *kubeSecrets) update(namespace string, secret *kubeSecret) {
+	s.register(namespace, secret)
+	id := namespace + "/" + secret.Metadata.Name
+
+	s.mu.Lock()
+	old := s.secrets[id]
+	s.secrets[id] = secret
+	s.mu.Unlock()
+
+	changed := old == nil || len(old.Data) != len(secret.Data)
+	for key, v := range secret.Data {
+		if !changed && string(old.Data[key]) != string(v) {
+			changed = true
+		}
+	}
+	if changed {
+		infof("the Secret %s changed", id)
+		s.changed.fire()
+	}
+}
+
+// secretBearerTokenTransport sends the bearer token read from a Secret with every request.
+type secretBearerTokenTransport struct {
+	next    http.RoundTripper
+	secrets *kubeSecrets
+	ref     secretRef
+}
+
+func (t *secretBearerTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.secrets.get(t.ref)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+string(token))
+
+	return t.next.RoundTrip(req) //nolint:wrapcheck
+}
+
+// secretTokenSource requests OIDC tokens with the client secret read from a Secret,
+// switching to a new token source once the client secret is rotated.
+type secretTokenSource struct {
+	ctx     context.Context
+	config  clientcredentials.Config
+	secrets *kubeSecrets
+	ref     secretRef
+
+	mu     sync.Mutex
+	secret string
+	source oauth2.TokenSource
+}
+
+func (s *secretTokenSource) Token() (*oauth2.Token, error) {
+	secret, err := s.secrets.get(s.ref)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.source == nil || string(secret) != s.secret {
+		cfg := s.config
+		cfg.ClientSecret = string(secret)
+		s.secret, s.source = cfg.ClientSecret, cfg.TokenSource(s.ctx)
+	}
+
+	return s.source.Token() //nolint:wrapcheck
+}
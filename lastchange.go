@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// tenantHashes returns the hashes of the rules of every tenant in the file: the whole file in the per-tenant layout
+// or for the tenant of the syncer, and the rules of every tenant label value otherwise.
+func (s *syncer) tenantHashes(f ruleFile) map[string]string {
+	tenant := f.tenant
+	if tenant == "" {
+		tenant = s.tenant
+	}
+	if tenant != "" || f.groups == nil {
+		return map[string]string{tenant: contentHash(f.content)}
+	}
+
+	hashes := make(map[string]string)
+	for t, trgs := range splitByTenant(f.groups, s.output.tenantLabel) {
+		b, err := yaml.Marshal(trgs)
+		if err != nil {
+			continue
+		}
+		hashes[t] = contentHash(b)
+	}
+
+	return hashes
+}
+
+// observeTenantChanges sets rule_syncer_rules_last_change_timestamp_seconds of the tenants whose rules changed
+// with the applied files, and removes it for the tenants that are gone.
+func (s *syncer) observeTenantChanges(files []ruleFile, at time.Time) {
+	hashes := make(map[string]string)
+	for _, f := range files {
+		for t, h := range s.tenantHashes(f) {
+			hashes[t] = h
+			if s.tenantRulesHashes[t] != h {
+				s.metrics.rulesLastChange.WithLabelValues(t).Set(float64(at.Unix()))
+			}
+		}
+	}
+	for t := range s.tenantRulesHashes {
+		if _, ok := hashes[t]; !ok {
+			s.metrics.rulesLastChange.DeleteLabelValues(t)
+		}
+	}
+	s.tenantRulesHashes = hashes
+}
+
+// loadTenantChanges initializes the last changes of the tenants from the rules files on disk, as of their headers,
+// so that restarts do not report the existing rules as changed. All the tenants of a file take the time the file last changed.
+func (s *syncer) loadTenantChanges(files []ruleFile) {
+	s.tenantRulesHashes = make(map[string]string)
+	for _, f := range files {
+		at := fileChangeTime(f.path)
+		for t, h := range s.tenantHashes(f) {
+			s.tenantRulesHashes[t] = h
+			s.metrics.rulesLastChange.WithLabelValues(t).Set(float64(at.Unix()))
+		}
+	}
+}
+
+// fileChangeTime returns the time the content of the rules file was written first as noted in its header,
+// or the modification time of a file without header.
+func fileChangeTime(path string) time.Time {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		if fields, _, ok := parseHeader(content); ok {
+			if t, err := time.Parse(time.RFC3339, fields[headerTimestamp]); err == nil {
+				return t
+			}
+		}
+	}
+	if fi, err := os.Stat(path); err == nil {
+		return fi.ModTime()
+	}
+
+	return time.Now()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	leasesPath = "/apis/coordination.k8s.io/v1/namespaces/%s/leases"
+	// leaseRetryPeriod is the time between two attempts to take a Lease held by someone else.
+	leaseRetryPeriod = time.Second
+	// leaseTimeFormat is that of the MicroTime of the Kubernetes API.
+	leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+type reloadLockConfig struct {
+	lease    string
+	duration time.Duration
+}
+
+type leaseMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	// Labels and annotations are kept when updating a Lease created by someone else.
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+type kubeLease struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Metadata   leaseMeta `json:"metadata"`
+	Spec       leaseSpec `json:"spec"`
+}
+
+// expired tells whether the holder of the Lease failed to release it within its duration, e.g. as it crashed while reloading.
+func (l *kubeLease) expired(now time.Time) bool {
+	renewed, err := time.Parse(leaseTimeFormat, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+
+	return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// reloadLock serializes the reloads of the syncers sharing a Thanos Ruler, e.g. those of the rules and of the alert relabel
+// configuration, by holding a Kubernetes Lease while reloading. Other holders of the Lease are waited for, unless it expired.
+type reloadLock struct {
+	client   *kubeClient
+	name     string
+	identity string
+	duration time.Duration
+	wait     prometheus.Observer
+	// logPrefix names the pipeline the syncer belongs to, if any.
+	logPrefix string
+}
+
+// acquire takes the Lease, waiting for its holder to release it until the context is done.
+func (l *reloadLock) acquire(ctx context.Context) error {
+	start := time.Now()
+	defer func() { l.wait.Observe(time.Since(start).Seconds()) }()
+
+	holder := ""
+	for {
+		taken, h, err := l.tryAcquire(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to take the reload lock %s: %w", l.name, err)
+		}
+		if taken {
+			return nil
+		}
+		if h != holder {
+			holder = h
+			debugf("%swaiting for %s to release the reload lock %s", l.logPrefix, holder, l.name)
+		}
+
+		t := time.NewTimer(leaseRetryPeriod)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("gave up waiting for %s to release the reload lock %s: %w", holder, l.name, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+// tryAcquire takes the Lease unless someone else holds it, whom it returns then.
+func (l *reloadLock) tryAcquire(ctx context.Context) (bool, string, error) {
+	now := time.Now()
+	lease, err := l.get(ctx)
+	if err != nil && !isKubeStatus(err, http.StatusNotFound) {
+		return false, "", err
+	}
+
+	if lease == nil {
+		lease = &kubeLease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMeta{Name: l.name, Namespace: l.client.namespace},
+		}
+	} else if h := lease.Spec.HolderIdentity; h != "" && h != l.identity && !lease.expired(now) {
+		return false, h, nil
+	}
+	if lease.Spec.HolderIdentity != l.identity {
+		lease.Spec.LeaseTransitions++
+		lease.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+	}
+	lease.Spec.HolderIdentity = l.identity
+	lease.Spec.LeaseDurationSeconds = int(l.duration / time.Second)
+	lease.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+
+	if err := l.put(ctx, lease); err != nil {
+		// Someone else took or created the Lease in the meantime.
+		if isKubeStatus(err, http.StatusConflict) {
+			return false, "another syncer", nil
+		}
+		return false, "", err
+	}
+
+	return true, "", nil
+}
+
+// release gives the Lease up, so that others waiting for it do not have to wait for it to expire.
+// It is released even if the reload timed out.
+func (l *reloadLock) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeRequestTimeout)
+	defer cancel()
+
+	lease, err := l.get(ctx)
+	if err == nil && lease.Spec.HolderIdentity == l.identity {
+		lease.Spec.HolderIdentity = ""
+		err = l.put(ctx, lease)
+	}
+	if err != nil {
+		warnf("%sfailed to release the reload lock %s, it expires in %s: %v", l.logPrefix, l.name, l.duration, err)
+	}
+}
+
+func (l *reloadLock) get(ctx context.Context) (*kubeLease, error) {
+	b, err := l.client.do(ctx, http.MethodGet, fmt.Sprintf(leasesPath, l.client.namespace)+"/"+l.name, nil, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var lease kubeLease
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return nil, fmt.Errorf("failed to decode Lease %s: %w", l.name, err)
+	}
+
+	return &lease, nil
+}
+
+// put creates the Lease, or updates it unless it changed since it was read.
+func (l *reloadLock) put(ctx context.Context, lease *kubeLease) error {
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Lease %s: %w", l.name, err)
+	}
+	if lease.Metadata.ResourceVersion == "" {
+		_, err = l.client.do(ctx, http.MethodPost, fmt.Sprintf(leasesPath, l.client.namespace), nil, "application/json", body)
+	} else {
+		_, err = l.client.do(ctx, http.MethodPut, fmt.Sprintf(leasesPath, l.client.namespace)+"/"+l.name, nil, "application/json", body)
+	}
+
+	return err
+}
+
+// leaseIdentity returns the holder of the Lease, unique to the process and the pipeline, as the pipelines reload separately.
+// The hostname alone is not, as the syncers sharing a Ruler often run in the same pod.
+func leaseIdentity(pipeline string) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the holder of the reload lock from hostname: %w", err)
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate the holder of the reload lock: %w", err)
+	}
+	identity := hostname + "_" + hex.EncodeToString(b)
+	if pipeline != "" {
+		identity += "/" + pipeline
+	}
+
+	return identity, nil
+}
+
+// isKubeStatus tells whether the Kubernetes API answered with the status.
+func isKubeStatus(err error, code int) bool {
+	var use *unexpectedStatusError
+	return errors.As(err, &use) && use.code == code
+}
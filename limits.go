@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Policies of -limits.min-group-interval-policy and -limits.max-rules-per-group-policy.
+const (
+	limitRaise  = "raise"
+	limitSplit  = "split"
+	limitReject = "reject"
+)
+
+// minGroupInterval enforces a floor on the evaluation interval of groups, protecting shared Rulers from groups evaluated every second.
+// Groups without an interval are evaluated at the global interval of Thanos Ruler and left untouched.
+type minGroupInterval struct {
+	min       time.Duration
+	policy    string
+	logPrefix string
+}
+
+func (l minGroupInterval) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	var rejected []string
+	for i := range rgs.Groups {
+		g := &rgs.Groups[i]
+		if g.Interval == "" {
+			continue
+		}
+		interval, err := model.ParseDuration(g.Interval)
+		if err != nil || time.Duration(interval) >= l.min {
+			// Invalid intervals are already refused by validate.
+			continue
+		}
+
+		if l.policy == limitReject {
+			rejected = append(rejected, fmt.Sprintf("group %q: interval %s is below the minimum of %s", g.Name, g.Interval, model.Duration(l.min)))
+			continue
+		}
+		debugf("%sraising the interval of group %q from %s to %s", l.logPrefix, g.Name, g.Interval, model.Duration(l.min))
+		g.Interval = model.Duration(l.min).String()
+		changed = true
+	}
+
+	if len(rejected) > 0 {
+		return false, fmt.Errorf("groups exceed limits: %s", strings.Join(rejected, "; "))
+	}
+
+	return changed, nil
+}
+
+// maxRulesPerGroup limits the number of rules of a group, either refusing larger groups or splitting them into numbered groups of at most max rules.
+// Split groups keep the order of their rules and the interval and remaining fields of the original group.
+type maxRulesPerGroup struct {
+	max       int
+	policy    string
+	logPrefix string
+}
+
+func (l maxRulesPerGroup) transform(rgs *ruleGroups) (bool, error) {
+	var rejected []string
+	for _, g := range rgs.Groups {
+		if len(g.Rules) > l.max {
+			rejected = append(rejected, fmt.Sprintf("group %q: %d rules exceed the maximum of %d", g.Name, len(g.Rules), l.max))
+		}
+	}
+	if len(rejected) == 0 {
+		return false, nil
+	}
+	if l.policy == limitReject {
+		return false, fmt.Errorf("groups exceed limits: %s", strings.Join(rejected, "; "))
+	}
+
+	names := make(map[string]struct{}, len(rgs.Groups))
+	for _, g := range rgs.Groups {
+		names[g.Name] = struct{}{}
+	}
+
+	groups := make([]ruleGroup, 0, len(rgs.Groups)+len(rejected))
+	for _, g := range rgs.Groups {
+		if len(g.Rules) <= l.max {
+			groups = append(groups, g)
+			continue
+		}
+
+		n := 0
+		for start := 0; start < len(g.Rules); start += l.max {
+			end := start + l.max
+			if end > len(g.Rules) {
+				end = len(g.Rules)
+			}
+			n++
+			sub := g
+			sub.Name = fmt.Sprintf("%s-%d", g.Name, n)
+			if _, ok := names[sub.Name]; ok {
+				return false, fmt.Errorf("failed to split group %q: group %q already exists", g.Name, sub.Name)
+			}
+			sub.Rules = g.Rules[start:end]
+			groups = append(groups, sub)
+		}
+		debugf("%ssplit group %q of %d rules into %d groups", l.logPrefix, g.Name, len(g.Rules), n)
+	}
+	rgs.Groups = groups
+
+	return true, nil
+}
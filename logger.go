@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel is the severity of a log line. Lines below the current level are dropped.
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	if l < levelDebug || l > levelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return logLevel(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+// currentLogLevel is read and written atomically, so that it can be changed at runtime.
+var currentLogLevel = int32(levelInfo)
+
+func setLogLevel(l logLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(l))
+}
+
+func getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&currentLogLevel))
+}
+
+func logf(l logLevel, format string, args ...interface{}) {
+	if l < getLogLevel() {
+		return
+	}
+	// Credentials are redacted from every line, as errors may quote them.
+	_ = log.Output(3, "level="+l.String()+" "+redact(fmt.Sprintf(format, args...)))
+}
+
+// pipelineLogPrefix is prepended to the log lines of a pipeline, so that the lines of concurrent pipelines can be told apart.
+func pipelineLogPrefix(pipeline string) string {
+	if pipeline == "" {
+		return ""
+	}
+
+	return "pipeline " + pipeline + ": "
+}
+
+func debugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logf(levelError, format, args...) }
+
+// logLevelHandler reports the current log level on GET and changes it on PUT.
+// The new level is given as the request body or as the level query parameter.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		v := r.URL.Query().Get("level")
+		if v == "" {
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			v = string(body)
+		}
+		l, err := parseLogLevel(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if old := getLogLevel(); old != l {
+			setLogLevel(l)
+			// Logged as a warning to be visible at every level but error.
+			warnf("log level changed from %s to %s", old, l)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprintln(w, getLogLevel())
+}
+
+// errorDeduper logs recurring errors once and then summarizes their repetitions,
+// so that a backend being down for hours does not fill the log with the same line every interval.
+// Changes of the error and recoveries are logged immediately. It is not safe for concurrent use.
+type errorDeduper struct {
+	// window is how often repetitions are summarized. 0 logs every error.
+	window time.Duration
+	// prefix is prepended to every line, e.g. to tell pipelines apart.
+	prefix string
+
+	last     string
+	loggedAt time.Time
+	repeated int
+	failures int
+}
+
+func newErrorDeduper(window time.Duration, prefix string) *errorDeduper {
+	return &errorDeduper{window: window, prefix: prefix}
+}
+
+// failed logs the error unless it repeats the previous one within the window.
+func (d *errorDeduper) failed(now time.Time, msg string) {
+	d.failures++
+	msg = d.prefix + msg
+	if d.window <= 0 {
+		errorf("%s", msg)
+		return
+	}
+
+	if msg != d.last {
+		d.flush()
+		errorf("%s", msg)
+		d.last, d.loggedAt, d.repeated = msg, now, 0
+		return
+	}
+
+	d.repeated++
+	if now.Sub(d.loggedAt) >= d.window {
+		errorf("same error repeated %d times in the last %s: %s", d.repeated, d.window, msg)
+		d.loggedAt, d.repeated = now, 0
+	}
+}
+
+// succeeded logs the recovery from previous errors.
+func (d *errorDeduper) succeeded() {
+	if d.failures == 0 {
+		return
+	}
+
+	d.flush()
+	infof("%srecovered after %d failed sync cycles", d.prefix, d.failures)
+	d.last, d.repeated, d.failures = "", 0, 0
+}
+
+// flush logs the repetitions of the last error that were not summarized yet.
+func (d *errorDeduper) flush() {
+	if d.repeated > 0 {
+		errorf("previous error repeated %d more times: %s", d.repeated, d.last)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Formats of the notifications.
+const (
+	// notifyFormatWebhook posts a notification as JSON, see notification.
+	notifyFormatWebhook = "webhook"
+	// notifyFormatSlack posts the text of a notification to a Slack incoming webhook.
+	notifyFormatSlack = "slack"
+)
+
+// Types of events notified.
+const (
+	notifyRulesChanged       = "rules-changed"
+	notifyValidationRejected = "validation-rejected"
+	notifySyncFailing        = "sync-failing"
+)
+
+var notifyEventTypes = []string{notifyRulesChanged, notifyValidationRejected, notifySyncFailing}
+
+func isNotifyEventType(e string) bool {
+	for _, t := range notifyEventTypes {
+		if e == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+type notifyConfig struct {
+	webhookURL string
+	format     string
+	// events are the types of events notified, all of them if empty.
+	events           listValue
+	failureThreshold int
+}
+
+func (c notifyConfig) validate() error {
+	if c.format != notifyFormatWebhook && c.format != notifyFormatSlack {
+		return fmt.Errorf("invalid -notify.format %q, must be %s or %s", c.format, notifyFormatWebhook, notifyFormatSlack)
+	}
+	for _, e := range c.events {
+		if !isNotifyEventType(e) {
+			return fmt.Errorf("invalid event type %q in -notify.events, must be one of %s", e, strings.Join(notifyEventTypes, ", "))
+		}
+	}
+	if c.failureThreshold < 1 {
+		return fmt.Errorf("invalid -notify.failure-threshold %d, must be at least 1", c.failureThreshold)
+	}
+
+	return nil
+}
+
+// notification is the body posted in the webhook format.
+type notification struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	Pipeline string    `json:"pipeline,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	// Text is a human readable summary, the only content of the Slack format.
+	Text   string       `json:"text"`
+	Change *rulesChange `json:"change,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	// Failures is the number of consecutive failed cycles of a sync-failing event.
+	Failures int `json:"failures,omitempty"`
+	// Resolved marks the sync-failing event sent once a cycle succeeds again.
+	Resolved bool `json:"resolved,omitempty"`
+}
+
+// notifier notifies the owners of the rules of what happens to them, e.g. on a Slack channel.
+// Its state is only accessed by the goroutine running the sync cycles.
+type notifier struct {
+	client           *http.Client
+	url              string
+	format           string
+	events           map[string]struct{}
+	failureThreshold int
+	source           string
+	pipeline         string
+	tenant           string
+
+	// failures counts the consecutive failed cycles.
+	failures int
+	// failing tells whether the failures were notified.
+	failing bool
+	// rejected is the last validation error notified, so that a payload is notified once rather than every cycle.
+	rejected string
+}
+
+func newNotifier(cfg notifyConfig, source, pipeline, tenant string, client *http.Client) *notifier {
+	events := make(map[string]struct{})
+	types := cfg.events
+	if len(types) == 0 {
+		types = notifyEventTypes
+	}
+	for _, e := range types {
+		events[e] = struct{}{}
+	}
+
+	return &notifier{
+		client:           client,
+		url:              cfg.webhookURL,
+		format:           cfg.format,
+		events:           events,
+		failureThreshold: cfg.failureThreshold,
+		source:           source,
+		pipeline:         pipeline,
+		tenant:           tenant,
+	}
+}
+
+func (n *notifier) rulesChanged(ctx context.Context, change rulesChange) {
+	text := fmt.Sprintf("Rules synced from %s changed: %d groups added, %d changed, %d removed.",
+		n.source, len(change.Groups.Added), len(change.Groups.Changed), len(change.Groups.Removed))
+	n.notify(ctx, notification{Event: notifyRulesChanged, Text: text, Change: &change})
+}
+
+// cycleFinished notifies validation rejections, and failures once they last for the failure threshold of cycles.
+func (n *notifier) cycleFinished(ctx context.Context, err error) {
+	if err == nil {
+		if n.failing {
+			text := fmt.Sprintf("Syncing rules from %s recovered after %d failed cycles.", n.source, n.failures)
+			n.notify(ctx, notification{Event: notifySyncFailing, Text: text, Failures: n.failures, Resolved: true})
+		}
+		n.failures, n.failing, n.rejected = 0, false, ""
+		return
+	}
+
+	n.failures++
+	// Timeouts of the validation are not caused by the payload.
+	if stage, code := classify(err); stage == stageValidate && code != codeTimeout && err.Error() != n.rejected {
+		n.rejected = err.Error()
+		text := fmt.Sprintf("Rules from %s were rejected and not synced: %v", n.source, err)
+		n.notify(ctx, notification{Event: notifyValidationRejected, Text: text, Error: err.Error()})
+	}
+	if !n.failing && n.failures >= n.failureThreshold {
+		n.failing = true
+		text := fmt.Sprintf("Syncing rules from %s failed %d times in a row: %v", n.source, n.failures, err)
+		n.notify(ctx, notification{Event: notifySyncFailing, Text: text, Error: err.Error(), Failures: n.failures})
+	}
+}
+
+// notify sends the notification if its type is enabled. Failing to deliver it only logs a warning.
+func (n *notifier) notify(ctx context.Context, msg notification) {
+	if _, ok := n.events[msg.Event]; !ok {
+		return
+	}
+	// The webhook is outside of the syncer, and the errors may hold credentials, e.g. of URLs, like the logs.
+	msg.Text, msg.Error = redact(msg.Text), redact(msg.Error)
+	msg.Time = time.Now().UTC()
+	msg.Source = n.source
+	msg.Pipeline = n.pipeline
+	msg.Tenant = n.tenant
+	if err := n.post(ctx, msg); err != nil {
+		warnf("%sfailed to send %s notification: %v", pipelineLogPrefix(n.pipeline), msg.Event, err)
+	}
+}
+
+func (n *notifier) post(ctx context.Context, msg notification) error {
+	var payload interface{} = msg
+	if n.format == notifyFormatSlack {
+		// Messages of several pipelines or tenants may share a channel.
+		var names []string
+		for _, name := range []string{msg.Pipeline, msg.Tenant} {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		text := msg.Text
+		if len(names) > 0 {
+			text = "[" + strings.Join(names, "/") + "] " + text
+		}
+		payload = struct {
+			Text string `json:"text"`
+		}{Text: text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		// The error holds the URL, e.g. the token of a Slack incoming webhook, which must not be logged.
+		if ue, ok := err.(*url.Error); ok {
+			return fmt.Errorf("failed to do http request: %w", ue.Err)
+		}
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("got unexpected status from notification webhook: %d", res.StatusCode)
+	}
+
+	return nil
+}
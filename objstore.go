@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// objectStore lists and reads the objects of a bucket or container.
+type objectStore interface {
+	// list returns the names of the objects starting with the prefix.
+	list(ctx context.Context, prefix string) ([]string, error)
+	get(ctx context.Context, name string) ([]byte, error)
+}
+
+// objectStoreFetcher reads the rules files below a prefix of an object store and merges them.
+type objectStoreFetcher struct {
+	store     objectStore
+	prefix    string
+	logPrefix string
+}
+
+// getRules concatenates the rules files in the order of their names into a multi-document YAML,
+// whose documents are merged into a single one when the rules are validated.
+// JSON files are valid YAML documents too.
+func (f *objectStoreFetcher) getRules(ctx context.Context) (*rulesPayload, error) {
+	names, err := f.store.list(ctx, f.prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	var files int
+	for _, name := range names {
+		if !isRulesObject(name) {
+			continue
+		}
+		content, err := f.store.get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		files++
+	}
+	if files == 0 {
+		return nil, fmt.Errorf("no rules files found below the prefix %q", f.prefix)
+	}
+	debugf("%sread %d rules files below the prefix %q", f.logPrefix, files, f.prefix)
+
+	return &rulesPayload{body: io.NopCloser(&buf), contentType: "application/yaml"}, nil
+}
+
+// isRulesObject tells whether the object is a rules file, skipping e.g. READMEs stored alongside.
+func isRulesObject(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Modes of -telemetry.mode.
+const (
+	// telemetryPrometheus serves the metrics on /metrics of the internal server.
+	telemetryPrometheus = "prometheus"
+	// telemetryOTLP pushes the metrics to an OpenTelemetry collector.
+	telemetryOTLP = "otlp"
+	// telemetryBoth serves and pushes the metrics.
+	telemetryBoth = "both"
+)
+
+type telemetryConfig struct {
+	mode string
+	// otlpEndpoint is the URL of the OTLP/HTTP metrics endpoint, like http://collector:4318/v1/metrics.
+	otlpEndpoint string
+	otlpHeaders  labelsValue
+	otlpInterval time.Duration
+}
+
+func (c telemetryConfig) validate() error {
+	switch c.mode {
+	case telemetryPrometheus:
+		return nil
+	case telemetryOTLP, telemetryBoth:
+	default:
+		return fmt.Errorf("invalid -telemetry.mode %q, must be %s, %s or %s", c.mode, telemetryPrometheus, telemetryOTLP, telemetryBoth)
+	}
+	if u, err := url.Parse(c.otlpEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -telemetry.otlp-endpoint %q, must be a URL like http://collector:4318/v1/metrics", redactURL(c.otlpEndpoint))
+	}
+	if c.otlpInterval <= 0 {
+		return fmt.Errorf("invalid -telemetry.otlp-interval %s, must be positive", c.otlpInterval)
+	}
+
+	return nil
+}
+
+func (c telemetryConfig) serve() bool {
+	return c.mode != telemetryOTLP
+}
+
+func (c telemetryConfig) push() bool {
+	return c.mode == telemetryOTLP || c.mode == telemetryBoth
+}
+
+// otlpExporter pushes the metrics gathered from the Prometheus registry to an OpenTelemetry collector,
+// encoded as JSON over OTLP/HTTP, which spares the dependency on the OpenTelemetry SDK.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	interval time.Duration
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	// start is the start of the cumulative sums, the start of the process.
+	start time.Time
+}
+
+func newOTLPExporter(cfg telemetryConfig, gatherer prometheus.Gatherer, client *http.Client) *otlpExporter {
+	return &otlpExporter{
+		endpoint: cfg.otlpEndpoint,
+		headers:  cfg.otlpHeaders,
+		interval: cfg.otlpInterval,
+		gatherer: gatherer,
+		client:   client,
+		start:    time.Now(),
+	}
+}
+
+// run pushes the metrics every interval, and a last time on shutdown.
+func (e *otlpExporter) run(ctx context.Context) error {
+	infof("pushing metrics to %s every %s", redactURL(e.endpoint), e.interval)
+
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			e.exportAndLog(ctx)
+		case <-ctx.Done():
+			e.exportAndLog(context.Background())
+			return nil
+		}
+	}
+}
+
+func (e *otlpExporter) exportAndLog(ctx context.Context) {
+	if err := e.export(ctx); err != nil {
+		warnf("failed to push metrics: %v", err)
+	}
+}
+
+func (e *otlpExporter) export(ctx context.Context) error {
+	mfs, err := e.gatherer.Gather()
+	if err != nil {
+		// Gather returns what it could gather along with the error.
+		warnf("failed to gather some metrics: %v", err)
+	}
+	body, err := json.Marshal(otlpRequest(mfs, e.start, time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to marshal metrics: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return &unexpectedStatusError{from: "the OTLP endpoint", code: res.StatusCode}
+	}
+
+	return nil
+}
+
+// The types below are the subset of the JSON encoding of the OTLP ExportMetricsServiceRequest that is used.
+// 64 bit integers are encoded as strings, as the protobuf JSON mapping does.
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+
+	AsDouble *otlpDouble `json:"asDouble,omitempty"`
+
+	Count          string              `json:"count,omitempty"`
+	Sum            *otlpDouble         `json:"sum,omitempty"`
+	BucketCounts   []string            `json:"bucketCounts,omitempty"`
+	ExplicitBounds []otlpDouble        `json:"explicitBounds,omitempty"`
+	QuantileValues []otlpQuantileValue `json:"quantileValues,omitempty"`
+}
+
+type otlpQuantileValue struct {
+	Quantile otlpDouble `json:"quantile"`
+	Value    otlpDouble `json:"value"`
+}
+
+// otlpDouble is a double of a point, which encoding/json cannot encode when it is NaN or infinite, e.g. a summary without
+// observations, so those are encoded as the strings of the protobuf JSON mapping.
+type otlpDouble float64
+
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+
+	return json.Marshal(f)
+}
+
+type otlpData struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+	// AggregationTemporality is 2, cumulative, for sums and histograms.
+	AggregationTemporality int  `json:"aggregationTemporality,omitempty"`
+	IsMonotonic            bool `json:"isMonotonic,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Gauge       *otlpData `json:"gauge,omitempty"`
+	Sum         *otlpData `json:"sum,omitempty"`
+	Histogram   *otlpData `json:"histogram,omitempty"`
+	Summary     *otlpData `json:"summary,omitempty"`
+}
+
+const otlpCumulative = 2
+
+// otlpRequest converts the metric families to an ExportMetricsServiceRequest.
+func otlpRequest(mfs []*dto.MetricFamily, start, now time.Time) interface{} {
+	startNano := strconv.FormatInt(start.UnixNano(), 10)
+	nowNano := strconv.FormatInt(now.UnixNano(), 10)
+
+	metrics := make([]otlpMetric, 0, len(mfs))
+	for _, mf := range mfs {
+		m := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		data := &otlpData{DataPoints: make([]otlpDataPoint, 0, len(mf.Metric))}
+		for _, pm := range mf.Metric {
+			p := otlpDataPoint{Attributes: otlpAttributes(pm.Label), TimeUnixNano: nowNano}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				p.StartTimeUnixNano = startNano
+				p.AsDouble = doublePtr(pm.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				p.AsDouble = doublePtr(pm.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := pm.GetHistogram()
+				p.StartTimeUnixNano = startNano
+				p.Count = strconv.FormatUint(h.GetSampleCount(), 10)
+				p.Sum = doublePtr(h.GetSampleSum())
+				// The counts of Prometheus buckets are cumulative, those of OTLP are not and end with the +Inf bucket.
+				var previous uint64
+				for _, b := range h.Bucket {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					p.ExplicitBounds = append(p.ExplicitBounds, otlpDouble(b.GetUpperBound()))
+					p.BucketCounts = append(p.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-previous, 10))
+					previous = b.GetCumulativeCount()
+				}
+				p.BucketCounts = append(p.BucketCounts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+			case dto.MetricType_SUMMARY:
+				s := pm.GetSummary()
+				p.StartTimeUnixNano = startNano
+				p.Count = strconv.FormatUint(s.GetSampleCount(), 10)
+				p.Sum = doublePtr(s.GetSampleSum())
+				for _, q := range s.Quantile {
+					p.QuantileValues = append(p.QuantileValues, otlpQuantileValue{Quantile: otlpDouble(q.GetQuantile()), Value: otlpDouble(q.GetValue())})
+				}
+			default:
+				p.AsDouble = doublePtr(pm.GetUntyped().GetValue())
+			}
+			data.DataPoints = append(data.DataPoints, p)
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			data.AggregationTemporality, data.IsMonotonic = otlpCumulative, true
+			m.Sum = data
+		case dto.MetricType_HISTOGRAM:
+			data.AggregationTemporality = otlpCumulative
+			m.Histogram = data
+		case dto.MetricType_SUMMARY:
+			m.Summary = data
+		default:
+			m.Gauge = data
+		}
+		metrics = append(metrics, m)
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes([]*dto.LabelPair{{Name: stringPtr("service.name"), Value: stringPtr("thanos-rule-syncer")}}),
+				},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]string{"name": "github.com/observatorium/thanos-rule-syncer"},
+						"metrics": metrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(labels []*dto.LabelPair) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(labels))
+	for _, l := range labels {
+		a := otlpAttribute{Key: l.GetName()}
+		a.Value.StringValue = l.GetValue()
+		attrs = append(attrs, a)
+	}
+
+	return attrs
+}
+
+func doublePtr(f float64) *otlpDouble {
+	d := otlpDouble(f)
+	return &d
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
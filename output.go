@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Layouts of the rules written to disk.
+const (
+	// layoutSingle writes all rules to a single file.
+	layoutSingle = "single"
+	// layoutPerTenant splits the rules by their tenant label into one file per tenant.
+	layoutPerTenant = "per-tenant"
+)
+
+const (
+	ruleFileExt = ".yaml"
+	// writeChunkSize is the amount of bytes written between two checks of the write deadline.
+	writeChunkSize = 32 * 1024
+	// unlabeledTenant is the name of the file holding the rules lacking a tenant label in the per-tenant layout.
+	unlabeledTenant = "_unlabeled"
+)
+
+// ruleFile is a rule file to write to disk.
+type ruleFile struct {
+	path string
+	// tenant is empty in the single layout.
+	tenant  string
+	groups  *ruleGroups
+	content []byte
+}
+
+// output renders rule groups into the files of a layout.
+type output struct {
+	layout      string
+	file        string
+	dir         string
+	tenantLabel string
+	// resources is set if the rules are applied as PrometheusRule resources rather than written to disk.
+	// Files are then identified by the namespace and name of their resource.
+	resources *prometheusRules
+	// contentAddressed writes the rules files as symlinks to their content-addressed versions, see writeVersion.
+	contentAddressed bool
+	// retainVersions is the number of versions kept besides the active ones.
+	retainVersions int
+	// source and tenant are noted in the header of the rules files, see renderHeader.
+	source string
+	tenant string
+	// force replaces and removes rules files lacking the header of the syncer rather than refusing to.
+	force bool
+	// logPrefix tells the pipeline of the output apart in the log lines.
+	logPrefix string
+}
+
+// render returns the files to write. content is the encoded rule groups in the single layout.
+func (o *output) render(rgs *ruleGroups, content []byte) ([]ruleFile, error) {
+	if o.layout != layoutPerTenant {
+		if o.resources != nil {
+			// What is read back from the resource is re-encoded, so the same is done here to compare equal.
+			b, err := yaml.Marshal(rgs)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal rules: %w", err)
+			}
+			return []ruleFile{{path: o.resources.path(""), groups: rgs, content: b}}, nil
+		}
+		return []ruleFile{{path: o.file, groups: rgs, content: content}}, nil
+	}
+
+	byTenant := splitByTenant(rgs, o.tenantLabel)
+	files := make([]ruleFile, 0, len(byTenant))
+	for tenant, trgs := range byTenant {
+		b, err := yaml.Marshal(trgs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal rules of tenant %s: %w", tenant, err)
+		}
+		if tenant == unlabeledTenant {
+			warnf("%swriting rules without a %s label to %s", o.logPrefix, o.tenantLabel, o.tenantPath(tenant))
+		}
+		files = append(files, ruleFile{path: o.tenantPath(tenant), tenant: tenant, groups: trgs, content: b})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	for i := 1; i < len(files); i++ {
+		if files[i].path == files[i-1].path {
+			return nil, fmt.Errorf("the rules of tenants %s and %s would both be written to %s", files[i-1].tenant, files[i].tenant, files[i].path)
+		}
+	}
+
+	return files, nil
+}
+
+func (o *output) tenantPath(tenant string) string {
+	if o.resources != nil {
+		return o.resources.path(tenant)
+	}
+
+	return filepath.Join(o.dir, tenantFileName(tenant)+ruleFileExt)
+}
+
+// current reads the rule files of the layout that are on disk.
+func (o *output) current() ([]ruleFile, error) {
+	if o.resources != nil {
+		return o.resources.current()
+	}
+
+	paths := []string{o.file}
+	if o.layout == layoutPerTenant {
+		var err error
+		if paths, err = o.ownedFiles(); err != nil {
+			return nil, err
+		}
+	}
+
+	files := make([]ruleFile, 0, len(paths))
+	for _, p := range paths {
+		content, err := readRulesFile(p)
+		if err != nil {
+			return nil, err
+		}
+		f := ruleFile{path: p, content: content}
+		if o.layout == layoutPerTenant {
+			f.tenant = strings.TrimSuffix(filepath.Base(p), ruleFileExt)
+		}
+		if rgs, _, err := parseRuleGroups(content); err == nil {
+			f.groups = rgs
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// ownedFiles lists the rule files in the output directory of the per-tenant layout.
+// The directory is expected to be dedicated to the syncer.
+func (o *output) ownedFiles() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(o.dir, "*"+ruleFileExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules files in %s: %w", o.dir, err)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// writeFiles writes the files, leaving the other files as they are, and returns their paths.
+func (o *output) writeFiles(ctx context.Context, files []ruleFile) (map[string]struct{}, error) {
+	now := time.Now()
+	written := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		content, err := o.withHeader(f, now)
+		if err != nil {
+			return nil, err
+		}
+		write := writeFile
+		if o.contentAddressed {
+			write = o.writeVersion
+		}
+		if err := write(ctx, f.path, content); err != nil {
+			return nil, err
+		}
+		written[f.path] = struct{}{}
+		debugf("%swrote rules file %s", o.logPrefix, f.path)
+	}
+
+	return written, nil
+}
+
+// write writes all files and, in the per-tenant layout, removes the files of tenants that are gone.
+func (o *output) write(ctx context.Context, files []ruleFile) error {
+	if o.resources != nil {
+		return o.resources.apply(ctx, files)
+	}
+
+	keep, err := o.writeFiles(ctx, files)
+	if err != nil {
+		return err
+	}
+
+	if o.layout != layoutPerTenant {
+		if o.contentAddressed {
+			return o.pruneVersions([]string{o.file})
+		}
+		return nil
+	}
+
+	owned, err := o.ownedFiles()
+	if err != nil {
+		return err
+	}
+	for _, p := range owned {
+		if _, ok := keep[p]; ok {
+			continue
+		}
+		if _, err := o.checkOwned(p); err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale rules file %s: %w", p, err)
+		}
+		infof("%sremoved rules file %s of a tenant without rules", o.logPrefix, p)
+	}
+	if o.contentAddressed {
+		paths := make([]string, 0, len(keep))
+		for p := range keep {
+			paths = append(paths, p)
+		}
+		return o.pruneVersions(paths)
+	}
+
+	return nil
+}
+
+// writeFile writes the content in chunks, checking the deadline of the context in between.
+// The content is written to a temporary file renamed over the rules file, so that a crash never leaves a truncated rules file behind.
+func writeFile(ctx context.Context, path string, content []byte) error {
+	tmp, err := tempFilePath(path)
+	if err != nil {
+		return err
+	}
+	// The mode of a new rules file is kept as it was before writing through a temporary file.
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if os.IsPermission(err) {
+		// Only the rules file itself may be writable, e.g. a file mounted into a container.
+		debugf("writing the rules file %s in place, as its directory is not writable", path)
+		return writeFileInPlace(ctx, path, content)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file for the rules file %s: %w", path, err)
+	}
+	if err := writeChunks(ctx, file, content); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write to rules file %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write to rules file %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to close the rules file %s: %w", path, err)
+	}
+	err = os.Rename(tmp, path)
+	if errors.Is(err, syscall.EBUSY) {
+		// The rules file is a mount point, which cannot be replaced.
+		os.Remove(tmp)
+		debugf("writing the rules file %s in place, as it is a mount point", path)
+		return writeFileInPlace(ctx, path, content)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace the rules file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// writeFileInPlace truncates the rules file and writes the content to it.
+func writeFileInPlace(ctx context.Context, path string, content []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create or open the rules file %s: %w", path, err)
+	}
+	if err := writeChunks(ctx, file, content); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write to rules file %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close the rules file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func writeChunks(ctx context.Context, file *os.File, content []byte) error {
+	for len(content) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := writeChunkSize
+		if n > len(content) {
+			n = len(content)
+		}
+		if _, err := file.Write(content[:n]); err != nil {
+			return err //nolint:wrapcheck
+		}
+		content = content[n:]
+	}
+
+	return nil
+}
+
+// tempFileSuffix ends the names of temporary files, which Thanos Ruler does not pick up with a glob like *.yaml.
+const tempFileSuffix = ".tmp"
+
+// tempFilePath returns a unique temporary file next to the given file, hidden and named after it.
+func tempFilePath(path string) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to name a temporary file: %w", err)
+	}
+
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+hex.EncodeToString(b)+tempFileSuffix), nil
+}
+
+// removeTempFiles removes the temporary files left behind by a crash while writing.
+func (o *output) removeTempFiles() error {
+	pattern := tempFilePattern(o.file)
+	if o.layout == layoutPerTenant {
+		pattern = tempFilePattern(filepath.Join(o.dir, "*"+ruleFileExt))
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("failed to list temporary files: %w", err)
+	}
+	if o.contentAddressed {
+		versions, err := filepath.Glob(tempFilePattern(filepath.Join(o.versionsDir(), versionPrefix+"*"+ruleFileExt)))
+		if err != nil {
+			return fmt.Errorf("failed to list temporary files: %w", err)
+		}
+		paths = append(paths, versions...)
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove temporary file %s: %w", p, err)
+		}
+		infof("%sremoved temporary file %s left behind by an interrupted write", o.logPrefix, p)
+	}
+
+	return nil
+}
+
+// tempFilePattern matches the temporary files of the given file, itself a glob pattern.
+func tempFilePattern(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".*"+tempFileSuffix)
+}
+
+// filesHash identifies a set of rule files.
+// For a single file it is the hash of its content, so it matches the hash of the fetched payload.
+func filesHash(files []ruleFile) string {
+	if len(files) == 1 && files[0].tenant == "" {
+		return contentHash(files[0].content)
+	}
+
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%s\n", f.path, contentHash(f.content))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// filesGroupHashes returns the hash of every group of the files.
+// In the per-tenant layout, groups are keyed by tenant/group, as group names are only unique per tenant.
+func filesGroupHashes(files []ruleFile) map[string]string {
+	hashes := make(map[string]string)
+	for _, f := range files {
+		if f.groups == nil {
+			continue
+		}
+		for name, h := range f.groups.groupHashes() {
+			if f.tenant != "" {
+				// Keyed like the file name, so that hashes read back from disk compare equal.
+				name = tenantFileName(f.tenant) + "/" + name
+			}
+			hashes[name] = h
+		}
+	}
+
+	return hashes
+}
+
+// splitByTenant splits rule groups by the value of the tenant label of their rules.
+// A group containing rules of several tenants is split into one group of the same name per tenant.
+func splitByTenant(rgs *ruleGroups, tenantLabel string) map[string]*ruleGroups {
+	byTenant := make(map[string]*ruleGroups)
+	for _, g := range rgs.Groups {
+		var order []string
+		rulesByTenant := make(map[string][]rule)
+		for _, r := range g.Rules {
+			tenant := r.Labels[tenantLabel]
+			if tenant == "" {
+				tenant = unlabeledTenant
+			}
+			if _, ok := rulesByTenant[tenant]; !ok {
+				order = append(order, tenant)
+			}
+			rulesByTenant[tenant] = append(rulesByTenant[tenant], r)
+		}
+
+		for _, tenant := range order {
+			tg := g
+			tg.Rules = rulesByTenant[tenant]
+			if _, ok := byTenant[tenant]; !ok {
+				byTenant[tenant] = &ruleGroups{}
+			}
+			byTenant[tenant].Groups = append(byTenant[tenant].Groups, tg)
+		}
+	}
+
+	return byTenant
+}
+
+// tenantFileName turns a tenant into a safe file name.
+func tenantFileName(tenant string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, tenant)
+}
+
+// handler serves the rules files as written to disk.
+// The tenant query parameter selects the rules of a single tenant: its file in the per-tenant layout,
+// its rules as identified by the tenant label in the single layout.
+func (o *output) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	content, err := o.serve(tenant)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(content)
+}
+
+func (o *output) serve(tenant string) ([]byte, error) {
+	if o.resources != nil {
+		return o.serveResources(tenant)
+	}
+
+	if o.layout == layoutPerTenant {
+		if tenant != "" {
+			return readRulesFile(o.tenantPath(tenant))
+		}
+
+		files, err := o.current()
+		if err != nil {
+			return nil, err
+		}
+
+		return concatFiles(files), nil
+	}
+
+	content, err := readRulesFile(o.file)
+	if err != nil || tenant == "" {
+		return content, err
+	}
+
+	rgs, _, err := parseRuleGroups(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return tenantRules(rgs, tenant, o.tenantLabel, o.file)
+}
+
+// serveResources serves the rules of the applied PrometheusRule resources.
+func (o *output) serveResources(tenant string) ([]byte, error) {
+	files, err := o.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return o.serveFiles(files, tenant)
+}
+
+// concatFiles concatenates the files into a multi-document YAML, noting the source of every document.
+func concatFiles(files []ruleFile) []byte {
+	var buf bytes.Buffer
+	for _, f := range files {
+		fmt.Fprintf(&buf, "---\n# Source: %s\n", f.path)
+		buf.Write(f.content)
+	}
+
+	return buf.Bytes()
+}
+
+// tenantRules encodes the rules of a tenant found in the given rules file.
+func tenantRules(rgs *ruleGroups, tenant, tenantLabel, path string) ([]byte, error) {
+	trgs, ok := splitByTenant(rgs, tenantLabel)[tenant]
+	if !ok {
+		return nil, fmt.Errorf("no rules of tenant %s in %s: %w", tenant, path, os.ErrNotExist)
+	}
+	b, err := yaml.Marshal(trgs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules of tenant %s: %w", tenant, err)
+	}
+
+	return b, nil
+}
+
+// readRulesFile reads the rules of the file, without the header of the syncer.
+func readRulesFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file %s: %w", path, err)
+	}
+
+	return stripHeader(content), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// overlay merges the groups of a local file into the synced rules, e.g. meta-alerts mandated by the platform like RulerDown,
+// which then survive even if a tenant deletes all of its rules in the backend.
+type overlay struct {
+	file      string
+	logPrefix string
+}
+
+// merge adds the groups of the overlay to the rules, replacing synced groups of the same name. It tells whether any group was added.
+// The file is read every cycle, so that changes of a mounted ConfigMap are picked up without a restart.
+func (o *overlay) merge(rgs *ruleGroups) (bool, error) {
+	b, err := os.ReadFile(o.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read overlay: %w", err)
+	}
+	orgs, _, err := parseRuleGroups(b)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse overlay %s: %w", o.file, err)
+	}
+	if err := orgs.validate(); err != nil {
+		return false, fmt.Errorf("invalid overlay %s: %w", o.file, err)
+	}
+	if len(orgs.Groups) == 0 {
+		return false, nil
+	}
+
+	names := make(map[string]struct{}, len(orgs.Groups))
+	for _, g := range orgs.Groups {
+		names[g.Name] = struct{}{}
+	}
+	groups := make([]ruleGroup, 0, len(rgs.Groups)+len(orgs.Groups))
+	for _, g := range rgs.Groups {
+		if _, ok := names[g.Name]; ok {
+			debugf("%sthe group %q of the overlay %s replaces the synced group of the same name", o.logPrefix, g.Name, o.file)
+			continue
+		}
+		groups = append(groups, g)
+	}
+	rgs.Groups = append(groups, orgs.Groups...)
+
+	return true, nil
+}
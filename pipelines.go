@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// configReloadDelay coalesces the bursts of file system events caused by a single change of -config.file.
+const configReloadDelay = time.Second
+
+// pipelinesFile is the content of -config.file.
+type pipelinesFile struct {
+	Pipelines []pipelineSpec `yaml:"pipelines"`
+}
+
+// pipelineSpec configures a pipeline. Fields that are not set default to the flags.
+type pipelineSpec struct {
+	// Name identifies the pipeline and defaults to the tenant.
+	Name             string         `yaml:"name"`
+	Tenant           string         `yaml:"tenant"`
+	File             string         `yaml:"file"`
+	OutputDir        string         `yaml:"output_dir"`
+	ObservatoriumURL string         `yaml:"observatorium_api_url"`
+	ObservatoriumCA  string         `yaml:"observatorium_ca"`
+	RulesBackendURL  string         `yaml:"rules_backend_url"`
+	Interval         model.Duration `yaml:"interval"`
+	Jitter           model.Duration `yaml:"jitter"`
+	// StalenessThreshold overrides -sync.staleness-threshold.
+	StalenessThreshold model.Duration `yaml:"staleness_threshold"`
+	// Stagger overrides -sync.stagger.
+	Stagger *bool `yaml:"stagger"`
+	// Align overrides -interval.align.
+	Align *bool `yaml:"align"`
+	// The timeouts override those of the stages given by the flags, e.g. -fetch.timeout.
+	FetchTimeout    model.Duration `yaml:"fetch_timeout"`
+	ValidateTimeout model.Duration `yaml:"validate_timeout"`
+	WriteTimeout    model.Duration `yaml:"write_timeout"`
+	ReloadTimeout   model.Duration `yaml:"reload_timeout"`
+	// OverlayFile overrides -overlay.file.
+	OverlayFile string `yaml:"overlay_file"`
+	// AlertRelabelURL and AlertRelabelFile override -alert-relabel.url and -alert-relabel.file.
+	AlertRelabelURL  string `yaml:"alert_relabel_url"`
+	AlertRelabelFile string `yaml:"alert_relabel_file"`
+	// Transformers are run in order on the rules of the pipeline, after the transformers enabled by the flags.
+	Transformers []transformerSpec `yaml:"transformers"`
+}
+
+// resolve returns the configuration of the pipeline, based on the configuration given by the flags.
+func (p pipelineSpec) resolve(base *config) (*config, error) {
+	cfg := *base
+	cfg.configFile = ""
+	cfg.pipeline = p.Name
+
+	if p.Tenant != "" {
+		cfg.tenant = p.Tenant
+	}
+	if p.File != "" {
+		cfg.file = p.File
+	}
+	if p.OutputDir != "" {
+		cfg.output.dir = p.OutputDir
+	}
+	if p.ObservatoriumURL != "" {
+		cfg.observatoriumURL = p.ObservatoriumURL
+	}
+	if p.ObservatoriumCA != "" {
+		cfg.observatoriumCA = p.ObservatoriumCA
+	}
+	if p.RulesBackendURL != "" {
+		cfg.rulesBackendURL = p.RulesBackendURL
+	}
+	if p.Interval != 0 {
+		cfg.interval = time.Duration(p.Interval)
+	}
+	if p.Jitter != 0 {
+		cfg.jitter = time.Duration(p.Jitter)
+	}
+	if p.StalenessThreshold != 0 {
+		cfg.staleness = time.Duration(p.StalenessThreshold)
+	}
+	if p.Stagger != nil {
+		cfg.stagger = *p.Stagger
+	}
+	if p.Align != nil {
+		cfg.align = *p.Align
+	}
+	for _, o := range []struct {
+		value model.Duration
+		dst   *time.Duration
+	}{
+		{value: p.FetchTimeout, dst: &cfg.timeouts.fetch},
+		{value: p.ValidateTimeout, dst: &cfg.timeouts.validate},
+		{value: p.WriteTimeout, dst: &cfg.timeouts.write},
+		{value: p.ReloadTimeout, dst: &cfg.timeouts.reload},
+	} {
+		if o.value != 0 {
+			*o.dst = time.Duration(o.value)
+		}
+	}
+	if p.OverlayFile != "" {
+		cfg.overlayFile = p.OverlayFile
+	}
+	if p.AlertRelabelURL != "" {
+		cfg.alertRelabel.url = p.AlertRelabelURL
+	}
+	if p.AlertRelabelFile != "" {
+		cfg.alertRelabel.file = p.AlertRelabelFile
+	}
+	cfg.transformers = p.Transformers
+	if cfg.dataDir != "" {
+		cfg.dataDir = filepath.Join(cfg.dataDir, tenantFileName(p.Name))
+	}
+	if cfg.record.dir != "" {
+		cfg.record.dir = filepath.Join(cfg.record.dir, tenantFileName(p.Name))
+	}
+	if cfg.output.target == targetPrometheusRule {
+		// Every pipeline owns its own PrometheusRules, as they prune the resources they did not apply.
+		cfg.output.prometheusRule.name += "-" + kubeName(p.Name)
+	}
+
+	if err := checkDurationBounds(
+		durationBounds{name: "interval", value: cfg.interval, min: time.Second, max: 24 * time.Hour},
+		durationBounds{name: "jitter", value: cfg.jitter, max: cfg.interval},
+		durationBounds{name: "staleness_threshold", value: cfg.staleness, max: 7 * 24 * time.Hour},
+		durationBounds{name: "fetch_timeout", value: cfg.timeouts.fetch, max: time.Hour},
+		durationBounds{name: "validate_timeout", value: cfg.timeouts.validate, max: time.Hour},
+		durationBounds{name: "write_timeout", value: cfg.timeouts.write, max: time.Hour},
+		durationBounds{name: "reload_timeout", value: cfg.timeouts.reload, max: time.Hour},
+	); err != nil {
+		return nil, err
+	}
+	if cfg.stagger && cfg.align {
+		return nil, fmt.Errorf("stagger and align are mutually exclusive")
+	}
+	if (cfg.alertRelabel.url == "") != (cfg.alertRelabel.file == "") {
+		return nil, fmt.Errorf("alert_relabel_url and alert_relabel_file must be set together")
+	}
+	if cfg.alertRelabel.url != "" && cfg.output.target != targetFile {
+		return nil, fmt.Errorf("alert_relabel_url requires the %s target", targetFile)
+	}
+	if _, err := buildTransformers(cfg.transformers, cfg.output.tenantLabel, ""); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// target is the file or, in the per-tenant layout, the directory the pipeline writes to.
+func (c *config) target() string {
+	if c.output.target == targetPrometheusRule {
+		return "PrometheusRule " + c.kubernetes.namespace + "/" + c.output.prometheusRule.name
+	}
+	if c.output.layout == layoutPerTenant {
+		return c.output.dir
+	}
+
+	return c.file
+}
+
+// parsePipelines parses and validates the content of -config.file.
+func parsePipelines(content []byte, base *config) ([]pipelineSpec, error) {
+	var pf pipelinesFile
+	if err := yaml.UnmarshalStrict(content, &pf); err != nil {
+		return nil, fmt.Errorf("failed to parse pipelines: %w", err)
+	}
+
+	names := make(map[string]struct{}, len(pf.Pipelines))
+	targets := make(map[string]string, len(pf.Pipelines))
+	for i := range pf.Pipelines {
+		p := &pf.Pipelines[i]
+		if p.Name == "" {
+			p.Name = p.Tenant
+		}
+		if p.Name == "" {
+			return nil, fmt.Errorf("pipeline %d: one of name or tenant must be set", i)
+		}
+		if _, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("pipeline %s: duplicate pipeline name", p.Name)
+		}
+		names[p.Name] = struct{}{}
+		registerURLSecret(p.ObservatoriumURL)
+		registerURLSecret(p.RulesBackendURL)
+		registerURLSecret(p.AlertRelabelURL)
+
+		cfg, err := p.resolve(base)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		if other, ok := targets[cfg.target()]; ok {
+			return nil, fmt.Errorf("pipelines %s and %s both write to %s", other, p.Name, cfg.target())
+		}
+		targets[cfg.target()] = p.Name
+		if f := cfg.alertRelabel.file; f != "" {
+			if other, ok := targets[f]; ok {
+				return nil, fmt.Errorf("pipelines %s and %s both write to %s", other, p.Name, f)
+			}
+			targets[f] = p.Name
+		}
+	}
+
+	return pf.Pipelines, nil
+}
+
+// pipeline is a running syncer of a pipeline.
+type pipeline struct {
+	spec    pipelineSpec
+	syncer  *syncer
+	metrics *collectorSet
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (p *pipeline) stop() {
+	p.cancel()
+	<-p.done
+}
+
+// fetchSlots bounds the number of concurrent fetches. A nil value does not.
+type fetchSlots chan struct{}
+
+func newFetchSlots(n int) fetchSlots {
+	if n <= 0 {
+		return nil
+	}
+
+	return make(fetchSlots, n)
+}
+
+// acquire waits for a free slot until the context is done.
+func (s fetchSlots) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for a fetch slot: %w", ctx.Err())
+	}
+}
+
+func (s fetchSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// pipelineManager runs the pipelines of -config.file and applies changes to the file without a restart.
+// Only the pipelines that were added, removed or changed are started or stopped.
+type pipelineManager struct {
+	base  *config
+	build func(context.Context, *config, prometheus.Registerer) (*syncer, error)
+	// syncNow triggers an immediate sync of every pipeline, reloadNow a reload of -config.file.
+	syncNow   trigger
+	reloadNow trigger
+
+	// hash is the hash of the last applied content of -config.file. It is only accessed by apply.
+	hash string
+
+	mu      sync.RWMutex
+	running map[string]*pipeline
+}
+
+func newPipelineManager(base *config, build func(context.Context, *config, prometheus.Registerer) (*syncer, error)) *pipelineManager {
+	return &pipelineManager{
+		base:      base,
+		build:     build,
+		syncNow:   newTrigger(),
+		reloadNow: newTrigger(),
+		running:   make(map[string]*pipeline),
+	}
+}
+
+// apply reads -config.file and starts, restarts and stops pipelines accordingly.
+// If any pipeline fails to build, the running pipelines are left untouched.
+func (m *pipelineManager) apply(ctx context.Context) error {
+	content, err := os.ReadFile(m.base.configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", m.base.configFile, err)
+	}
+	hash := contentHash(content)
+	if hash == m.hash {
+		return nil
+	}
+
+	specs, err := parsePipelines(content, m.base)
+	if err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	current := make(map[string]*pipeline, len(m.running))
+	for name, p := range m.running {
+		current[name] = p
+	}
+	m.mu.RUnlock()
+
+	wanted := make(map[string]struct{}, len(specs))
+	started := make(map[string]*pipeline)
+	for _, spec := range specs {
+		wanted[spec.Name] = struct{}{}
+		if p, ok := current[spec.Name]; ok && reflect.DeepEqual(p.spec, spec) {
+			continue
+		}
+
+		p, err := m.start(ctx, spec)
+		if err != nil {
+			// None of them runs yet.
+			for _, p := range started {
+				p.cancel()
+			}
+			return fmt.Errorf("pipeline %s: %w", spec.Name, err)
+		}
+		started[spec.Name] = p
+	}
+
+	var stopped []*pipeline
+	m.mu.Lock()
+	for name, p := range m.running {
+		_, restarted := started[name]
+		if _, ok := wanted[name]; ok && !restarted {
+			continue
+		}
+		stopped = append(stopped, p)
+		delete(m.running, name)
+	}
+	for name, p := range started {
+		m.running[name] = p
+	}
+	m.mu.Unlock()
+
+	for _, p := range stopped {
+		p.stop()
+		if _, ok := started[p.spec.Name]; !ok {
+			infof("stopped pipeline %s", p.spec.Name)
+		}
+	}
+	for name, p := range started {
+		go func(p *pipeline) {
+			defer close(p.done)
+			_ = p.syncer.run(p.ctx)
+		}(p)
+		if _, ok := current[name]; ok {
+			infof("restarted pipeline %s", name)
+		} else {
+			infof("started pipeline %s", name)
+		}
+	}
+
+	m.hash = hash
+
+	return nil
+}
+
+// start builds the syncer of a pipeline. It runs once it is added to the running pipelines.
+func (m *pipelineManager) start(ctx context.Context, spec pipelineSpec) (*pipeline, error) {
+	cfg, err := spec.resolve(m.base)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	metrics := &collectorSet{}
+	syn, err := m.build(ctx, cfg, prometheus.WrapRegistererWith(prometheus.Labels{"pipeline": spec.Name}, metrics))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &pipeline{spec: spec, syncer: syn, metrics: metrics, ctx: ctx, cancel: cancel, done: make(chan struct{})}, nil
+}
+
+// run watches -config.file and forwards immediate syncs to the pipelines until the context is done.
+func (m *pipelineManager) run(ctx context.Context) error {
+	defer m.stopAll()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", m.base.configFile, err)
+	}
+	defer watcher.Close()
+	// The directory is watched, as editors and Kubernetes replace the file rather than writing to it.
+	if err := watcher.Add(filepath.Dir(m.base.configFile)); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", m.base.configFile, err)
+	}
+
+	var changed <-chan time.Time
+	for {
+		select {
+		case <-m.syncNow:
+			m.mu.RLock()
+			for _, p := range m.running {
+				p.syncer.syncNow.fire()
+			}
+			m.mu.RUnlock()
+		case <-watcher.Events:
+			changed = time.After(configReloadDelay)
+		case err := <-watcher.Errors:
+			warnf("failed to watch %s: %v", m.base.configFile, err)
+		case <-changed:
+			changed = nil
+			m.reload(ctx)
+		case <-m.reloadNow:
+			m.reload(ctx)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (m *pipelineManager) reload(ctx context.Context) {
+	if err := m.apply(ctx); err != nil {
+		errorf("failed to reload %s, keeping the running pipelines: %v", m.base.configFile, err)
+	}
+}
+
+func (m *pipelineManager) stopAll() {
+	m.mu.Lock()
+	running := m.running
+	m.running = make(map[string]*pipeline)
+	m.mu.Unlock()
+
+	for _, p := range running {
+		p.stop()
+	}
+}
+
+// handler serves the endpoint given by handler for the pipeline selected with the pipeline query parameter.
+// The parameter can be omitted if there is a single pipeline.
+func (m *pipelineManager) handler(handler func(*syncer) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("pipeline")
+		syn, err := m.lookup(name)
+		if err != nil {
+			code := http.StatusNotFound
+			if name == "" {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, fmt.Sprintf("select a pipeline with ?pipeline=: %v", err), code)
+			return
+		}
+
+		handler(syn)(w, r)
+	}
+}
+
+// lookup returns the syncer of the running pipeline of the given name.
+// The name can be empty if there is a single pipeline.
+func (m *pipelineManager) lookup(name string) (*syncer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if p, ok := m.running[name]; ok {
+		return p.syncer, nil
+	}
+	if name == "" && len(m.running) == 1 {
+		for _, p := range m.running {
+			return p.syncer, nil
+		}
+	}
+
+	names := make([]string, 0, len(m.running))
+	for n := range m.running {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	if name == "" {
+		return nil, fmt.Errorf("a pipeline must be selected, one of: %s", strings.Join(names, ", "))
+	}
+
+	return nil, fmt.Errorf("unknown pipeline %q, one of: %s", name, strings.Join(names, ", "))
+}
+
+// syncers returns the syncers of the running pipelines.
+func (m *pipelineManager) syncers() []*syncer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	syncers := make([]*syncer, 0, len(m.running))
+	for _, p := range m.running {
+		syncers = append(syncers, p.syncer)
+	}
+
+	return syncers
+}
+
+// statusHandler reports the status of every running pipeline as JSON, sorted by name,
+// so that all of them can be checked without knowing their names.
+func (m *pipelineManager) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	syncers := m.syncers()
+	statuses := make([]syncStatus, 0, len(syncers))
+	for _, s := range syncers {
+		statuses = append(statuses, s.status.snapshot())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Config.Pipeline < statuses[j].Config.Pipeline })
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(struct {
+		Pipelines []syncStatus `json:"pipelines"`
+	}{Pipelines: statuses})
+}
+
+// Describe sends no descriptions, which makes the pipelines an unchecked collector,
+// as the metrics come and go with the pipelines.
+func (m *pipelineManager) Describe(chan<- *prometheus.Desc) {}
+
+// Collect collects the metrics of the running pipelines.
+func (m *pipelineManager) Collect(ch chan<- prometheus.Metric) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, p := range m.running {
+		p.metrics.Collect(ch)
+	}
+}
+
+// collectorSet is a prometheus.Registerer keeping the metrics of a pipeline,
+// so that they can be collected while the pipeline runs and dropped once it stops.
+type collectorSet struct {
+	collectors []prometheus.Collector
+}
+
+func (c *collectorSet) Register(col prometheus.Collector) error {
+	c.collectors = append(c.collectors, col)
+	return nil
+}
+
+func (c *collectorSet) MustRegister(cols ...prometheus.Collector) {
+	for _, col := range cols {
+		_ = c.Register(col)
+	}
+}
+
+func (c *collectorSet) Unregister(col prometheus.Collector) bool {
+	for i, registered := range c.collectors {
+		if registered == col {
+			c.collectors = append(c.collectors[:i], c.collectors[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *collectorSet) Collect(ch chan<- prometheus.Metric) {
+	for _, col := range c.collectors {
+		col.Collect(ch)
+	}
+}
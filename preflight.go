@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	preflightReject = "reject"
+	preflightWarn   = "warn"
+)
+
+type preflightConfig struct {
+	queryURL   string
+	maxSeries  int
+	maxSamples int64
+	policy     string
+	timeout    time.Duration
+}
+
+// preflight runs the expressions of new or changed recording rules once as instant queries against Thanos Query,
+// to catch those returning too many series or touching too many samples before Thanos Ruler evaluates them every interval.
+// Its state is only accessed by the goroutine running the sync cycles.
+type preflight struct {
+	client     *http.Client
+	queryURL   *url.URL
+	maxSeries  int
+	maxSamples int64
+	policy     string
+	timeout    time.Duration
+	logPrefix  string
+
+	exceeding *prometheus.CounterVec
+	errors    prometheus.Counter
+
+	// checked maps the expressions of the recording rules of the last cycle to the limit they exceed, empty if none.
+	// They are not queried again until they change.
+	checked map[string]string
+}
+
+// seed marks the expressions of the rules on disk as checked, so that restarts do not query them all again.
+func (p *preflight) seed(files []ruleFile) {
+	p.checked = make(map[string]string)
+	for _, f := range files {
+		if f.groups == nil {
+			continue
+		}
+		for _, g := range f.groups.Groups {
+			for _, r := range g.Rules {
+				if r.Record != "" {
+					p.checked[r.Expr] = ""
+				}
+			}
+		}
+	}
+}
+
+// check queries the expressions of the recording rules not checked before and returns the rejections of the groups
+// with rules exceeding a limit with -preflight.policy=reject, by their index. Failed queries do not refuse the rules,
+// which are queried again the next cycle.
+func (p *preflight) check(ctx context.Context, rgs *ruleGroups) map[int][]ruleRejection {
+	rejected := make(map[int][]ruleRejection)
+	checked := make(map[string]string)
+	queried, failed := 0, 0
+	for gi, g := range rgs.Groups {
+		for ri, r := range g.Rules {
+			if r.Record == "" {
+				continue
+			}
+			reason, ok := checked[r.Expr]
+			if !ok {
+				if reason, ok = p.checked[r.Expr]; !ok {
+					var (
+						limit string
+						err   error
+					)
+					queried++
+					if limit, reason, err = p.query(ctx, r.Expr); err != nil {
+						failed++
+						p.errors.Inc()
+						warnf("%sfailed to preflight recording rule %s in group %q: %v", p.logPrefix, r.Record, g.Name, err)
+						continue
+					}
+					if reason != "" {
+						p.exceeding.WithLabelValues(limit).Inc()
+						if p.policy == preflightWarn {
+							warnf("%srecording rule %s in group %q %s", p.logPrefix, r.Record, g.Name, reason)
+						}
+					}
+				}
+				checked[r.Expr] = reason
+			}
+			if reason != "" && p.policy == preflightReject {
+				rejected[gi] = append(rejected[gi], newRuleRejection(g, ri, reason))
+			}
+		}
+	}
+	p.checked = checked
+	if queried > 0 {
+		debugf("%spreflighted %d new or changed recording rules, %d of them failed", p.logPrefix, queried, failed)
+	}
+
+	return rejected
+}
+
+// query runs the expression as an instant query and returns the limit it exceeds, series or samples, and why, empty if none.
+func (p *preflight) query(ctx context.Context, expr string) (string, string, error) {
+	params := url.Values{
+		"query": []string{expr},
+		"stats": []string{"all"},
+	}
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+		params.Set("timeout", model.Duration(p.timeout).String())
+	}
+	// Backends supporting it return no more series than needed to tell the limit is exceeded.
+	if p.maxSeries > 0 {
+		params.Set("limit", strconv.Itoa(p.maxSeries+1))
+	}
+
+	qr, err := queryAPI(ctx, p.client, p.queryURL, "api/v1/query", params)
+	if err != nil {
+		return "", "", err
+	}
+
+	series := 1
+	switch qr.Data.ResultType {
+	case model.ValVector.String(), model.ValMatrix.String():
+		var result []json.RawMessage
+		if err := json.Unmarshal(qr.Data.Result, &result); err != nil {
+			return "", "", fmt.Errorf("failed to decode query result: %w", err)
+		}
+		series = len(result)
+	}
+	if p.maxSeries > 0 && series > p.maxSeries {
+		return "series", fmt.Sprintf("returns more than the %d series of -preflight.max-series", p.maxSeries), nil
+	}
+	// The samples are only checked if the backend reports them.
+	if p.maxSamples > 0 && qr.Data.Stats != nil {
+		if samples := qr.Data.Stats.Samples.TotalQueryableSamples; samples > p.maxSamples {
+			return "samples", fmt.Sprintf("touches %d samples, more than the %d of -preflight.max-samples", samples, p.maxSamples), nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// preflightRules adds the rejections of the preflight to those of the validation, attributed like them.
+func (s *syncer) preflightRules(ctx context.Context, rgs *ruleGroups, rejected map[int][]ruleRejection) {
+	for i, rejections := range s.preflight.check(ctx, rgs) {
+		for j := range rejections {
+			rejections[j].Tenant = s.rejectionTenant(rgs.Groups[i], rejections[j].Index)
+		}
+		rejected[i] = append(rejected[i], rejections...)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// previewContext is the number of unchanged lines around the changes of the diff of a preview.
+const previewContext = 3
+
+// maxDiffEdits bounds the work of diffing a preview. Beyond it, the differing lines are reported as removed and added at once.
+const maxDiffEdits = 2000
+
+// minPreviewInterval is the least time between the previews of a pipeline, which run one at a time, so that the endpoint
+// cannot be used to flood the backend with fetches.
+const minPreviewInterval = time.Second
+
+// previewResponse is what the syncer would write for the rules the backend serves now, and how it differs from what is on disk.
+type previewResponse struct {
+	Tenant  string     `json:"tenant,omitempty"`
+	Changed bool       `json:"changed"`
+	Groups  groupDelta `json:"groups"`
+	// Rules are the rules as they would be written, and Diff a unified diff from the rules on disk to them.
+	Rules string `json:"rules"`
+	Diff  string `json:"diff,omitempty"`
+}
+
+// preview fetches, validates and transforms the rules like a sync cycle, without writing them or recording anything about them.
+// It returns the rules of the tenant, or all of them if no tenant is given, as they are served by /debug/rules once synced.
+func (s *syncer) preview(ctx context.Context, tenant string) (*previewResponse, error) {
+	rgs, content, err := s.previewRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.output.render(rgs, content)
+	if err != nil {
+		return nil, &stageError{stage: stageWrite, err: fmt.Errorf("failed to render rules files: %w", err)}
+	}
+	if err := s.checkTenantQuota(files, true); err != nil {
+		return nil, err
+	}
+
+	rules, err := s.output.serveFiles(files, tenant)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	current, err := s.output.serve(tenant)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	res := &previewResponse{
+		Tenant:  tenant,
+		Changed: string(rules) != string(current),
+		Rules:   string(rules),
+		Diff:    unifiedDiff(string(current), string(rules), "current", "preview"),
+	}
+	oldGroups, newGroups := make(map[string]string), make(map[string]string)
+	if rgs, _, err := parseRuleGroups(current); err == nil {
+		oldGroups = rgs.groupHashes()
+	}
+	if rgs, _, err := parseRuleGroups(rules); err == nil {
+		newGroups = rgs.groupHashes()
+	}
+	res.Groups = diffGroups(oldGroups, newGroups)
+
+	return res, nil
+}
+
+// previewRules fetches, validates and transforms the rules like a sync cycle without the chaos, and returns them with their content.
+// The fetch runs concurrently with the cycles, the validation and the transformers only between them, as they are not safe
+// for concurrent use.
+func (s *syncer) previewRules(ctx context.Context) (*ruleGroups, []byte, error) {
+	payload, _, contentType, _, err := s.fetchPayload(ctx)
+	if err != nil {
+		return nil, nil, &stageError{stage: stageFetch, err: fmt.Errorf("failed to get rules from url: %w", err)}
+	}
+
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	rgs, content, err := s.validatePayload(ctx, payload, contentType, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rgs, content, err = s.transformRules(rgs, content, true); err != nil {
+		return nil, nil, err
+	}
+	if content == nil {
+		content = payload
+	}
+
+	return rgs, content, nil
+}
+
+// startPreview tells whether a preview may start now, marking it running until the returned function is called.
+func (s *syncer) startPreview() (func(), bool) {
+	s.previewMu.Lock()
+	defer s.previewMu.Unlock()
+
+	if s.previewing || time.Since(s.lastPreview) < minPreviewInterval {
+		return nil, false
+	}
+	s.previewing = true
+
+	return func() {
+		s.previewMu.Lock()
+		s.previewing, s.lastPreview = false, time.Now()
+		s.previewMu.Unlock()
+	}, true
+}
+
+// previewHandler serves the preview of the rules as JSON, of a single tenant with ?tenant=.
+func (s *syncer) previewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	done, ok := s.startPreview()
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(minPreviewInterval/time.Second)))
+		http.Error(w, "a preview is running or just ran, retry later", http.StatusTooManyRequests)
+		return
+	}
+	defer done()
+
+	res, err := s.preview(r.Context(), r.URL.Query().Get("tenant"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch stage, _ := classify(err); stage {
+		case stageFetch:
+			status = http.StatusBadGateway
+		case stageValidate:
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, redact(err.Error()), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(res)
+}
+
+// serveFiles returns the rules of the tenant in the files, or all of them if no tenant is given.
+func (o *output) serveFiles(files []ruleFile, tenant string) ([]byte, error) {
+	if tenant == "" {
+		if o.layout != layoutPerTenant && o.resources == nil && len(files) == 1 {
+			return files[0].content, nil
+		}
+		return concatFiles(files), nil
+	}
+
+	for _, f := range files {
+		switch {
+		case o.layout == layoutPerTenant && f.tenant == tenant:
+			return f.content, nil
+		case o.layout != layoutPerTenant && f.groups != nil:
+			return tenantRules(f.groups, tenant, o.tenantLabel, f.path)
+		}
+	}
+
+	return nil, fmt.Errorf("no rules of tenant %s: %w", tenant, os.ErrNotExist)
+}
+
+// diffOp is a line of a diff, kept, removed or added.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the unified diff of two texts, empty if they do not differ.
+func unifiedDiff(a, b, aName, bName string) string {
+	if a == b {
+		return ""
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// The hunk spans the changes closer to one another than twice the context.
+		start := i - previewContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops) && j-end <= 2*previewContext; j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			}
+		}
+		stop := end + previewContext + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		aStart, bStart := 1, 1
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				aStart++
+			}
+			if op.kind != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		// Empty ranges start at the line before them.
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[start:stop] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line + "\n")
+		}
+		i = stop
+	}
+
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the shortest edit of a into b, computed with the algorithm of Myers past the common prefix and suffix.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, l := range a[:prefix] {
+		ops = append(ops, diffOp{kind: ' ', line: l})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{kind: ' ', line: l})
+	}
+
+	return ops
+}
+
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// trace keeps the furthest x of every diagonal -d..d after every step d, to walk the edit back.
+	var trace [][]int
+	edits := -1
+	for d := 0; d <= n+m && edits < 0; d++ {
+		if d > maxDiffEdits {
+			return replaceLines(a, b)
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				edits = d
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	var reversed []diffOp
+	x, y := n, m
+	for d := edits; d > 0; d-- {
+		prev := trace[d-1]
+		furthest := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || k != d && furthest(k-1) < furthest(k+1) {
+			prevK = k + 1
+		}
+		prevX := furthest(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, diffOp{kind: ' ', line: a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			reversed = append(reversed, diffOp{kind: '+', line: b[y-1]})
+			y--
+		} else {
+			reversed = append(reversed, diffOp{kind: '-', line: a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, diffOp{kind: ' ', line: a[x-1]})
+		x--
+		y--
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(reversed)-1-i] = op
+	}
+
+	return ops
+}
+
+// replaceLines returns the edit removing all lines of a and adding all lines of b.
+func replaceLines(a, b []string) []diffOp {
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, l := range a {
+		ops = append(ops, diffOp{kind: '-', line: l})
+	}
+	for _, l := range b {
+		ops = append(ops, diffOp{kind: '+', line: l})
+	}
+
+	return ops
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Targets the rules are written to.
+const (
+	// targetFile writes rules files read by Thanos Ruler.
+	targetFile = "file"
+	// targetPrometheusRule applies PrometheusRule resources picked up by the Prometheus Operator.
+	targetPrometheusRule = "prometheus-rule"
+)
+
+const (
+	prometheusRuleAPIVersion = "monitoring.coreos.com/v1"
+	prometheusRuleKind       = "PrometheusRule"
+	prometheusRulesPath      = "/apis/monitoring.coreos.com/v1/namespaces/%s/prometheusrules"
+	// fieldManager owns the fields of the resources applied by the syncer.
+	fieldManager = "thanos-rule-syncer"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	// ownerLabel tells apart the resources of several syncers in a namespace, so that each only prunes its own.
+	ownerLabel       = "thanos-rule-syncer.observatorium.io/name"
+	tenantAnnotation = "thanos-rule-syncer.observatorium.io/tenant"
+
+	// kubeRequestTimeout bounds reading the resources outside of a sync cycle.
+	kubeRequestTimeout = 30 * time.Second
+)
+
+type prometheusRuleConfig struct {
+	name   string
+	labels labelsValue
+}
+
+type objectMeta struct {
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type prometheusRule struct {
+	APIVersion string     `yaml:"apiVersion"`
+	Kind       string     `yaml:"kind"`
+	Metadata   objectMeta `yaml:"metadata"`
+	Spec       ruleGroups `yaml:"spec"`
+}
+
+// prometheusRules applies rules as PrometheusRule resources with server-side apply and prunes the resources of tenants that are gone.
+// In the single layout all rules go into a resource of the configured name, in the per-tenant layout every tenant gets a resource named after it.
+type prometheusRules struct {
+	client    *kubeClient
+	name      string
+	labels    map[string]string
+	logPrefix string
+}
+
+// resourceName returns the name of the resource holding the rules of the tenant, which is empty in the single layout.
+func (p *prometheusRules) resourceName(tenant string) string {
+	if tenant == "" {
+		return p.name
+	}
+
+	return p.name + "-" + kubeName(tenant)
+}
+
+// path identifies the resource like a rules file, as namespace/name.
+func (p *prometheusRules) path(tenant string) string {
+	return p.client.namespace + "/" + p.resourceName(tenant)
+}
+
+func (p *prometheusRules) selector() string {
+	return managedByLabel + "=" + fieldManager + "," + ownerLabel + "=" + p.name
+}
+
+func (p *prometheusRules) apply(ctx context.Context, files []ruleFile) error {
+	keep := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		name := strings.TrimPrefix(f.path, p.client.namespace+"/")
+		labels := map[string]string{managedByLabel: fieldManager, ownerLabel: p.name}
+		for k, v := range p.labels {
+			labels[k] = v
+		}
+		pr := prometheusRule{
+			APIVersion: prometheusRuleAPIVersion,
+			Kind:       prometheusRuleKind,
+			Metadata:   objectMeta{Name: name, Namespace: p.client.namespace, Labels: labels},
+			Spec:       *f.groups,
+		}
+		if f.tenant != "" {
+			pr.Metadata.Annotations = map[string]string{tenantAnnotation: f.tenant}
+		}
+		body, err := yaml.Marshal(pr)
+		if err != nil {
+			return fmt.Errorf("failed to marshal PrometheusRule %s: %w", f.path, err)
+		}
+
+		query := url.Values{"fieldManager": []string{fieldManager}, "force": []string{"true"}}
+		if _, err := p.client.do(ctx, http.MethodPatch, p.resourcePath(name), query, "application/apply-patch+yaml", body); err != nil {
+			return fmt.Errorf("failed to apply PrometheusRule %s: %w", f.path, err)
+		}
+		keep[name] = struct{}{}
+		debugf("%sapplied PrometheusRule %s", p.logPrefix, f.path)
+	}
+
+	current, err := p.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pr := range current {
+		if _, ok := keep[pr.Metadata.Name]; ok {
+			continue
+		}
+		if _, err := p.client.do(ctx, http.MethodDelete, p.resourcePath(pr.Metadata.Name), nil, "", nil); err != nil {
+			return fmt.Errorf("failed to delete stale PrometheusRule %s/%s: %w", p.client.namespace, pr.Metadata.Name, err)
+		}
+		infof("%sdeleted stale PrometheusRule %s/%s", p.logPrefix, p.client.namespace, pr.Metadata.Name)
+	}
+
+	return nil
+}
+
+func (p *prometheusRules) resourcePath(name string) string {
+	return fmt.Sprintf(prometheusRulesPath, p.client.namespace) + "/" + name
+}
+
+// list returns the resources applied by the syncer, sorted by name.
+func (p *prometheusRules) list(ctx context.Context) ([]prometheusRule, error) {
+	b, err := p.client.do(ctx, http.MethodGet, fmt.Sprintf(prometheusRulesPath, p.client.namespace), url.Values{"labelSelector": []string{p.selector()}}, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PrometheusRules: %w", err)
+	}
+
+	// JSON is decoded as YAML, so that the fields of groups we do not interpret are kept.
+	var list struct {
+		Items []prometheusRule `yaml:"items"`
+	}
+	if err := yaml.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("failed to decode PrometheusRules: %w", err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Metadata.Name < list.Items[j].Metadata.Name })
+
+	return list.Items, nil
+}
+
+// current returns the applied resources as rules files.
+func (p *prometheusRules) current() ([]ruleFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeRequestTimeout)
+	defer cancel()
+
+	items, err := p.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]ruleFile, 0, len(items))
+	for i := range items {
+		pr := &items[i]
+		content, err := yaml.Marshal(pr.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal PrometheusRule %s/%s: %w", pr.Metadata.Namespace, pr.Metadata.Name, err)
+		}
+		files = append(files, ruleFile{
+			path:    pr.Metadata.Namespace + "/" + pr.Metadata.Name,
+			tenant:  pr.Metadata.Annotations[tenantAnnotation],
+			groups:  &pr.Spec,
+			content: content,
+		})
+	}
+
+	return files, nil
+}
+
+// kubeName turns a tenant into a valid part of a resource name.
+func kubeName(tenant string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, tenant)
+
+	return strings.Trim(name, "-.")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Modes of -provenance.mode.
+const (
+	provenanceOff         = "off"
+	provenanceLabels      = "labels"
+	provenanceAnnotations = "annotations"
+	provenanceStrip       = "strip"
+)
+
+// The provenance labels, like the meta labels of Prometheus service discovery.
+const (
+	provenancePrefix          = "__meta_"
+	provenanceSourceLabel     = "__meta_source"
+	provenanceSourceHashLabel = "__meta_source_hash"
+	provenanceSyncedAtLabel   = "__meta_synced_at"
+)
+
+// provenance traces the synced rules back to where they came from: every rule is labeled with the source of the syncer,
+// a hash of it to match on in Alertmanager without spelling out the URL, and the time the syncer first wrote the version of its group.
+// The source labels are set before the other transformers, so that e.g. a relabel transformer can copy them to other labels,
+// and the time last, as it is that of the rules as written. Depending on -provenance.mode, the labels are then kept,
+// moved to the annotations of the alerts, or stripped before the rules are written. The time is only ever an annotation of the alerts,
+// as a label changing with every version of a group would reset the alerts and the series of the recording rules.
+// It is safe for concurrent use.
+type provenance struct {
+	mode       string
+	source     string
+	sourceHash string
+	now        func() time.Time
+
+	mu sync.Mutex
+	// syncedAt are the times the versions of the groups were first written, by the hash of the group without provenance.
+	syncedAt map[string]string
+}
+
+func newProvenance(mode, source string) *provenance {
+	sum := sha256.Sum256([]byte(source))
+	return &provenance{
+		mode:       mode,
+		source:     source,
+		sourceHash: hex.EncodeToString(sum[:])[:12],
+		now:        time.Now,
+		syncedAt:   make(map[string]string),
+	}
+}
+
+// seed takes the times of the versions of the groups on disk, so that restarts do not rewrite all rules with a new time.
+func (p *provenance) seed(files []ruleFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, f := range files {
+		if f.groups == nil {
+			continue
+		}
+		for _, g := range f.groups.Groups {
+			if at := groupSyncedAt(g); at != "" {
+				p.syncedAt[provenanceHash(g)] = at
+			}
+		}
+	}
+}
+
+// groupSyncedAt returns the time noted on the first rule of the group, as an annotation or, as written by earlier versions, a label.
+func groupSyncedAt(g ruleGroup) string {
+	for _, r := range g.Rules {
+		if at, ok := r.Labels[provenanceSyncedAtLabel]; ok {
+			return at
+		}
+		if at, ok := r.Annotations[provenanceSyncedAtLabel]; ok {
+			return at
+		}
+	}
+
+	return ""
+}
+
+// provenanceHash hashes the group without its provenance.
+func provenanceHash(g ruleGroup) string {
+	rules := make([]rule, len(g.Rules))
+	for i, r := range g.Rules {
+		r.Labels, r.Annotations = withoutProvenance(r.Labels), withoutProvenance(r.Annotations)
+		rules[i] = r
+	}
+	g.Rules = rules
+	b, err := yaml.Marshal(g)
+	if err != nil {
+		// Groups that were just unmarshaled always marshal again.
+		return ""
+	}
+
+	return contentHash(b)
+}
+
+// withoutProvenance returns a copy of the labels or annotations without those of the provenance, nil if none is left.
+func withoutProvenance(m map[string]string) map[string]string {
+	var c map[string]string
+	for k, v := range m {
+		if strings.HasPrefix(k, provenancePrefix) {
+			continue
+		}
+		if c == nil {
+			c = make(map[string]string, len(m))
+		}
+		c[k] = v
+	}
+
+	return c
+}
+
+// sourceLabeler labels every rule with the source, before the other transformers.
+type sourceLabeler struct {
+	p *provenance
+}
+
+func (l sourceLabeler) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	for gi := range rgs.Groups {
+		g := &rgs.Groups[gi]
+		for ri := range g.Rules {
+			r := &g.Rules[ri]
+			// The labels may be shared with a copy of the rule.
+			labels := copyLabels(r.Labels)
+			labels[provenanceSourceLabel] = l.p.source
+			labels[provenanceSourceHashLabel] = l.p.sourceHash
+			r.Labels = labels
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// provenanceWriter notes the time on the rules last, and keeps, moves or strips the provenance labels as of -provenance.mode.
+type provenanceWriter struct {
+	p *provenance
+}
+
+func (w provenanceWriter) transform(rgs *ruleGroups) (bool, error) {
+	return w.write(rgs, false)
+}
+
+// preview writes the provenance like transform, without forgetting the times of the groups not in the rules, e.g. of other tenants.
+func (w provenanceWriter) preview(rgs *ruleGroups) (bool, error) {
+	return w.write(rgs, true)
+}
+
+func (w provenanceWriter) write(rgs *ruleGroups, preview bool) (bool, error) {
+	p := w.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now().UTC().Format(time.RFC3339)
+	seen := make(map[string]string, len(rgs.Groups))
+	changed := false
+	for gi := range rgs.Groups {
+		g := &rgs.Groups[gi]
+		h := provenanceHash(*g)
+		at, ok := p.syncedAt[h]
+		if !ok {
+			at = now
+		}
+		seen[h] = at
+
+		for ri := range g.Rules {
+			r := &g.Rules[ri]
+			meta := make(map[string]string)
+			for k, v := range r.Labels {
+				if strings.HasPrefix(k, provenancePrefix) {
+					meta[k] = v
+				}
+			}
+			if len(meta) == 0 {
+				continue
+			}
+			changed = true
+
+			switch p.mode {
+			case provenanceLabels:
+				// The source labels are kept, the time is only annotated.
+				meta = map[string]string{provenanceSyncedAtLabel: at}
+			case provenanceAnnotations:
+				r.Labels = withoutProvenance(r.Labels)
+				meta[provenanceSyncedAtLabel] = at
+			default:
+				r.Labels = withoutProvenance(r.Labels)
+				continue
+			}
+			// Recording rules have no annotations.
+			if r.Alert == "" {
+				continue
+			}
+			annotations := copyLabels(r.Annotations)
+			for k, v := range meta {
+				annotations[k] = v
+			}
+			r.Annotations = annotations
+		}
+	}
+	// The times of the versions no longer synced are forgotten, unless the rules are only previewed.
+	if !preview {
+		p.syncedAt = seen
+	}
+
+	return changed, nil
+}
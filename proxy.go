@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxyFunc returns the proxy of the HTTP clients: the one of -http.proxy-url if given, of HTTPS_PROXY and HTTP_PROXY otherwise.
+// Either way, NO_PROXY is honored and requests to localhost are not proxied, so that a local Thanos Ruler stays reachable.
+func proxyFunc(proxyURL string) func(*http.Request) (*url.URL, error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	proxy := (&httpproxy.Config{HTTPProxy: proxyURL, HTTPSProxy: proxyURL, NoProxy: noProxy}).ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// socks5ProxyURL returns the proxy URL of -http.socks5-proxy, given as host:port or as socks5://[user:password@]host:port.
+// The HTTP clients dial SOCKS5 proxies themselves, handing them the names of the hosts to resolve.
+func socks5ProxyURL(addr string) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "socks5://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "socks5" || u.Host == "" || u.Port() == "" {
+		return "", fmt.Errorf("invalid -http.socks5-proxy %q, must be host:port or a URL like socks5://bastion:1080, with the credentials as its user information", redactURL(addr))
+	}
+
+	return u.String(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// tenantBytes returns the size in bytes of the rules of every tenant in the files, attributed like tenantHashes:
+// the whole file in the per-tenant layout or to the tenant of the syncer, and the encoded rules of every tenant label value otherwise.
+func (s *syncer) tenantBytes(files []ruleFile) map[string]int {
+	sizes := make(map[string]int)
+	for _, f := range files {
+		tenant := f.tenant
+		if tenant == "" {
+			tenant = s.tenant
+		}
+		if tenant != "" || f.groups == nil {
+			sizes[tenant] += len(f.content)
+			continue
+		}
+		for t, trgs := range splitByTenant(f.groups, s.output.tenantLabel) {
+			b, err := yaml.Marshal(trgs)
+			if err != nil {
+				continue
+			}
+			sizes[t] += len(b)
+		}
+	}
+
+	return sizes
+}
+
+// checkTenantQuota refuses the files if the rules of a tenant exceed -limits.max-bytes-per-tenant, so that one tenant cannot fill
+// the rules volume shared by all tenants of a Ruler. The rules on disk are then left as they are. A preview does not record the rejections.
+func (s *syncer) checkTenantQuota(files []ruleFile, preview bool) error {
+	if s.maxTenantBytes <= 0 {
+		return nil
+	}
+
+	sizes := s.tenantBytes(files)
+	tenants := make([]string, 0, len(sizes))
+	for t, n := range sizes {
+		if int64(n) > s.maxTenantBytes {
+			tenants = append(tenants, t)
+		}
+	}
+	if len(tenants) == 0 {
+		return nil
+	}
+	sort.Strings(tenants)
+
+	rejected := make([]ruleRejection, 0, len(tenants))
+	reasons := make([]string, 0, len(tenants))
+	for _, t := range tenants {
+		reason := fmt.Sprintf("%d bytes of rules exceed the maximum of %d bytes per tenant", sizes[t], s.maxTenantBytes)
+		rejected = append(rejected, ruleRejection{Tenant: t, Index: -1, Reason: reason})
+		reasons = append(reasons, fmt.Sprintf("tenant %q: %s", t, reason))
+	}
+	if !preview {
+		s.rejections.add(rejected)
+	}
+
+	return &stageError{stage: stageValidate, code: codeInvalid, err: fmt.Errorf("rules exceed limits: %s", strings.Join(reasons, "; "))}
+}
+
+// observeTenantBytes sets rule_syncer_tenant_rules_bytes to the size of the rules of every tenant in the applied files.
+func (s *syncer) observeTenantBytes(files []ruleFile) {
+	s.metrics.tenantRulesBytes.Reset()
+	for t, n := range s.tenantBytes(files) {
+		s.metrics.tenantRulesBytes.WithLabelValues(t).Set(float64(n))
+	}
+}
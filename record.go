@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	recordingMetaExt    = ".json"
+	recordingPayloadExt = ".payload"
+	// recordingTimeFormat names the recordings, so that their names sort by time.
+	recordingTimeFormat = "20060102T150405.000000000Z"
+)
+
+type recordConfig struct {
+	dir       string
+	retention int
+	// replayInPlace makes the replay subcommand write to the output of the flags and reload -thanos-rule-url.
+	replayInPlace bool
+}
+
+// recording describes a fetched payload kept in -record.dir, next to which the payload is stored as is.
+type recording struct {
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	ContentType string    `json:"contentType"`
+	Hash        string    `json:"hash"`
+}
+
+// recorder keeps the fetched payloads, so that they can be replayed later with the replay subcommand.
+// Its state is only accessed by the goroutine running the sync cycles.
+type recorder struct {
+	dir       string
+	retention int
+	source    string
+	logPrefix string
+	// last is the hash of the last recorded payload, as unchanged payloads are not recorded again.
+	last string
+}
+
+func newRecorder(cfg recordConfig, source string) (*recorder, error) {
+	if err := os.MkdirAll(cfg.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create -record.dir: %w", err)
+	}
+
+	r := &recorder{dir: cfg.dir, retention: cfg.retention, source: source}
+	if names, err := recordingNames(cfg.dir); err == nil && len(names) > 0 {
+		if rec, _, err := readRecording(cfg.dir, names[len(names)-1]); err == nil {
+			r.last = rec.Hash
+		}
+	}
+
+	return r, nil
+}
+
+// record stores the payload unless it is the one recorded last, then removes the oldest recordings beyond the retention.
+func (r *recorder) record(payload []byte, hash, contentType string, now time.Time) error {
+	if hash == r.last {
+		return nil
+	}
+
+	name := now.UTC().Format(recordingTimeFormat)
+	if err := os.WriteFile(filepath.Join(r.dir, name+recordingPayloadExt), payload, 0o644); err != nil {
+		return fmt.Errorf("failed to record payload: %w", err)
+	}
+	meta, err := json.Marshal(recording{Time: now.UTC(), Source: r.source, ContentType: contentType, Hash: hash})
+	if err != nil {
+		return fmt.Errorf("failed to marshal recording: %w", err)
+	}
+	// The metadata is written last, as it marks the recording complete.
+	if err := os.WriteFile(filepath.Join(r.dir, name+recordingMetaExt), meta, 0o644); err != nil {
+		return fmt.Errorf("failed to record payload: %w", err)
+	}
+	r.last = hash
+	debugf("%srecorded payload %s", r.logPrefix, name)
+
+	if r.retention <= 0 {
+		return nil
+	}
+	names, err := recordingNames(r.dir)
+	if err != nil {
+		return err
+	}
+	for len(names) > r.retention {
+		for _, ext := range []string{recordingMetaExt, recordingPayloadExt} {
+			if err := os.Remove(filepath.Join(r.dir, names[0]+ext)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove old recording: %w", err)
+			}
+		}
+		names = names[1:]
+	}
+
+	return nil
+}
+
+// recordingNames lists the complete recordings of the directory, oldest first.
+func recordingNames(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+recordingMetaExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recordings: %w", err)
+	}
+	names := make([]string, 0, len(paths))
+	for _, p := range paths {
+		names = append(names, strings.TrimSuffix(filepath.Base(p), recordingMetaExt))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func readRecording(dir, name string) (recording, []byte, error) {
+	var rec recording
+	b, err := os.ReadFile(filepath.Join(dir, name+recordingMetaExt))
+	if err != nil {
+		return rec, nil, fmt.Errorf("failed to read recording %s: %w", name, err)
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return rec, nil, fmt.Errorf("failed to decode recording %s: %w", name, err)
+	}
+	payload, err := os.ReadFile(filepath.Join(dir, name+recordingPayloadExt))
+	if err != nil {
+		return rec, nil, fmt.Errorf("failed to read recording %s: %w", name, err)
+	}
+
+	return rec, payload, nil
+}
+
+// replayFetcher serves a recorded payload.
+type replayFetcher struct {
+	payload     []byte
+	contentType string
+}
+
+func (f *replayFetcher) getRules(_ context.Context) (*rulesPayload, error) {
+	return &rulesPayload{body: io.NopCloser(bytes.NewReader(f.payload)), contentType: f.contentType}, nil
+}
+
+// runReplay feeds the payloads recorded in -record.dir through a sync cycle each, in the order they were fetched,
+// configured by the same flags as the syncer, so that transforms and validation are tested against real payloads.
+// The rules are written to a scratch directory removed once done and reloaded by a fake Thanos Ruler answering every request,
+// unless -replay.in-place is given, so that replaying next to a live syncer does not change the rules of its Ruler.
+// It fails if any of the cycles failed.
+func runReplay(cfg *config, stdout io.Writer) error {
+	dir := cfg.record.dir
+	if dir == "" {
+		return fmt.Errorf("-record.dir is required to replay the payloads recorded in it")
+	}
+	if cfg.configFile != "" {
+		return fmt.Errorf("the pipelines of -config.file are not replayed, point -record.dir at the recordings of a pipeline, in the directory named after it")
+	}
+	names, err := recordingNames(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no recordings in %s", dir)
+	}
+
+	// Replaying neither records again nor touches the state of the syncer, nor tells anyone about the cycles.
+	cfg.record.dir = ""
+	cfg.dataDir = ""
+	cfg.eventsSinkURL = ""
+	cfg.notify.webhookURL = ""
+	cfg.chaos = chaosConfig{}
+	cfg.audit = auditConfig{}
+	cfg.telemetry.otlpEndpoint = ""
+	if !cfg.record.replayInPlace {
+		scratch, err := os.MkdirTemp("", "thanos-rule-syncer-replay-")
+		if err != nil {
+			return fmt.Errorf("failed to create the scratch directory of the replay: %w", err)
+		}
+		defer os.RemoveAll(scratch)
+		cfg.output.target = targetFile
+		cfg.file = filepath.Join(scratch, filepath.Base(cfg.file))
+		if cfg.output.dir != "" {
+			cfg.output.dir = scratch
+		}
+		// The Ruler is faked, and neither its process nor the other syncers are told about the reloads.
+		cfg.thanosRuleURL = ""
+		cfg.sighupProcess = ""
+		cfg.reloadLock.lease = ""
+		cfg.alertRelabel = alertRelabelConfig{}
+		cfg.runbook.check = false
+	}
+	if cfg.thanosRuleURL == "" {
+		ruler := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		defer ruler.Close()
+		cfg.thanosRuleURL = ruler.URL
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	syn, err := newSyncer(ctx, cfg, newRoundTripperInstrumenter(nil), prometheus.NewRegistry())
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, name := range names {
+		rec, payload, err := readRecording(dir, name)
+		if err != nil {
+			return err
+		}
+		syn.fetcher = &replayFetcher{payload: payload, contentType: rec.ContentType}
+
+		if err := syn.sync(ctx); err != nil {
+			failed++
+			stage, code := classify(err)
+			fmt.Fprintf(stdout, "%s\tFAIL\t%s/%s\t%v\n", rec.Time.Format(time.RFC3339), stage, code, err)
+			continue
+		}
+		fmt.Fprintf(stdout, "%s\tOK\t%s\n", rec.Time.Format(time.RFC3339), syn.hash)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d recorded payloads failed", failed, len(names))
+	}
+
+	return nil
+}
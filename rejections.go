@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ruleRejection is the reason a group or one of its rules was refused by the validation.
+type ruleRejection struct {
+	Tenant string `json:"tenant,omitempty"`
+	Group  string `json:"group,omitempty"`
+	// Rule is the alert or record of the refused rule, empty if the group itself, or the whole payload, is refused.
+	Rule string `json:"rule,omitempty"`
+	// Index is that of the rule in its group, -1 if the group itself is refused.
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+func newRuleRejection(g ruleGroup, i int, reason string) ruleRejection {
+	r := g.Rules[i]
+	name := r.Alert
+	if name == "" {
+		name = r.Record
+	}
+
+	return ruleRejection{Group: g.Name, Rule: name, Index: i, Reason: reason}
+}
+
+func (r ruleRejection) String() string {
+	switch {
+	case r.Index >= 0 && r.Rule != "":
+		return fmt.Sprintf("group %q, rule %d (%s): %s", r.Group, r.Index, r.Rule, r.Reason)
+	case r.Index >= 0:
+		return fmt.Sprintf("group %q, rule %d: %s", r.Group, r.Index, r.Reason)
+	case r.Group != "":
+		return fmt.Sprintf("group %q: %s", r.Group, r.Reason)
+	}
+
+	return r.Reason
+}
+
+// rejectionTracker keeps the rejections of the last validated payload for GET /-/rejections and rule_syncer_rule_rejected_info,
+// so that tenants can see why their rules are not live.
+type rejectionTracker struct {
+	info *prometheus.GaugeVec
+
+	mu       sync.RWMutex
+	at       time.Time
+	rejected []ruleRejection
+}
+
+func newRejectionTracker(info *prometheus.GaugeVec) *rejectionTracker {
+	return &rejectionTracker{info: info, rejected: []ruleRejection{}}
+}
+
+// set replaces the rejections with those of the payload validated at the given time, none if it was valid.
+func (t *rejectionTracker) set(at time.Time, rejected []ruleRejection) {
+	if rejected == nil {
+		rejected = []ruleRejection{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.at, t.rejected = at, rejected
+	t.info.Reset()
+	for _, r := range rejected {
+		t.info.WithLabelValues(r.Tenant, r.Group, r.Rule).Set(1)
+	}
+}
+
+// add adds rejections to those of the payload last validated, e.g. as it is refused after the validation.
+func (t *rejectionTracker) add(rejected []ruleRejection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rejected = append(t.rejected, rejected...)
+	for _, r := range rejected {
+		t.info.WithLabelValues(r.Tenant, r.Group, r.Rule).Set(1)
+	}
+}
+
+type rejectionsResponse struct {
+	Time       *time.Time      `json:"time,omitempty"`
+	Rejections []ruleRejection `json:"rejections"`
+}
+
+// handler serves the rejections of the last validated payload as JSON, of a single tenant with ?tenant=.
+func (t *rejectionTracker) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+
+	t.mu.RLock()
+	res := rejectionsResponse{Rejections: make([]ruleRejection, 0, len(t.rejected))}
+	if !t.at.IsZero() {
+		at := t.at
+		res.Time = &at
+	}
+	for _, rej := range t.rejected {
+		if tenant == "" || rej.Tenant == tenant {
+			res.Rejections = append(res.Rejections, rej)
+		}
+	}
+	t.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(res)
+}
+
+// rejectedGroups returns the rejections of the invalid groups by their index, including those with invalid templates
+// with -validate.templates=reject, attributed to the tenant of the syncer or else to that of the rules.
+func (s *syncer) rejectedGroups(rgs *ruleGroups) map[int][]ruleRejection {
+	rejected := rgs.groupErrors()
+	if s.templatePolicy == templatesReject {
+		for i, g := range rgs.Groups {
+			if trejected := g.templateErrors(); len(trejected) > 0 {
+				rejected[i] = append(rejected[i], trejected...)
+			}
+		}
+	}
+
+	for i, rejections := range rejected {
+		g := rgs.Groups[i]
+		for j := range rejections {
+			rejections[j].Tenant = s.rejectionTenant(g, rejections[j].Index)
+		}
+	}
+
+	return rejected
+}
+
+// rejectionTenant returns the tenant of the rule, or of the first rule of the group carrying the tenant label for the group itself.
+func (s *syncer) rejectionTenant(g ruleGroup, index int) string {
+	if s.tenant != "" {
+		return s.tenant
+	}
+	if index >= 0 {
+		return g.Rules[index].Labels[s.output.tenantLabel]
+	}
+	for _, r := range g.Rules {
+		if t := r.Labels[s.output.tenantLabel]; t != "" {
+			return t
+		}
+	}
+
+	return ""
+}
+
+// flattenRejections lists the rejections in the order of the groups.
+func flattenRejections(rgs *ruleGroups, rejected map[int][]ruleRejection) []ruleRejection {
+	var all []ruleRejection
+	for i := range rgs.Groups {
+		all = append(all, rejected[i]...)
+	}
+
+	return all
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+type alertRelabelConfig struct {
+	url  string
+	file string
+}
+
+// alertRelabelSyncer syncs the alert relabel configuration of Thanos Ruler, its --alert.relabel-config-file, along with the rules,
+// as tenants managing their rules centrally usually manage it centrally too.
+type alertRelabelSyncer struct {
+	url    string
+	file   string
+	client *http.Client
+	// logPrefix names the pipeline in the log lines.
+	logPrefix string
+	// hash is the hash of the configuration on disk.
+	hash string
+}
+
+func newAlertRelabelSyncer(cfg alertRelabelConfig, client *http.Client) *alertRelabelSyncer {
+	a := &alertRelabelSyncer{url: cfg.url, file: cfg.file, client: client}
+	if b, err := os.ReadFile(cfg.file); err == nil {
+		a.hash = contentHash(b)
+	}
+
+	return a
+}
+
+// fetch gets the configuration and checks that it is a valid list of relabel configs.
+func (a *alertRelabelSyncer) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+	if err != nil {
+		return nil, &stageError{stage: stageFetch, err: fmt.Errorf("failed to create request: %w", err)}
+	}
+	req.Header.Set("Accept", "application/yaml")
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, &stageError{stage: stageFetch, err: fmt.Errorf("failed to get alert relabel config: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return nil, &stageError{stage: stageFetch, err: &unexpectedStatusError{from: "alert relabel config backend", code: res.StatusCode}}
+	}
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, &stageError{stage: stageFetch, err: fmt.Errorf("failed to read alert relabel config: %w", err)}
+	}
+
+	var cfgs []*relabel.Config
+	if err := yaml.UnmarshalStrict(content, &cfgs); err != nil {
+		return nil, &stageError{stage: stageValidate, code: codeInvalid, err: fmt.Errorf("invalid alert relabel config: %w", err)}
+	}
+	debugf("%sfetched %d alert relabel configs", a.logPrefix, len(cfgs))
+
+	return content, nil
+}
+
+// write writes the configuration unless it did not change.
+func (a *alertRelabelSyncer) write(ctx context.Context, content []byte) error {
+	hash := contentHash(content)
+	if hash == a.hash {
+		return nil
+	}
+	if err := writeFile(ctx, a.file, content); err != nil {
+		return err
+	}
+	a.hash = hash
+	infof("%swrote changed alert relabel config to %s", a.logPrefix, a.file)
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policies of -write.ruler-health-check.
+const (
+	healthCheckOff   = "off"
+	healthCheckWarn  = "warn"
+	healthCheckDefer = "defer"
+)
+
+// reloadQuorum is the number of Thanos Rulers that must reload for a sync cycle to succeed,
+// given either as a count or as a percentage of the Rulers, see -reload.min-success.
+type reloadQuorum struct {
+	count   int
+	percent int
+}
+
+// Set implements flag.Value.
+func (q *reloadQuorum) Set(s string) error {
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		percent, err := strconv.Atoi(p)
+		if err != nil || percent < 1 || percent > 100 {
+			return fmt.Errorf("invalid percentage %q, must be between 1%% and 100%%", s)
+		}
+		*q = reloadQuorum{percent: percent}
+		return nil
+	}
+
+	count, err := strconv.Atoi(s)
+	if err != nil || count < 1 {
+		return fmt.Errorf("invalid count %q, must be a positive integer or a percentage", s)
+	}
+	*q = reloadQuorum{count: count}
+
+	return nil
+}
+
+// required returns the number of successful reloads required out of n.
+func (q reloadQuorum) required(n int) int {
+	if q.percent == 0 {
+		return q.count
+	}
+
+	// Rounded up, so that 50% of 3 Rulers means 2.
+	return (n*q.percent + 99) / 100
+}
+
+func (q *reloadQuorum) String() string {
+	if q.percent == 0 {
+		return strconv.Itoa(q.count)
+	}
+
+	return strconv.Itoa(q.percent) + "%"
+}
+
+// splitURLs splits a comma-separated list of URLs.
+func splitURLs(s string) []string {
+	var urls []string
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+
+	return urls
+}
+
+// reloadTarget is a Thanos Ruler to reload.
+type reloadTarget struct {
+	// name identifies the Ruler in logs, metrics and the status, with secrets redacted.
+	name   string
+	url    string
+	client *http.Client
+}
+
+// reloadResult is the outcome of the reload of a Thanos Ruler.
+type reloadResult struct {
+	target string
+	err    error
+}
+
+// reloader reloads several Thanos Rulers at once and tells whether enough of them succeeded.
+type reloader struct {
+	targets []reloadTarget
+	quorum  reloadQuorum
+	// sighupProcess is the name of the process signaled if the lifecycle API of a Ruler is disabled, see -reload.sighup-process.
+	sighupProcess string
+	up            *prometheus.GaugeVec
+	// lock is held while reloading, if set, see -reload.lock-lease.
+	lock      *reloadLock
+	logPrefix string
+}
+
+// reload triggers the reload of all Rulers concurrently.
+// It returns the outcome of every reload and an error if fewer than the quorum succeeded.
+func (r *reloader) reload(ctx context.Context) ([]reloadResult, error) {
+	if len(r.targets) == 0 {
+		return nil, fmt.Errorf("no Thanos Ruler to reload, -thanos-rule-url is required")
+	}
+	if r.lock != nil {
+		if err := r.lock.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer r.lock.release()
+	}
+
+	results := r.each(ctx, r.reloadOne)
+	for _, res := range results {
+		if res.err == nil {
+			r.up.WithLabelValues(res.target).Set(1)
+		} else {
+			r.up.WithLabelValues(res.target).Set(0)
+		}
+	}
+
+	err := r.check(results, "reloaded")
+	if err == nil {
+		for _, res := range results {
+			if res.err != nil {
+				warnf("%sfailed to reload Thanos Ruler %s: %v", r.logPrefix, res.target, res.err)
+			}
+		}
+	}
+
+	return results, err
+}
+
+// reloadOne reloads a Ruler, falling back to SIGHUP if its lifecycle API is disabled.
+func (r *reloader) reloadOne(ctx context.Context, client *http.Client, url string) error {
+	err := reloadThanosRule(ctx, client, url)
+	var lde *lifecycleDisabledError
+	if r.sighupProcess == "" || !errors.As(err, &lde) {
+		return err
+	}
+
+	n, err := signalProcesses(r.sighupProcess, syscall.SIGHUP)
+	if err != nil {
+		return fmt.Errorf("%v, and failed to fall back to SIGHUP: %w", lde, err)
+	}
+	debugf("%ssent SIGHUP to %d %s processes, as their lifecycle API is disabled", r.logPrefix, n, r.sighupProcess)
+
+	return nil
+}
+
+// checkHealth checks whether enough Rulers are healthy according to the quorum.
+func (r *reloader) checkHealth(ctx context.Context) error {
+	return r.check(r.each(ctx, checkThanosRuleHealth), "healthy")
+}
+
+// each calls f for all Rulers concurrently.
+func (r *reloader) each(ctx context.Context, f func(context.Context, *http.Client, string) error) []reloadResult {
+	results := make([]reloadResult, len(r.targets))
+	var wg sync.WaitGroup
+	for i, t := range r.targets {
+		wg.Add(1)
+		go func(i int, t reloadTarget) {
+			defer wg.Done()
+			results[i] = reloadResult{target: t.name, err: f(ctx, t.client, t.url)}
+		}(i, t)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// check returns an error if fewer results than the quorum succeeded.
+func (r *reloader) check(results []reloadResult, outcome string) error {
+	var (
+		succeeded int
+		failed    []string
+		firstErr  error
+	)
+	for _, res := range results {
+		if res.err == nil {
+			succeeded++
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %v", res.target, res.err))
+		if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+
+	if len(results) == 1 {
+		return firstErr
+	}
+	if required := r.quorum.required(len(results)); succeeded < required {
+		return &quorumError{outcome: outcome, succeeded: succeeded, total: len(results), required: required, failed: failed, err: firstErr}
+	}
+
+	return nil
+}
+
+// checkThanosRuleHealth fails unless Thanos Ruler reports to be healthy.
+func checkThanosRuleHealth(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/-/healthy", nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return &unexpectedStatusError{from: "Thanos Ruler", code: res.StatusCode}
+	}
+
+	return nil
+}
+
+// lifecycleDisabledMessage is answered by Prometheus to a reload unless it runs with --web.enable-lifecycle.
+const lifecycleDisabledMessage = "Lifecycle API is not enabled"
+
+// lifecycleDisabledError is returned when the reload endpoint is disabled.
+type lifecycleDisabledError struct {
+	err *unexpectedStatusError
+}
+
+func (e *lifecycleDisabledError) Error() string {
+	return "the lifecycle API is disabled, start Prometheus with --web.enable-lifecycle or set -reload.sighup-process"
+}
+
+func (e *lifecycleDisabledError) Unwrap() error {
+	return e.err
+}
+
+// quorumError is returned when fewer Rulers than required reloaded or are healthy.
+type quorumError struct {
+	outcome                    string
+	succeeded, total, required int
+	failed                     []string
+	// err is the first failure, by which the error is classified.
+	err error
+}
+
+func (e *quorumError) Error() string {
+	return fmt.Sprintf("%d of %d Thanos Rulers %s, %d required: %s", e.succeeded, e.total, e.outcome, e.required, strings.Join(e.failed, "; "))
+}
+
+func (e *quorumError) Unwrap() error {
+	return e.err
+}
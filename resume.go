@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5" //nolint:gosec
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxPartialBytes is the most bytes of interrupted downloads kept for the next cycle, of all payloads.
+const maxPartialBytes = 64 << 20
+
+// fetchResumer resumes the downloads of rules payloads interrupted by flaky links with Range requests, instead of downloading
+// them again from the start, and verifies the checksums the backend gives for them. Downloads are only resumed if the backend
+// accepts ranges and identifies the payload with an ETag or a Last-Modified date, so that the parts are known to be of the same payload.
+// The beginnings of payloads whose connection broke are kept, up to maxPartialBytes in all, so that the next cycle resumes them.
+// It is safe for concurrent use.
+type fetchResumer struct {
+	attempts  int
+	logPrefix string
+
+	// resumed and mismatches are set once the metrics of the syncer exist.
+	resumed    prometheus.Counter
+	mismatches prometheus.Counter
+
+	mu sync.Mutex
+	// partials are the payloads whose download failed, by URL, taking up partialBytes.
+	partials     map[string]*partialDownload
+	partialBytes int
+}
+
+// partialDownload is the beginning of a payload, and what identifies it.
+type partialDownload struct {
+	validator string
+	header    http.Header
+	data      []byte
+}
+
+func newFetchResumer(attempts int, logPrefix string) *fetchResumer {
+	return &fetchResumer{attempts: attempts, logPrefix: logPrefix, partials: make(map[string]*partialDownload)}
+}
+
+// wrap returns a transport resuming the downloads of the given one.
+func (r *fetchResumer) wrap(next http.RoundTripper) http.RoundTripper {
+	return &resumingTransport{resumer: r, next: next}
+}
+
+type resumingTransport struct {
+	resumer *fetchResumer
+	next    http.RoundTripper
+}
+
+func (t *resumingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req) //nolint:wrapcheck
+	}
+	r := t.resumer
+	key := req.URL.String()
+
+	r.mu.Lock()
+	partial := r.partials[key]
+	if partial != nil {
+		delete(r.partials, key)
+		r.partialBytes -= len(partial.data)
+	}
+	r.mu.Unlock()
+
+	if partial != nil {
+		res, err := t.next.RoundTrip(rangeRequest(req, partial.validator, int64(len(partial.data))))
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		if res.StatusCode == http.StatusPartialContent && rangeStartsAt(res, int64(len(partial.data))) {
+			debugf("%sresuming the download of the rules of the previous cycle at %d bytes", r.logPrefix, len(partial.data))
+			r.resumed.Inc()
+			res.StatusCode, res.Status, res.ContentLength = http.StatusOK, "200 OK", -1
+			// The checksums and the type are those of the whole payload, not of the range.
+			res.Header = partial.header
+			body := newResumableBody(t, req, res, partial.validator)
+			body.offset, body.prefix = int64(len(partial.data)), partial.data
+			body.write(partial.data)
+			res.Body = body
+			return res, nil
+		}
+		// The payload changed since, or the range is not served: it is downloaded again.
+		if res.StatusCode == http.StatusPartialContent {
+			res.Body.Close()
+			return t.RoundTrip(req)
+		}
+		if resumable(res) {
+			res.Body = newResumableBody(t, req, res, validatorOf(res.Header))
+		}
+		return res, nil
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	if res.StatusCode == http.StatusOK && resumable(res) {
+		res.Body = newResumableBody(t, req, res, validatorOf(res.Header))
+	}
+
+	return res, nil
+}
+
+// resumable tells whether the download of the response can be resumed.
+// Responses decompressed by the transport are not, as their ranges and checksums are those of the compressed payload.
+func resumable(res *http.Response) bool {
+	return res.StatusCode == http.StatusOK && !res.Uncompressed && res.Header.Get("Accept-Ranges") == "bytes" && validatorOf(res.Header) != ""
+}
+
+// validatorOf returns what identifies the version of a payload for If-Range: its strong ETag, or else its Last-Modified date.
+func validatorOf(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return h.Get("Last-Modified")
+}
+
+// rangeRequest returns a copy of the request asking for the rest of the payload from the offset, unless it changed.
+func rangeRequest(req *http.Request, validator string, offset int64) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	r.Header.Set("If-Range", validator)
+
+	return r
+}
+
+// rangeStartsAt tells whether the partial response starts at the offset, as asked.
+func rangeStartsAt(res *http.Response, offset int64) bool {
+	return strings.HasPrefix(res.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-")
+}
+
+// resumableBody reads the payload, requesting the rest of it from where the connection broke, up to -fetch.resume-attempts times.
+type resumableBody struct {
+	transport *resumingTransport
+	req       *http.Request
+	validator string
+	header    http.Header
+	body      io.ReadCloser
+
+	// prefix are the bytes received by a previous cycle not read yet.
+	prefix   []byte
+	offset   int64
+	resumes  int
+	received bytes.Buffer
+	// truncated is set once the payload is too large to be kept in received.
+	truncated bool
+	digest    *payloadDigest
+	done      bool
+	// failed is set once a read failed, unlike a body closed before its end by the reader.
+	failed bool
+}
+
+func newResumableBody(t *resumingTransport, req *http.Request, res *http.Response, validator string) *resumableBody {
+	return &resumableBody{
+		transport: t,
+		req:       req,
+		validator: validator,
+		header:    res.Header,
+		body:      res.Body,
+		digest:    newPayloadDigest(res.Header),
+	}
+}
+
+// write records bytes of the payload, to keep them if the download fails in the end and to verify its checksum.
+func (b *resumableBody) write(p []byte) {
+	if !b.truncated && b.received.Len()+len(p) <= maxPartialBytes {
+		b.received.Write(p)
+	} else {
+		b.truncated = true
+		b.received = bytes.Buffer{}
+	}
+	if b.digest != nil {
+		b.digest.hash.Write(p)
+	}
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	// The bytes received by a previous cycle are read first.
+	if len(b.prefix) > 0 {
+		n := copy(p, b.prefix)
+		b.prefix = b.prefix[n:]
+		return n, nil
+	}
+
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		b.write(p[:n])
+		switch {
+		case err == nil:
+			return n, nil
+		case errors.Is(err, io.EOF):
+			b.done = true
+			if b.digest != nil && !b.digest.matches() {
+				b.transport.resumer.mismatches.Inc()
+				return n, fmt.Errorf("the checksum of the rules does not match the %s %s of the backend", b.digest.name, b.digest.want)
+			}
+			return n, io.EOF
+		}
+		if n > 0 {
+			// The error is returned by the next read, resuming the download then.
+			b.body = &failedBody{ReadCloser: b.body, err: err}
+			return n, nil
+		}
+		if rerr := b.resume(err); rerr != nil {
+			b.failed = true
+			return 0, rerr
+		}
+	}
+}
+
+// resume requests the rest of the payload after the read failed, unless the attempts are used up.
+func (b *resumableBody) resume(cause error) error {
+	r := b.transport.resumer
+	if b.resumes >= r.attempts || b.req.Context().Err() != nil {
+		return cause
+	}
+	b.resumes++
+	b.body.Close()
+
+	res, err := b.transport.next.RoundTrip(rangeRequest(b.req, b.validator, b.offset))
+	if err != nil {
+		return fmt.Errorf("failed to resume the download of the rules after %d bytes: %w, after %v", b.offset, err, cause)
+	}
+	if res.StatusCode != http.StatusPartialContent || !rangeStartsAt(res, b.offset) {
+		res.Body.Close()
+		return fmt.Errorf("failed to resume the download of the rules after %d bytes, as the backend answered the range with status code %d: %w", b.offset, res.StatusCode, cause)
+	}
+	debugf("%sresuming the download of the rules at %d bytes after: %v", r.logPrefix, b.offset, cause)
+	r.resumed.Inc()
+	b.body = res.Body
+
+	return nil
+}
+
+// Close keeps the bytes received of a download whose connection broke, for the next cycle to resume it, unless they take up
+// too much memory. Downloads the reader stopped, e.g. as the payload is refused, are not kept.
+func (b *resumableBody) Close() error {
+	err := b.body.Close()
+	if b.failed && !b.truncated && b.received.Len() > 0 {
+		r := b.transport.resumer
+		r.mu.Lock()
+		if r.partialBytes+b.received.Len() <= maxPartialBytes {
+			r.partials[b.req.URL.String()] = &partialDownload{validator: b.validator, header: b.header, data: b.received.Bytes()}
+			r.partialBytes += b.received.Len()
+		}
+		r.mu.Unlock()
+	}
+
+	return err //nolint:wrapcheck
+}
+
+// failedBody returns the error of a read that returned bytes as well, with the next read.
+type failedBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *failedBody) Read([]byte) (int, error) {
+	return 0, b.err
+}
+
+// payloadDigest verifies a payload against the checksum of the backend: the sha-256 of Repr-Digest or Digest,
+// the x-amz-checksum-sha256 of S3, the md5 of x-goog-hash of GCS, or else Content-MD5, e.g. of Azure Blob Storage.
+// Only checksums of the whole payload are verified, not the composite checksums of the parts of multipart uploads to S3.
+type payloadDigest struct {
+	name string
+	want string
+	hash hash.Hash
+}
+
+func newPayloadDigest(h http.Header) *payloadDigest {
+	composite := strings.EqualFold(h.Get("X-Amz-Checksum-Type"), "COMPOSITE")
+	for _, d := range []struct {
+		header, prefix, name string
+		hash                 func() hash.Hash
+	}{
+		{header: "Repr-Digest", prefix: "sha-256=", name: "Repr-Digest sha-256", hash: sha256.New},
+		{header: "Digest", prefix: "sha-256=", name: "Digest sha-256", hash: sha256.New},
+		{header: "X-Amz-Checksum-Sha256", name: "x-amz-checksum-sha256", hash: sha256.New},
+		{header: "X-Goog-Hash", prefix: "md5=", name: "x-goog-hash md5", hash: md5.New},
+		{header: "Content-Md5", name: "Content-MD5", hash: md5.New},
+	} {
+		for _, v := range h.Values(d.header) {
+			for _, part := range strings.Split(v, ",") {
+				part = strings.TrimSpace(part)
+				if !strings.HasPrefix(strings.ToLower(part), d.prefix) {
+					continue
+				}
+				// Repr-Digest encloses the value in colons.
+				want := strings.Trim(part[len(d.prefix):], ":")
+				// Composite checksums are the checksum of the checksums of the parts followed by -<parts>, which base64 lacks.
+				if d.header == "X-Amz-Checksum-Sha256" && (composite || strings.Contains(want, "-")) {
+					continue
+				}
+				if want != "" {
+					return &payloadDigest{name: d.name, want: want, hash: d.hash()}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *payloadDigest) matches() bool {
+	return base64.StdEncoding.EncodeToString(d.hash.Sum(nil)) == d.want
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Modes of -routing.mode.
+const (
+	routingDefault = "default"
+	routingForce   = "force"
+)
+
+// Policies of -routing.unmatched.
+const (
+	routingKeep   = "keep"
+	routingReject = "reject"
+)
+
+type routingConfig struct {
+	mapFile   string
+	mode      string
+	unmatched string
+}
+
+// routingRule gives the routing labels of the alerts of the groups whose name matches the regular expression.
+type routingRule struct {
+	Match  string            `yaml:"match"`
+	Labels map[string]string `yaml:"labels"`
+
+	re *regexp.Regexp
+}
+
+// routingLabeler sets the routing labels of alerts, e.g. team, service and escalation, from the name of their group,
+// so that the routing in Alertmanager is enforced centrally rather than left to every tenant. Recording rules are left untouched,
+// as their labels are part of the recorded series.
+type routingLabeler struct {
+	rules []routingRule
+	// force overrides the routing labels the alerts already have.
+	force bool
+	// reject refuses the rules of alerts of groups no pattern matches, which would not be routed.
+	reject bool
+}
+
+// newRoutingLabeler reads the mapping file, a list of regular expressions matching the whole group name and the labels of
+// the alerts of the groups they match, the first match winning, e.g. an entry with match: payments-.* and
+// labels: {team: payments, escalation: payments-oncall}, followed by one with match: .* and labels: {team: platform}.
+func newRoutingLabeler(cfg routingConfig) (*routingLabeler, error) {
+	b, err := os.ReadFile(cfg.mapFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -routing.map-file: %w", err)
+	}
+	var rules []routingRule
+	if err := yaml.UnmarshalStrict(b, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse -routing.map-file: %w", err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no routing rules in -routing.map-file %s", cfg.mapFile)
+	}
+
+	for i := range rules {
+		r := &rules[i]
+		if r.re, err = regexp.Compile("^(?:" + r.Match + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid -routing.map-file, rule %d: invalid match %q: %w", i, r.Match, err)
+		}
+		if len(r.Labels) == 0 {
+			return nil, fmt.Errorf("invalid -routing.map-file, rule %d matching %q has no labels", i, r.Match)
+		}
+		for name := range r.Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("invalid -routing.map-file, rule %d: invalid label name %q", i, name)
+			}
+		}
+	}
+
+	return &routingLabeler{rules: rules, force: cfg.mode == routingForce, reject: cfg.unmatched == routingReject}, nil
+}
+
+func (l *routingLabeler) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	var unmatched []string
+	for gi := range rgs.Groups {
+		g := &rgs.Groups[gi]
+		labels := l.labels(g.Name)
+		for ri := range g.Rules {
+			r := &g.Rules[ri]
+			if r.Alert == "" {
+				continue
+			}
+			if labels == nil {
+				if l.reject {
+					unmatched = append(unmatched, fmt.Sprintf("alert %s in group %q", r.Alert, g.Name))
+				}
+				continue
+			}
+
+			var set map[string]string
+			for name, value := range labels {
+				current, ok := r.Labels[name]
+				if current == value || ok && !l.force {
+					continue
+				}
+				if set == nil {
+					// The labels may be shared with a copy of the rule.
+					set = copyLabels(r.Labels)
+				}
+				set[name] = value
+			}
+			if set != nil {
+				r.Labels = set
+				changed = true
+			}
+		}
+	}
+
+	if len(unmatched) > 0 {
+		return false, fmt.Errorf("alerts of groups without routing labels in -routing.map-file: %s", strings.Join(unmatched, "; "))
+	}
+
+	return changed, nil
+}
+
+// labels returns the routing labels of the group, nil if no rule matches it.
+func (l *routingLabeler) labels(group string) map[string]string {
+	for _, r := range l.rules {
+		if r.re.MatchString(group) {
+			return r.Labels
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// rulerGlob validates the rules files Thanos Ruler loads with its glob, including the files of others,
+// so that conflicts the synced rules would create with them are noticed before Thanos Ruler runs both.
+// It only warns, as the files of others are not for the syncer to fix. Its state is only accessed by the goroutine running the sync cycles.
+type rulerGlob struct {
+	pattern   string
+	logPrefix string
+
+	// conflicts are the last conflicts logged, so that they are logged once rather than every cycle.
+	conflicts string
+}
+
+// check returns the conflicts of the files about to be written with the other files matching the glob:
+// other files Thanos Ruler fails to load and rules producing the same series or alerts. Groups are identified by their file
+// and name, like Thanos Ruler does, so groups of the same name in different files do not conflict.
+func (g *rulerGlob) check(o *output, files []ruleFile) ([]string, error) {
+	paths, err := filepath.Glob(g.pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the rules files matching %s: %w", g.pattern, err)
+	}
+	sort.Strings(paths)
+
+	ours := make(map[string]*ruleFile, len(files))
+	for i := range files {
+		ours[absPath(files[i].path)] = &files[i]
+	}
+
+	rules := make(map[string]string)
+	for _, f := range files {
+		if f.groups == nil {
+			continue
+		}
+		for _, rg := range f.groups.Groups {
+			for _, r := range rg.Rules {
+				rules[ruleIdentity(r)] = f.path
+			}
+		}
+	}
+
+	var conflicts []string
+	for _, p := range paths {
+		if _, ok := ours[absPath(p)]; ok || o.owns(p) {
+			continue
+		}
+		content, err := readRulesFile(p)
+		if err != nil {
+			conflicts = append(conflicts, err.Error())
+			continue
+		}
+		rgs, _, err := parseRuleGroups(content)
+		if err == nil {
+			err = rgs.validate()
+		}
+		if err != nil {
+			// Thanos Ruler refuses to reload any of the rules while one of its files is invalid.
+			conflicts = append(conflicts, fmt.Sprintf("%s is invalid, which fails the reloads of Thanos Ruler: %v", p, err))
+			continue
+		}
+		for _, rg := range rgs.Groups {
+			for _, r := range rg.Rules {
+				if path, ok := rules[ruleIdentity(r)]; ok {
+					conflicts = append(conflicts, fmt.Sprintf("%s of group %q in %s is also in %s", ruleKind(r), rg.Name, p, path))
+				}
+			}
+		}
+	}
+
+	return conflicts, nil
+}
+
+// report logs the conflicts when they change.
+func (g *rulerGlob) report(conflicts []string) {
+	joined := strings.Join(conflicts, "; ")
+	if joined == g.conflicts {
+		return
+	}
+	g.conflicts = joined
+	if len(conflicts) == 0 {
+		infof("%sthe rules files matching %s no longer conflict", g.logPrefix, g.pattern)
+		return
+	}
+	for _, c := range conflicts {
+		warnf("%sconflict with the rules files matching %s: %s", g.logPrefix, g.pattern, c)
+	}
+}
+
+// ruleIdentity identifies the series of a recording rule or the alerts of an alerting rule by its name and static labels.
+func ruleIdentity(r rule) string {
+	keys := make([]string, 0, len(r.Labels))
+	for k := range r.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(ruleKind(r))
+	for _, k := range keys {
+		b.WriteString("," + k + "=" + r.Labels[k])
+	}
+
+	return b.String()
+}
+
+func ruleKind(r rule) string {
+	if r.Record != "" {
+		return "recording rule " + r.Record
+	}
+
+	return "alert " + r.Alert
+}
+
+// owns tells whether the path is written by the output, besides the files about to be written:
+// the files of gone tenants in the per-tenant layout, which are removed, temporary files and content-addressed versions.
+func (o *output) owns(path string) bool {
+	path = absPath(path)
+	base := filepath.Base(path)
+	if strings.HasPrefix(base, ".") && strings.HasSuffix(base, tempFileSuffix) {
+		return true
+	}
+	if o.contentAddressed && strings.HasPrefix(path, absPath(o.versionsDir())+string(filepath.Separator)) {
+		return true
+	}
+	if o.layout == layoutPerTenant {
+		return filepath.Dir(path) == absPath(o.dir) && filepath.Ext(path) == ruleFileExt
+	}
+
+	return path == absPath(o.file)
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+
+	return filepath.Clean(path)
+}
+
+// checkRulerGlob checks the rules files about to be written against those matching the glob of Thanos Ruler.
+// Failures do not fail the cycle.
+func (s *syncer) checkRulerGlob(files []ruleFile) {
+	conflicts, err := s.rulerGlob.check(s.output, files)
+	if err != nil {
+		warnf("%s%v", s.logPrefix(), err)
+		return
+	}
+	s.rulerGlob.report(conflicts)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// ruleGroups is the content of a Prometheus rule file as read by Thanos Ruler.
+type ruleGroups struct {
+	Groups []ruleGroup `yaml:"groups" json:"groups"`
+}
+
+type ruleGroup struct {
+	Name     string `yaml:"name" json:"name"`
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Rules    []rule `yaml:"rules" json:"rules"`
+	// Extra holds the fields we do not interpret, e.g. partial_response_strategy or limit.
+	Extra map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+type rule struct {
+	Record      string                 `yaml:"record,omitempty" json:"record,omitempty"`
+	Alert       string                 `yaml:"alert,omitempty" json:"alert,omitempty"`
+	Expr        string                 `yaml:"expr" json:"expr"`
+	For         string                 `yaml:"for,omitempty" json:"for,omitempty"`
+	Labels      map[string]string      `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Annotations map[string]string      `yaml:"annotations,omitempty" json:"annotations,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (g *ruleGroup) UnmarshalJSON(b []byte) error {
+	type plain ruleGroup
+	if err := json.Unmarshal(b, (*plain)(g)); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	extra, err := unknownJSONFields(b, "name", "interval", "rules")
+	g.Extra = extra
+
+	return err
+}
+
+func (r *rule) UnmarshalJSON(b []byte) error {
+	type plain rule
+	if err := json.Unmarshal(b, (*plain)(r)); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	extra, err := unknownJSONFields(b, "record", "alert", "expr", "for", "labels", "annotations")
+	r.Extra = extra
+
+	return err
+}
+
+// unknownJSONFields returns the fields of a JSON object that are not among the known ones.
+func unknownJSONFields(b []byte, known ...string) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	for _, k := range known {
+		delete(fields, k)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	return fields, nil
+}
+
+// parseRuleGroups parses a rule file.
+// Multiple YAML documents, separated by ---, are merged into a single set of rule groups.
+// It also returns the number of non-empty documents.
+func parseRuleGroups(content []byte) (*ruleGroups, int, error) {
+	rgs := &ruleGroups{}
+	docs := 0
+
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		doc := &ruleGroups{}
+		err := dec.Decode(doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to parse rules in document %d: %w", docs+1, err)
+		}
+		if len(doc.Groups) == 0 {
+			continue
+		}
+		docs++
+		rgs.Groups = append(rgs.Groups, doc.Groups...)
+	}
+
+	return rgs, docs, nil
+}
+
+// isJSON tells whether a Content-Type denotes a JSON payload.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// decodeRuleGroups parses a rules payload according to its Content-Type.
+// JSON payloads and YAML payloads made of several documents are converted to a single YAML document,
+// which is returned as the content to write to disk. It is nil if the payload can be written as is.
+func decodeRuleGroups(payload []byte, contentType string) (*ruleGroups, []byte, error) {
+	var rgs *ruleGroups
+
+	if isJSON(contentType) {
+		rgs = &ruleGroups{}
+		if err := json.Unmarshal(payload, rgs); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse JSON rules: %w", err)
+		}
+	} else {
+		var (
+			docs int
+			err  error
+		)
+		rgs, docs, err = parseRuleGroups(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		if docs <= 1 {
+			return rgs, nil, nil
+		}
+	}
+
+	content, err := yaml.Marshal(rgs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert rules to a single YAML document: %w", err)
+	}
+
+	return rgs, content, nil
+}
+
+// Policies of -validate.policy.
+const (
+	// validateAllOrNothing refuses all rules if any group is invalid.
+	validateAllOrNothing = "all-or-nothing"
+	// validateDropInvalid drops the invalid groups and applies the others.
+	validateDropInvalid = "drop-invalid"
+)
+
+// validate checks the rule groups for the mistakes Thanos Ruler would refuse to load.
+func (rgs *ruleGroups) validate() error {
+	rejected := rgs.groupErrors()
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid rules: %s", joinRejections(rgs, rejected))
+}
+
+// groupErrors returns the rejections of the invalid groups by their index. Groups named like one before them are invalid.
+func (rgs *ruleGroups) groupErrors() map[int][]ruleRejection {
+	rejected := make(map[int][]ruleRejection)
+
+	names := make(map[string]struct{}, len(rgs.Groups))
+	for gi, g := range rgs.Groups {
+		reject := func(reason string) {
+			rejected[gi] = append(rejected[gi], ruleRejection{Group: g.Name, Index: -1, Reason: reason})
+		}
+		if g.Name == "" {
+			reject("group name must not be empty")
+		}
+		if _, ok := names[g.Name]; ok {
+			reject("duplicate group name")
+		}
+		names[g.Name] = struct{}{}
+
+		if g.Interval != "" {
+			if _, err := model.ParseDuration(g.Interval); err != nil {
+				reject(fmt.Sprintf("invalid interval: %v", err))
+			}
+		}
+
+		for i, r := range g.Rules {
+			for _, err := range r.validate() {
+				rejected[gi] = append(rejected[gi], newRuleRejection(g, i, err))
+			}
+		}
+	}
+
+	return rejected
+}
+
+// joinRejections joins the rejections in the order of the groups.
+func joinRejections(rgs *ruleGroups, rejected map[int][]ruleRejection) string {
+	all := flattenRejections(rgs, rejected)
+	reasons := make([]string, 0, len(all))
+	for _, r := range all {
+		reasons = append(reasons, r.String())
+	}
+
+	return strings.Join(reasons, "; ")
+}
+
+func (r rule) validate() []string {
+	var errs []string
+
+	switch {
+	case r.Record != "" && r.Alert != "":
+		errs = append(errs, "only one of 'record' and 'alert' must be set")
+	case r.Record == "" && r.Alert == "":
+		errs = append(errs, "one of 'record' or 'alert' must be set")
+	}
+	if r.Expr == "" {
+		errs = append(errs, "field 'expr' must be set")
+	}
+	if r.Record != "" {
+		if len(r.Annotations) > 0 {
+			errs = append(errs, "invalid field 'annotations' in recording rule")
+		}
+		if r.For != "" {
+			errs = append(errs, "invalid field 'for' in recording rule")
+		}
+	}
+	if r.For != "" {
+		if _, err := model.ParseDuration(r.For); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid 'for' duration: %v", err))
+		}
+	}
+
+	return errs
+}
+
+// countRules returns the number of alerting and recording rules.
+func (rgs *ruleGroups) countRules() (alerting, recording int) {
+	for _, g := range rgs.Groups {
+		for _, r := range g.Rules {
+			if r.Alert != "" {
+				alerting++
+			} else {
+				recording++
+			}
+		}
+	}
+
+	return alerting, recording
+}
+
+// contentHash returns the hex encoded SHA-256 of a rules payload.
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// groupHashes returns the hash of every group by group name.
+func (rgs *ruleGroups) groupHashes() map[string]string {
+	hashes := make(map[string]string, len(rgs.Groups))
+	for _, g := range rgs.Groups {
+		b, err := yaml.Marshal(g)
+		if err != nil {
+			// Groups that were just unmarshaled always marshal again.
+			continue
+		}
+		hashes[g.Name] = contentHash(b)
+	}
+
+	return hashes
+}
+
+// groupDelta lists the names of the groups that differ between two versions of the rules.
+type groupDelta struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// diffGroups compares two sets of group hashes as returned by groupHashes.
+func diffGroups(old, new map[string]string) groupDelta {
+	d := groupDelta{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for name, h := range new {
+		oh, ok := old[name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, name)
+		case oh != h:
+			d.Changed = append(d.Changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+
+	return d
+}
@@ -0,0 +1,248 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        v3.20.3
+// source: rulespb/rules.proto
+
+package rulespb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type WatchRulesRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Tenants []string `protobuf:"bytes,1,rep,name=tenants,proto3" json:"tenants,omitempty"`
+	Version string   `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+}
+
+func (x *WatchRulesRequest) Reset() {
+	*x = WatchRulesRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rulespb_rules_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WatchRulesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRulesRequest) ProtoMessage() {}
+
+func (x *WatchRulesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_rulespb_rules_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRulesRequest.ProtoReflect.Descriptor instead.
+func (*WatchRulesRequest) Descriptor() ([]byte, []int) {
+	return file_rulespb_rules_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *WatchRulesRequest) GetTenants() []string {
+	if x != nil {
+		return x.Tenants
+	}
+	return nil
+}
+
+func (x *WatchRulesRequest) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+type WatchRulesResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version     string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	ContentType string `protobuf:"bytes,2,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	Rules       []byte `protobuf:"bytes,3,opt,name=rules,proto3" json:"rules,omitempty"`
+}
+
+func (x *WatchRulesResponse) Reset() {
+	*x = WatchRulesResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rulespb_rules_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WatchRulesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRulesResponse) ProtoMessage() {}
+
+func (x *WatchRulesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_rulespb_rules_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRulesResponse.ProtoReflect.Descriptor instead.
+func (*WatchRulesResponse) Descriptor() ([]byte, []int) {
+	return file_rulespb_rules_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *WatchRulesResponse) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *WatchRulesResponse) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+func (x *WatchRulesResponse) GetRules() []byte {
+	if x != nil {
+		return x.Rules
+	}
+	return nil
+}
+
+var File_rulespb_rules_proto protoreflect.FileDescriptor
+
+var file_rulespb_rules_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x72, 0x75, 0x6c, 0x65, 0x73, 0x70, 0x62, 0x2f, 0x72, 0x75, 0x6c, 0x65, 0x73, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x19, 0x74, 0x68, 0x61, 0x6e, 0x6f, 0x73, 0x72, 0x75, 0x6c,
+	0x65, 0x73, 0x79, 0x6e, 0x63, 0x65, 0x72, 0x2e, 0x72, 0x75, 0x6c, 0x65, 0x73, 0x2e, 0x76, 0x31,
+	0x22, 0x47, 0x0a, 0x11, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52, 0x75, 0x6c, 0x65, 0x73, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x74, 0x73,
+	0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x07, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x74, 0x73, 0x12,
+	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x67, 0x0a, 0x12, 0x57, 0x61, 0x74,
+	0x63, 0x68, 0x52, 0x75, 0x6c, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
+	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x6e,
+	0x74, 0x65, 0x6e, 0x74, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0b, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x14, 0x0a, 0x05,
+	0x72, 0x75, 0x6c, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x05, 0x72, 0x75, 0x6c,
+	0x65, 0x73, 0x32, 0x74, 0x0a, 0x05, 0x52, 0x75, 0x6c, 0x65, 0x73, 0x12, 0x6b, 0x0a, 0x0a, 0x57,
+	0x61, 0x74, 0x63, 0x68, 0x52, 0x75, 0x6c, 0x65, 0x73, 0x12, 0x2c, 0x2e, 0x74, 0x68, 0x61, 0x6e,
+	0x6f, 0x73, 0x72, 0x75, 0x6c, 0x65, 0x73, 0x79, 0x6e, 0x63, 0x65, 0x72, 0x2e, 0x72, 0x75, 0x6c,
+	0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52, 0x75, 0x6c, 0x65, 0x73,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x2d, 0x2e, 0x74, 0x68, 0x61, 0x6e, 0x6f, 0x73,
+	0x72, 0x75, 0x6c, 0x65, 0x73, 0x79, 0x6e, 0x63, 0x65, 0x72, 0x2e, 0x72, 0x75, 0x6c, 0x65, 0x73,
+	0x2e, 0x76, 0x31, 0x2e, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52, 0x75, 0x6c, 0x65, 0x73, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x30, 0x01, 0x42, 0x35, 0x5a, 0x33, 0x67, 0x69, 0x74, 0x68,
+	0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6f, 0x62, 0x73, 0x65, 0x72, 0x76, 0x61, 0x74, 0x6f,
+	0x72, 0x69, 0x75, 0x6d, 0x2f, 0x74, 0x68, 0x61, 0x6e, 0x6f, 0x73, 0x2d, 0x72, 0x75, 0x6c, 0x65,
+	0x2d, 0x73, 0x79, 0x6e, 0x63, 0x65, 0x72, 0x2f, 0x72, 0x75, 0x6c, 0x65, 0x73, 0x70, 0x62, 0x62,
+	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_rulespb_rules_proto_rawDescOnce sync.Once
+	file_rulespb_rules_proto_rawDescData = file_rulespb_rules_proto_rawDesc
+)
+
+func file_rulespb_rules_proto_rawDescGZIP() []byte {
+	file_rulespb_rules_proto_rawDescOnce.Do(func() {
+		file_rulespb_rules_proto_rawDescData = protoimpl.X.CompressGZIP(file_rulespb_rules_proto_rawDescData)
+	})
+	return file_rulespb_rules_proto_rawDescData
+}
+
+var file_rulespb_rules_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_rulespb_rules_proto_goTypes = []interface{}{
+	(*WatchRulesRequest)(nil),  // 0: thanosrulesyncer.rules.v1.WatchRulesRequest
+	(*WatchRulesResponse)(nil), // 1: thanosrulesyncer.rules.v1.WatchRulesResponse
+}
+var file_rulespb_rules_proto_depIdxs = []int32{
+	0, // 0: thanosrulesyncer.rules.v1.Rules.WatchRules:input_type -> thanosrulesyncer.rules.v1.WatchRulesRequest
+	1, // 1: thanosrulesyncer.rules.v1.Rules.WatchRules:output_type -> thanosrulesyncer.rules.v1.WatchRulesResponse
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_rulespb_rules_proto_init() }
+func file_rulespb_rules_proto_init() {
+	if File_rulespb_rules_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_rulespb_rules_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchRulesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_rulespb_rules_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchRulesResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_rulespb_rules_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_rulespb_rules_proto_goTypes,
+		DependencyIndexes: file_rulespb_rules_proto_depIdxs,
+		MessageInfos:      file_rulespb_rules_proto_msgTypes,
+	}.Build()
+	File_rulespb_rules_proto = out.File
+	file_rulespb_rules_proto_rawDesc = nil
+	file_rulespb_rules_proto_goTypes = nil
+	file_rulespb_rules_proto_depIdxs = nil
+}
@@ -0,0 +1,132 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.20.3
+// source: rulespb/rules.proto
+
+package rulespb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// RulesClient is the client API for Rules service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RulesClient interface {
+	WatchRules(ctx context.Context, in *WatchRulesRequest, opts ...grpc.CallOption) (Rules_WatchRulesClient, error)
+}
+
+type rulesClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRulesClient(cc grpc.ClientConnInterface) RulesClient {
+	return &rulesClient{cc}
+}
+
+func (c *rulesClient) WatchRules(ctx context.Context, in *WatchRulesRequest, opts ...grpc.CallOption) (Rules_WatchRulesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Rules_ServiceDesc.Streams[0], "/thanosrulesyncer.rules.v1.Rules/WatchRules", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &rulesWatchRulesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Rules_WatchRulesClient interface {
+	Recv() (*WatchRulesResponse, error)
+	grpc.ClientStream
+}
+
+type rulesWatchRulesClient struct {
+	grpc.ClientStream
+}
+
+func (x *rulesWatchRulesClient) Recv() (*WatchRulesResponse, error) {
+	m := new(WatchRulesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RulesServer is the server API for Rules service.
+// All implementations must embed UnimplementedRulesServer
+// for forward compatibility
+type RulesServer interface {
+	WatchRules(*WatchRulesRequest, Rules_WatchRulesServer) error
+	mustEmbedUnimplementedRulesServer()
+}
+
+// UnimplementedRulesServer must be embedded to have forward compatible implementations.
+type UnimplementedRulesServer struct {
+}
+
+func (UnimplementedRulesServer) WatchRules(*WatchRulesRequest, Rules_WatchRulesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRules not implemented")
+}
+func (UnimplementedRulesServer) mustEmbedUnimplementedRulesServer() {}
+
+// UnsafeRulesServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RulesServer will
+// result in compilation errors.
+type UnsafeRulesServer interface {
+	mustEmbedUnimplementedRulesServer()
+}
+
+func RegisterRulesServer(s grpc.ServiceRegistrar, srv RulesServer) {
+	s.RegisterService(&Rules_ServiceDesc, srv)
+}
+
+func _Rules_WatchRules_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRulesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RulesServer).WatchRules(m, &rulesWatchRulesServer{stream})
+}
+
+type Rules_WatchRulesServer interface {
+	Send(*WatchRulesResponse) error
+	grpc.ServerStream
+}
+
+type rulesWatchRulesServer struct {
+	grpc.ServerStream
+}
+
+func (x *rulesWatchRulesServer) Send(m *WatchRulesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Rules_ServiceDesc is the grpc.ServiceDesc for Rules service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Rules_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "thanosrulesyncer.rules.v1.Rules",
+	HandlerType: (*RulesServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRules",
+			Handler:       _Rules_WatchRules_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rulespb/rules.proto",
+}
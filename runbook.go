@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// runbookWarning is the kind of the status warnings about broken runbook links.
+	runbookWarning = "runbook"
+	// runbookCheckTimeout bounds a check of a runbook link.
+	runbookCheckTimeout = 10 * time.Second
+)
+
+type runbookConfig struct {
+	check      bool
+	annotation string
+	cacheTTL   time.Duration
+	rate       float64
+	// allowedHosts are the host names whose links are checked, *. matching the subdomains of a domain.
+	allowedHosts listValue
+}
+
+// runbookLink is the runbook annotation of a synced alert.
+type runbookLink struct {
+	tenant, group, alert, url string
+}
+
+// runbookResult is the outcome of the check of a link, err being empty if it is not broken.
+type runbookResult struct {
+	at  time.Time
+	err string
+}
+
+// runbookChecker checks the runbook links of the synced alerts in the background, so that broken links are found when the rules
+// are distributed rather than when the alert fires. Links are checked with HEAD, at most -runbook.check-rate times per second,
+// and their results cached for -runbook.cache-ttl, so that neither the sync nor the hosts of the runbooks are slowed down.
+// Broken links are reported in the status and by rule_syncer_broken_runbook_links, and never fail the sync.
+// As the tenants choose the links, only those to -runbook.allowed-hosts are checked, redirects included, so that the syncer
+// does not probe the internal addresses it reaches.
+type runbookChecker struct {
+	cfg runbookConfig
+	// client must not authenticate nor present a client certificate, as the runbooks are not served by the backend.
+	client    *http.Client
+	status    *statusTracker
+	broken    *prometheus.GaugeVec
+	logPrefix string
+
+	// links receives the links of the last synced rules, the check in progress picking up the latest ones once it is done.
+	links chan []runbookLink
+	// cache and lastBroken, the number of broken links last logged, are only used by run.
+	cache      map[string]runbookResult
+	lastBroken int
+}
+
+func newRunbookChecker(cfg runbookConfig, client *http.Client, status *statusTracker, logPrefix string) *runbookChecker {
+	c := &runbookChecker{
+		cfg:       cfg,
+		status:    status,
+		logPrefix: logPrefix,
+		links:     make(chan []runbookLink, 1),
+		cache:     make(map[string]runbookResult),
+	}
+	c.client = &http.Client{Transport: client.Transport, Timeout: client.Timeout, CheckRedirect: c.checkRedirect}
+
+	return c
+}
+
+// allowed tells whether the links to the host are checked.
+func (c *runbookChecker) allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range c.cfg.allowedHosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *runbookChecker) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !c.allowed(req.URL.Hostname()) {
+		return errors.New("redirected to a host not in -runbook.allowed-hosts")
+	}
+
+	return nil
+}
+
+// submit hands the links of the synced rules to the checker, replacing those not picked up yet. It does not block.
+// It is only called by the sync cycles, which never run concurrently.
+func (c *runbookChecker) submit(links []runbookLink) {
+	select {
+	case <-c.links:
+	default:
+	}
+	c.links <- links
+}
+
+// run checks the submitted links until the context is done.
+func (c *runbookChecker) run(ctx context.Context) {
+	pace := time.NewTicker(time.Duration(float64(time.Second) / c.cfg.rate))
+	defer pace.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case links := <-c.links:
+			if !c.checkAll(ctx, links, pace.C) {
+				return
+			}
+		}
+	}
+}
+
+// checkAll checks the links whose results are not cached, paced by the ticks, and reports the broken ones.
+// It returns false if the context is done.
+func (c *runbookChecker) checkAll(ctx context.Context, links []runbookLink, pace <-chan time.Time) bool {
+	now := time.Now()
+	inUse := make(map[string]struct{}, len(links))
+	for _, l := range links {
+		inUse[l.url] = struct{}{}
+		if r, ok := c.cache[l.url]; ok && now.Sub(r.at) < c.cfg.cacheTTL {
+			continue
+		}
+		// Links to other hosts are neither checked nor reported.
+		if u, err := url.Parse(l.url); err == nil && u.Host != "" && !c.allowed(u.Hostname()) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-pace:
+		}
+		if err, ok := c.check(ctx, l.url); ok {
+			c.cache[l.url] = runbookResult{at: time.Now(), err: err}
+		}
+	}
+	// Links no longer used are forgotten.
+	for u := range c.cache {
+		if _, ok := inUse[u]; !ok {
+			delete(c.cache, u)
+		}
+	}
+
+	c.report(links)
+
+	return true
+}
+
+// check returns why the link is broken, empty if it is not, and false if that is not known, e.g. as the host is throttling.
+func (c *runbookChecker) check(ctx context.Context, link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "not an http or https URL", true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, runbookCheckTimeout)
+	defer cancel()
+	code, err := c.request(ctx, http.MethodHead, link)
+	// Not all servers answer HEAD.
+	if err == nil && (code == http.StatusMethodNotAllowed || code == http.StatusNotImplemented) {
+		code, err = c.request(ctx, http.MethodGet, link)
+	}
+	switch {
+	case err != nil:
+		if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+			return "", false
+		}
+		// The error repeats the URL, which is reported along with it.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return err.Error(), true
+	case code == http.StatusTooManyRequests:
+		return "", false
+	// Runbooks behind single sign-on exist, but are not for the syncer to read.
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return "", true
+	case code >= 400:
+		return fmt.Sprintf("status code %d", code), true
+	}
+
+	return "", true
+}
+
+func (c *runbookChecker) request(ctx context.Context, method, link string) (int, error) {
+	req, err := http.NewRequest(method, link, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+
+	return res.StatusCode, nil
+}
+
+// report sets the status warnings and rule_syncer_broken_runbook_links of the broken links, as of the cached results.
+func (c *runbookChecker) report(links []runbookLink) {
+	var warnings []statusWarning
+	broken := make(map[string]int)
+	for _, l := range links {
+		r, ok := c.cache[l.url]
+		if !ok || r.err == "" {
+			continue
+		}
+		warnings = append(warnings, statusWarning{
+			Kind:    runbookWarning,
+			Tenant:  l.tenant,
+			Group:   l.group,
+			Alert:   l.alert,
+			Message: fmt.Sprintf("broken runbook link %s: %s", l.url, r.err),
+		})
+		broken[l.tenant]++
+	}
+	sort.SliceStable(warnings, func(i, j int) bool { return warnings[i].Tenant < warnings[j].Tenant })
+
+	c.status.warn(runbookWarning, warnings)
+	c.broken.Reset()
+	for t, n := range broken {
+		c.broken.WithLabelValues(t).Set(float64(n))
+	}
+	if len(warnings) > 0 && len(warnings) != c.lastBroken {
+		warnf("%sfound %d broken runbook links, see the warnings of the status", c.logPrefix, len(warnings))
+	}
+	c.lastBroken = len(warnings)
+}
+
+// runbookLinks returns the runbook links of the alerts in the files, attributed to the tenant of the file, of the syncer or of their tenant label.
+func (s *syncer) runbookLinks(files []ruleFile) []runbookLink {
+	var links []runbookLink
+	for _, f := range files {
+		if f.groups == nil {
+			continue
+		}
+		for _, g := range f.groups.Groups {
+			for _, r := range g.Rules {
+				link := r.Annotations[s.runbooks.cfg.annotation]
+				// Templated links are only known once the alert fires.
+				if r.Alert == "" || link == "" || strings.Contains(link, "{{") {
+					continue
+				}
+				tenant := f.tenant
+				if tenant == "" {
+					tenant = s.tenant
+				}
+				if tenant == "" {
+					tenant = r.Labels[s.output.tenantLabel]
+				}
+				links = append(links, runbookLink{tenant: tenant, group: g.Name, alert: r.Alert, url: link})
+			}
+		}
+	}
+
+	return links
+}
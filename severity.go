@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Policies of -severity.unknown.
+const (
+	severityKeep   = "keep"
+	severityReject = "reject"
+)
+
+type severityConfig struct {
+	mapFile string
+	label   string
+	unknown string
+}
+
+// severityNormalizer rewrites the severity label of alerts to the values of an org-wide taxonomy,
+// e.g. crit and sev1 to critical, so that routing in Alertmanager can rely on a known set of severities.
+// Recording rules are left untouched, as their labels are part of the recorded series.
+type severityNormalizer struct {
+	label string
+	// severities maps the lowercased aliases and canonical values to the canonical values.
+	severities map[string]string
+	reject     bool
+}
+
+// newSeverityNormalizer reads the mapping file, which maps every canonical severity to its aliases:
+//
+//	critical: [crit, sev1, p1]
+//	warning: [warn, sev2]
+//	info: []
+func newSeverityNormalizer(cfg severityConfig) (*severityNormalizer, error) {
+	b, err := os.ReadFile(cfg.mapFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -severity.map-file: %w", err)
+	}
+	var aliases map[string][]string
+	if err := yaml.UnmarshalStrict(b, &aliases); err != nil {
+		return nil, fmt.Errorf("failed to parse -severity.map-file: %w", err)
+	}
+	if len(aliases) == 0 {
+		return nil, fmt.Errorf("no severities in -severity.map-file %s", cfg.mapFile)
+	}
+
+	n := &severityNormalizer{label: cfg.label, severities: make(map[string]string), reject: cfg.unknown == severityReject}
+	canonical := make([]string, 0, len(aliases))
+	for severity := range aliases {
+		canonical = append(canonical, severity)
+	}
+	sort.Strings(canonical)
+	for _, severity := range canonical {
+		for _, alias := range append([]string{severity}, aliases[severity]...) {
+			key := strings.ToLower(strings.TrimSpace(alias))
+			if other, ok := n.severities[key]; ok && other != severity {
+				return nil, fmt.Errorf("invalid -severity.map-file, %s is mapped to both %s and %s", alias, other, severity)
+			}
+			n.severities[key] = severity
+		}
+	}
+
+	return n, nil
+}
+
+func (n *severityNormalizer) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	var rejected []string
+	for gi := range rgs.Groups {
+		g := &rgs.Groups[gi]
+		for ri := range g.Rules {
+			r := &g.Rules[ri]
+			value, ok := r.Labels[n.label]
+			if r.Alert == "" || !ok {
+				continue
+			}
+			severity, known := n.severities[strings.ToLower(strings.TrimSpace(value))]
+			if !known {
+				if n.reject {
+					rejected = append(rejected, fmt.Sprintf("alert %s in group %q: unknown %s %q", r.Alert, g.Name, n.label, value))
+				}
+				continue
+			}
+			if severity == value {
+				continue
+			}
+
+			// The labels may be shared with a copy of the rule.
+			labels := make(map[string]string, len(r.Labels))
+			for k, v := range r.Labels {
+				labels[k] = v
+			}
+			labels[n.label] = severity
+			r.Labels = labels
+			changed = true
+		}
+	}
+
+	if len(rejected) > 0 {
+		return false, fmt.Errorf("alerts outside of the severity taxonomy: %s", strings.Join(rejected, "; "))
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Keys rules are sharded by.
+const (
+	shardByTenant = "tenant"
+	shardByGroup  = "group"
+)
+
+// shard selects the tenants or groups owned by one of several syncer replicas.
+// Ownership is decided with a jump consistent hash, so that changing the number of replicas
+// only moves about 1/total of the tenants or groups, see https://arxiv.org/abs/1406.2294.
+type shard struct {
+	index int
+	total int
+	by    string
+}
+
+func (s shard) enabled() bool {
+	return s.total > 1
+}
+
+func (s shard) validate() error {
+	if s.total < 1 {
+		return fmt.Errorf("-shard.total must be at least 1, got %d", s.total)
+	}
+	if s.index < 0 || s.index >= s.total {
+		return fmt.Errorf("-shard.index must be between 0 and %d, got %d", s.total-1, s.index)
+	}
+	if s.by != shardByTenant && s.by != shardByGroup {
+		return fmt.Errorf("invalid -shard.by %q, must be %s or %s", s.by, shardByTenant, shardByGroup)
+	}
+
+	return nil
+}
+
+func (s shard) owns(key string) bool {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+
+	return jumpHash(h.Sum64(), s.total) == s.index
+}
+
+// filter drops the tenants or groups owned by other replicas. It returns the number of dropped rules.
+func (s shard) filter(rgs *ruleGroups, tenantLabel string) (*ruleGroups, int) {
+	if !s.enabled() {
+		return rgs, 0
+	}
+
+	filtered := &ruleGroups{Groups: make([]ruleGroup, 0, len(rgs.Groups))}
+	dropped := 0
+	for _, g := range rgs.Groups {
+		if s.by == shardByGroup {
+			if s.owns(g.Name) {
+				filtered.Groups = append(filtered.Groups, g)
+			} else {
+				dropped += len(g.Rules)
+			}
+			continue
+		}
+
+		rules := make([]rule, 0, len(g.Rules))
+		for _, r := range g.Rules {
+			if s.owns(r.Labels[tenantLabel]) {
+				rules = append(rules, r)
+			} else {
+				dropped++
+			}
+		}
+		if len(rules) == 0 && len(g.Rules) > 0 {
+			continue
+		}
+		g.Rules = rules
+		filtered.Groups = append(filtered.Groups, g)
+	}
+
+	return filtered, dropped
+}
+
+// jumpHash maps a key to one of the buckets with the jump consistent hash of Lamping and Veach.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// procDir is where the processes sharing the process namespace of the syncer are listed.
+const procDir = "/proc"
+
+// signalProcesses sends the signal to every process of the given name and returns their number.
+// Processes are found by the command name in /proc, so this only works on Linux.
+func signalProcesses(name string, sig syscall.Signal) (int, error) {
+	dirs, err := filepath.Glob(filepath.Join(procDir, "[0-9]*"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	var n int
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+		if err != nil || strings.TrimSpace(string(comm)) != name {
+			// The process exited in the meantime, or is another one.
+			continue
+		}
+		if err := signalProcess(pid, sig); err != nil {
+			return n, fmt.Errorf("failed to send %s to process %d: %w", sig, pid, err)
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no process named %s found", name)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// signalProcess sends the signal to the process.
+func signalProcess(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig) //nolint:wrapcheck
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// signalProcess fails, as there are no signals on Windows.
+func signalProcess(pid int, sig syscall.Signal) error {
+	return errors.New("sending signals is not supported on Windows")
+}
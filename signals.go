@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runSignalHandler performs an immediate sync on the syncSignals, e.g. SIGUSR1, until the context is done.
+// SIGHUP reloads the configuration if reloadConfig is given and performs an immediate sync otherwise.
+func runSignalHandler(ctx context.Context, syncNow, reloadConfig trigger) error {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, append([]os.Signal{syscall.SIGHUP}, syncSignals...)...)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case sig := <-c:
+			if sig == syscall.SIGHUP && reloadConfig != nil {
+				infof("received %s, reloading the configuration", sig)
+				reloadConfig.fire()
+				continue
+			}
+			infof("received %s, syncing now", sig)
+			syncNow.fire()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// syncSignals perform an immediate sync.
+var syncSignals = []os.Signal{syscall.SIGUSR1}
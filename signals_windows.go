@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// syncSignals perform an immediate sync. There is no SIGUSR1 on Windows.
+var syncSignals []os.Signal
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxSignedURLResponseSize bounds the output of the refresh hook.
+	maxSignedURLResponseSize = 64 << 10
+	// signedURLTimeFormat is that of the X-Amz-Date and X-Goog-Date query parameters.
+	signedURLTimeFormat = "20060102T150405Z"
+)
+
+type signedURLConfig struct {
+	refreshCommand string
+	refreshURL     string
+	refreshBefore  time.Duration
+}
+
+// signedURLHookResponse is the JSON a refresh hook may answer with, instead of the bare URL.
+type signedURLHookResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// signedURLFetcher fetches the rules from a pre-signed URL of an object in S3, GCS or Azure Blob Storage, handed out by a control plane,
+// so that the syncer holds no cloud credentials. The URL is obtained from a refresh hook, a command or an HTTP endpoint,
+// and obtained again shortly before it expires, or when the object storage refuses it.
+type signedURLFetcher struct {
+	cfg signedURLConfig
+	// client fetches the object. It must not authenticate, as object storages refuse pre-signed URLs with other credentials.
+	client *http.Client
+	// hookClient requests -signed-url.refresh-url with the credentials of the syncer.
+	hookClient *http.Client
+	logPrefix  string
+
+	refreshes *prometheus.CounterVec
+	failures  prometheus.Counter
+
+	mu        sync.Mutex
+	url       string
+	expiresAt time.Time
+}
+
+func (f *signedURLFetcher) getRules(ctx context.Context) (*rulesPayload, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	refreshed := false
+	switch {
+	case f.url == "":
+		refreshed = true
+		if err := f.refresh(ctx, "initial"); err != nil {
+			return nil, err
+		}
+	case !f.expiresAt.IsZero() && time.Now().Add(f.cfg.refreshBefore).After(f.expiresAt):
+		refreshed = true
+		if err := f.refresh(ctx, "expiry"); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := f.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The URL expired earlier than it tells, e.g. with the credentials it was signed with, or was revoked.
+	if (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusUnauthorized) && !refreshed {
+		res.Body.Close()
+		debugf("%sobject storage refused the signed URL with status code %d, refreshing it", f.logPrefix, res.StatusCode)
+		if err := f.refresh(ctx, "refused"); err != nil {
+			return nil, err
+		}
+		if res, err = f.get(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		if err := throttled(res); err != nil {
+			return nil, err
+		}
+		return nil, &unexpectedStatusError{from: "object storage", code: res.StatusCode}
+	}
+
+	return newRulesPayload(res), nil
+}
+
+func (f *signedURLFetcher) get(ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		// The error holds the URL, whose signature must not be logged.
+		if ue, ok := err.(*url.Error); ok {
+			return nil, fmt.Errorf("failed to do http request: %w", ue.Err)
+		}
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+
+	return res, nil
+}
+
+// refresh obtains a new URL from the hook. The previous one is kept if it fails, so that the next cycle tries it again.
+func (f *signedURLFetcher) refresh(ctx context.Context, reason string) error {
+	var (
+		out []byte
+		err error
+	)
+	if f.cfg.refreshCommand != "" {
+		out, err = f.runCommand(ctx)
+	} else {
+		out, err = f.requestURL(ctx)
+	}
+	if err != nil {
+		f.failures.Inc()
+		return fmt.Errorf("failed to refresh the signed URL: %w", err)
+	}
+
+	signed, expiresAt, err := parseSignedURLHook(out)
+	if err != nil {
+		f.failures.Inc()
+		return fmt.Errorf("failed to refresh the signed URL: %w", err)
+	}
+	f.refreshes.WithLabelValues(reason).Inc()
+	f.url, f.expiresAt = signed, expiresAt
+	if expiresAt.IsZero() {
+		debugf("%srefreshed the signed URL, it tells no expiry", f.logPrefix)
+	} else {
+		debugf("%srefreshed the signed URL, it expires at %s", f.logPrefix, expiresAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// runCommand runs -signed-url.refresh-command with sh, and returns its standard output.
+func (f *signedURLFetcher) runCommand(ctx context.Context) ([]byte, error) {
+	stdout, stderr := limitedBuffer{limit: maxSignedURLResponseSize}, limitedBuffer{limit: maxSignedURLResponseSize}
+	cmd := exec.CommandContext(ctx, "sh", "-c", f.cfg.refreshCommand)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// The command fails once its output is cut, e.g. with SIGPIPE, so the size is checked first.
+	if err := cmd.Run(); stdout.exceeded {
+		return nil, fmt.Errorf("-signed-url.refresh-command printed more than %d bytes", maxSignedURLResponseSize)
+	} else if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("-signed-url.refresh-command failed: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("-signed-url.refresh-command failed: %w", err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// limitedBuffer is a buffer that refuses writes past its limit, so that a command cannot print without bounds.
+// It does not embed bytes.Buffer, whose ReadFrom would let io.Copy bypass the limit.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.limit {
+		b.exceeded = true
+		return 0, errors.New("output limit exceeded")
+	}
+
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Bytes() []byte { return b.buf.Bytes() }
+
+func (b *limitedBuffer) String() string { return b.buf.String() }
+
+// requestURL requests -signed-url.refresh-url, and returns the body of its response.
+func (f *signedURLFetcher) requestURL(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, f.cfg.refreshURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json, text/plain;q=0.9")
+
+	res, err := f.hookClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return nil, &unexpectedStatusError{from: "signed URL refresh endpoint", code: res.StatusCode}
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxSignedURLResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the response of -signed-url.refresh-url: %w", err)
+	}
+	if len(b) > maxSignedURLResponseSize {
+		return nil, fmt.Errorf("the response of -signed-url.refresh-url is larger than %d bytes", maxSignedURLResponseSize)
+	}
+
+	return b, nil
+}
+
+// parseSignedURLHook returns the URL the hook answered with and when it expires, zero if unknown.
+// The hook answers with the bare URL, or with a JSON object giving the url, and optionally when it expiresAt in RFC 3339.
+// Without the latter, the expiry is read from the query parameters of the URL.
+func parseSignedURLHook(out []byte) (string, time.Time, error) {
+	out = bytes.TrimSpace(out)
+	var hr signedURLHookResponse
+	if bytes.HasPrefix(out, []byte("{")) {
+		if err := json.Unmarshal(out, &hr); err != nil {
+			return "", time.Time{}, fmt.Errorf("failed to decode the response of the hook: %w", err)
+		}
+	} else {
+		hr.URL = string(out)
+	}
+	if hr.URL == "" {
+		return "", time.Time{}, fmt.Errorf("the hook answered with no URL")
+	}
+
+	u, err := url.Parse(hr.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		// The URL itself is not part of the error, as it holds the signature.
+		return "", time.Time{}, fmt.Errorf("the hook answered with no valid http or https URL")
+	}
+	if hr.ExpiresAt.IsZero() {
+		hr.ExpiresAt = signedURLExpiry(u.Query())
+	}
+
+	return hr.URL, hr.ExpiresAt, nil
+}
+
+// signedURLExpiry returns when a pre-signed URL expires, from its query parameters: the date and lifetime of
+// AWS Signature Version 4 and GCS V4 signing, the Unix time of their former versions, or the se of an Azure SAS.
+// It returns zero if the URL tells no expiry.
+func signedURLExpiry(q url.Values) time.Time {
+	for _, p := range []string{"X-Amz", "X-Goog"} {
+		date, err := time.Parse(signedURLTimeFormat, q.Get(p+"-Date"))
+		if err != nil {
+			continue
+		}
+		if secs, err := strconv.Atoi(q.Get(p + "-Expires")); err == nil {
+			return date.Add(time.Duration(secs) * time.Second)
+		}
+	}
+	if secs, err := strconv.ParseInt(q.Get("Expires"), 10, 64); err == nil {
+		return time.Unix(secs, 0)
+	}
+	if se, err := time.Parse(time.RFC3339, q.Get("se")); err == nil {
+		return se
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusConfig summarizes the configuration of the syncer. It must not hold any secret.
+type statusConfig struct {
+	Pipeline    string `json:"pipeline,omitempty"`
+	Source      string `json:"source"`
+	Tenant      string `json:"tenant,omitempty"`
+	Target      string `json:"target"`
+	Layout      string `json:"layout"`
+	File        string `json:"file,omitempty"`
+	Dir         string `json:"dir,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	TenantLabel string `json:"tenantLabel"`
+	FetchFormat string `json:"fetchFormat"`
+	Interval    string `json:"interval"`
+	Jitter      string `json:"jitter"`
+	Staleness   string `json:"stalenessThreshold,omitempty"`
+	Stagger     bool   `json:"stagger,omitempty"`
+	Align       bool   `json:"align,omitempty"`
+	ShardIndex  int    `json:"shardIndex"`
+	ShardTotal  int    `json:"shardTotal"`
+	ReloadURL   string `json:"reloadURL,omitempty"`
+}
+
+// syncStatus is the state of the syncer as reported by /-/status.
+type syncStatus struct {
+	LastSync    *time.Time      `json:"lastSync,omitempty"`
+	LastSuccess *time.Time      `json:"lastSuccess,omitempty"`
+	LastError   *statusError    `json:"lastError,omitempty"`
+	Hash        string          `json:"hash,omitempty"`
+	Groups      int             `json:"groups"`
+	Rules       int             `json:"rules"`
+	Tenants     []tenantStatus  `json:"tenants"`
+	Warnings    []statusWarning `json:"warnings"`
+	Reload      reloadStatus    `json:"reload"`
+	Paused      bool            `json:"paused"`
+	Stale       bool            `json:"stale"`
+	Config      statusConfig    `json:"config"`
+}
+
+type statusError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// statusWarning is a problem of a synced rule that does not fail the sync, e.g. a broken runbook link.
+type statusWarning struct {
+	Kind    string `json:"kind"`
+	Tenant  string `json:"tenant,omitempty"`
+	Group   string `json:"group,omitempty"`
+	Alert   string `json:"alert,omitempty"`
+	Message string `json:"message"`
+}
+
+// tenantStatus describes the rules of a tenant written by the last successful cycle.
+type tenantStatus struct {
+	Tenant     string    `json:"tenant"`
+	File       string    `json:"file"`
+	LastSync   time.Time `json:"lastSync"`
+	LastChange time.Time `json:"lastChange"`
+	Hash       string    `json:"hash"`
+	Groups     int       `json:"groups"`
+	Rules      int       `json:"rules"`
+}
+
+// reloadStatus is the state of the reloads. Healthy tells whether the quorum of -reload.min-success was met.
+type reloadStatus struct {
+	URL        string               `json:"url"`
+	Healthy    bool                 `json:"healthy"`
+	LastReload *time.Time           `json:"lastReload,omitempty"`
+	LastError  *statusError         `json:"lastError,omitempty"`
+	Targets    []reloadTargetStatus `json:"targets"`
+}
+
+// reloadTargetStatus is the state of the reloads of a Thanos Ruler.
+type reloadTargetStatus struct {
+	URL        string       `json:"url"`
+	Healthy    bool         `json:"healthy"`
+	LastReload *time.Time   `json:"lastReload,omitempty"`
+	LastError  *statusError `json:"lastError,omitempty"`
+}
+
+// cycleRecord is the outcome of a sync cycle kept in the history.
+type cycleRecord struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	// Hash, Bytes, Groups and Rules describe the files written by the cycle, if it got that far.
+	Hash   string `json:"hash,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"`
+	Groups int    `json:"groups,omitempty"`
+	Rules  int    `json:"rules,omitempty"`
+	// Changes summarizes the changed groups by tenant. It is empty if the cycle failed before writing.
+	Changes map[string]deltaSummary `json:"changes,omitempty"`
+	// Reloaded tells whether a reload was attempted and ReloadError whether it failed.
+	Reloaded    bool   `json:"reloaded"`
+	ReloadError string `json:"reloadError,omitempty"`
+	// Headers are the captured headers of the response of the backend, see -fetch.capture-headers.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// files are the files written by the cycle.
+	files []ruleFile
+}
+
+type deltaSummary struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	Changed int `json:"changed"`
+}
+
+// statusTracker records the outcome of sync cycles. It is safe for concurrent use.
+type statusTracker struct {
+	mu     sync.Mutex
+	status syncStatus
+	// history is a ring buffer of the last cycles, next is the index the next cycle is recorded at.
+	history []cycleRecord
+	next    int
+	size    int
+	// current collects the outcome of the cycle in progress.
+	current cycleRecord
+	// store is optional and persists the history across restarts.
+	store *historyStore
+}
+
+func newStatusTracker(cfg statusConfig, historySize int, store *historyStore) *statusTracker {
+	t := &statusTracker{
+		status: syncStatus{
+			Tenants:  []tenantStatus{},
+			Warnings: []statusWarning{},
+			Reload:   reloadStatus{URL: cfg.ReloadURL, Targets: []reloadTargetStatus{}},
+			Config:   cfg,
+		},
+		history: make([]cycleRecord, 0, historySize),
+		size:    historySize,
+		store:   store,
+	}
+
+	if store != nil && historySize > 0 {
+		cycles, err := store.recent(historySize)
+		if err != nil {
+			warnf("failed to load the sync history: %v", err)
+		}
+		// The history is filled oldest first.
+		for i := len(cycles) - 1; i >= 0; i-- {
+			c := cycles[i]
+			t.history = append(t.history, c)
+
+			at := c.Start.Add(c.Duration)
+			t.status.LastSync = &at
+			if c.Error != "" {
+				t.status.LastError = &statusError{Time: at, Message: c.Error}
+			} else {
+				t.status.LastSuccess = &at
+			}
+		}
+		t.next = len(t.history) % historySize
+	}
+
+	return t
+}
+
+// fetched records the captured headers of the response the cycle in progress fetched the rules with.
+func (t *statusTracker) fetched(headers map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.current.Headers = headers
+}
+
+// wrote records that the cycle in progress wrote the given files, even if it fails later on, e.g. to reload Thanos Ruler.
+func (t *statusTracker) wrote(hash string, files []ruleFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.current.Hash = hash
+	t.current.files = files
+}
+
+// succeeded records that the cycle in progress wrote the given files, changing the given groups.
+func (t *statusTracker) succeeded(at time.Time, hash string, files []ruleFile, tenant string, delta groupDelta) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.current.Changes = t.summarize(delta)
+	t.current.Hash = hash
+	t.current.files = files
+	t.status.LastSuccess = &at
+	t.status.Hash = hash
+	t.status.Groups, t.status.Rules = 0, 0
+
+	previous := make(map[string]tenantStatus, len(t.status.Tenants))
+	for _, ts := range t.status.Tenants {
+		previous[ts.File] = ts
+	}
+	t.status.Tenants = make([]tenantStatus, 0, len(files))
+	for _, f := range files {
+		ts := tenantStatus{Tenant: f.tenant, File: f.path, LastSync: at, LastChange: at, Hash: contentHash(f.content)}
+		if ts.Tenant == "" {
+			ts.Tenant = tenant
+		}
+		if p, ok := previous[f.path]; ok && p.Hash == ts.Hash {
+			ts.LastChange = p.LastChange
+		}
+		if f.groups != nil {
+			alerting, recording := f.groups.countRules()
+			ts.Groups, ts.Rules = len(f.groups.Groups), alerting+recording
+		}
+		t.status.Groups += ts.Groups
+		t.status.Rules += ts.Rules
+		t.current.Bytes += len(f.content)
+		t.status.Tenants = append(t.status.Tenants, ts)
+	}
+	sort.Slice(t.status.Tenants, func(i, j int) bool { return t.status.Tenants[i].Tenant < t.status.Tenants[j].Tenant })
+	t.current.Groups, t.current.Rules = t.status.Groups, t.status.Rules
+}
+
+// warn replaces the warnings of the kind with the given ones.
+func (t *statusTracker) warn(kind string, warnings []statusWarning) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	kept := make([]statusWarning, 0, len(t.status.Warnings)+len(warnings))
+	for _, w := range t.status.Warnings {
+		if w.Kind != kind {
+			kept = append(kept, w)
+		}
+	}
+	t.status.Warnings = append(kept, warnings...)
+}
+
+// finished records the end of the cycle in progress and adds it to the history, persisting it once the lock is released,
+// so that a slow disk does not block the status pages.
+func (t *statusTracker) finished(start time.Time, d time.Duration, err error) {
+	record := t.finish(start, d, err)
+	if t.store != nil {
+		if err := t.store.record(record); err != nil {
+			warnf("failed to persist the sync cycle: %v", err)
+		}
+	}
+}
+
+// finish ends the cycle in progress and returns its record.
+func (t *statusTracker) finish(start time.Time, d time.Duration, err error) cycleRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at := start.Add(d)
+	t.status.LastSync = &at
+	t.current.Start, t.current.Duration = start, d
+	if err != nil {
+		msg := redact(err.Error())
+		t.status.LastError = &statusError{Time: at, Message: msg}
+		t.current.Error = msg
+	}
+
+	record := t.current
+	// The history does not keep the files, only the store does.
+	t.current.files = nil
+	if t.size > 0 {
+		if len(t.history) < t.size {
+			t.history = append(t.history, t.current)
+		} else {
+			t.history[t.next] = t.current
+		}
+		t.next = (t.next + 1) % t.size
+	}
+	t.current = cycleRecord{}
+
+	return record
+}
+
+// recent returns the recorded cycles, the most recent first.
+func (t *statusTracker) recent() []cycleRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cycles := make([]cycleRecord, 0, len(t.history))
+	for i := 1; i <= len(t.history); i++ {
+		cycles = append(cycles, t.history[(t.next-i+len(t.history))%len(t.history)])
+	}
+
+	return cycles
+}
+
+// summarize counts the changed groups by tenant.
+// In the per-tenant layout, groups are keyed by tenant/group, see filesGroupHashes.
+func (t *statusTracker) summarize(delta groupDelta) map[string]deltaSummary {
+	changes := make(map[string]deltaSummary)
+	tenantOf := func(name string) string {
+		if t.status.Config.Layout == layoutPerTenant {
+			if i := strings.Index(name, "/"); i >= 0 {
+				return name[:i]
+			}
+		}
+
+		return t.status.Config.Tenant
+	}
+
+	for _, name := range delta.Added {
+		c := changes[tenantOf(name)]
+		c.Added++
+		changes[tenantOf(name)] = c
+	}
+	for _, name := range delta.Removed {
+		c := changes[tenantOf(name)]
+		c.Removed++
+		changes[tenantOf(name)] = c
+	}
+	for _, name := range delta.Changed {
+		c := changes[tenantOf(name)]
+		c.Changed++
+		changes[tenantOf(name)] = c
+	}
+
+	return changes
+}
+
+// reloaded records the outcome of a reload of the Thanos Rulers, err telling whether the quorum was met.
+func (t *statusTracker) reloaded(at time.Time, results []reloadResult, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.current.Reloaded = true
+	var msg string
+	if err != nil {
+		msg = redact(err.Error())
+		t.current.ReloadError = msg
+	}
+	t.status.Reload.LastReload = &at
+	t.status.Reload.Healthy = err == nil
+	t.status.Reload.LastError = nil
+	if err != nil {
+		t.status.Reload.LastError = &statusError{Time: at, Message: msg}
+	}
+
+	targets := make([]reloadTargetStatus, 0, len(results))
+	for _, res := range results {
+		ts := reloadTargetStatus{URL: res.target, Healthy: res.err == nil, LastReload: &at}
+		if res.err != nil {
+			ts.LastError = &statusError{Time: at, Message: redact(res.err.Error())}
+		}
+		targets = append(targets, ts)
+	}
+	t.status.Reload.Targets = targets
+}
+
+// setStale records whether the rules are stale and tells whether that changed.
+func (t *statusTracker) setStale(stale bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := t.status.Stale != stale
+	t.status.Stale = stale
+
+	return changed
+}
+
+func (t *statusTracker) setPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.status.Paused = paused
+}
+
+// files returns the rules files written by the cycle with the given hash, as kept by the history store.
+func (t *statusTracker) files(hash string) ([]ruleFile, error) {
+	if t.store == nil {
+		return nil, fmt.Errorf("the rules of earlier cycles are only kept with -data.dir")
+	}
+	files, err := t.store.files(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no rules files stored for hash %s", hash)
+	}
+
+	return files, nil
+}
+
+// lastWritten returns the hash of the rules written by the last cycle that got that far, as kept by the history store.
+func (t *statusTracker) lastWritten() (string, error) {
+	if t.store == nil {
+		return "", fmt.Errorf("the rules of earlier cycles are only kept with -data.dir")
+	}
+	cycles, err := t.store.recent(0)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range cycles {
+		if c.Hash != "" {
+			return c.Hash, nil
+		}
+	}
+
+	return "", fmt.Errorf("no cycle wrote rules files yet")
+}
+
+func (t *statusTracker) snapshot() syncStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.status
+	s.Tenants = append([]tenantStatus(nil), t.status.Tenants...)
+	s.Warnings = append([]statusWarning{}, t.status.Warnings...)
+
+	return s
+}
+
+// handler serves the status as JSON.
+func (t *statusTracker) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(t.snapshot())
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ts": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>thanos-rule-syncer status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; vertical-align: top; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>thanos-rule-syncer</h1>
+<p>Syncing from {{ .Status.Config.Source }} every {{ .Status.Config.Interval }}{{ if .Status.Config.ReloadURL }}, reloading {{ .Status.Config.ReloadURL }}{{ else }} to PrometheusRules in {{ .Status.Config.Namespace }}{{ end }}.</p>
+{{ if .Status.Paused }}<p class="error">Syncing is paused.</p>{{ end }}
+{{ if .Status.Stale }}<p class="error">The rules are stale, no sync succeeded within {{ .Status.Config.Staleness }}.</p>{{ end }}
+{{ with .Status.LastError }}<p class="error">Last error at {{ ts .Time }}: {{ .Message }}</p>{{ end }}
+
+<h2>Tenants</h2>
+<table>
+<tr><th>Tenant</th><th>File</th><th>Groups</th><th>Rules</th><th>Last sync</th><th>Last change</th></tr>
+{{ range .Status.Tenants }}<tr><td>{{ .Tenant }}</td><td>{{ .File }}</td><td>{{ .Groups }}</td><td>{{ .Rules }}</td><td>{{ ts .LastSync }}</td><td>{{ ts .LastChange }}</td></tr>
+{{ else }}<tr><td colspan="6">No rules synced yet.</td></tr>
+{{ end }}</table>
+
+{{ if .Status.Warnings }}<h2>Warnings</h2>
+<table>
+<tr><th>Kind</th><th>Tenant</th><th>Group</th><th>Alert</th><th>Warning</th></tr>
+{{ range .Status.Warnings }}<tr><td>{{ .Kind }}</td><td>{{ .Tenant }}</td><td>{{ .Group }}</td><td>{{ .Alert }}</td><td class="error">{{ .Message }}</td></tr>
+{{ end }}</table>
+
+{{ end }}{{ if gt (len .Status.Reload.Targets) 1 }}<h2>Thanos Rulers</h2>
+<table>
+<tr><th>URL</th><th>Last reload</th><th>Result</th></tr>
+{{ range .Status.Reload.Targets }}<tr><td>{{ .URL }}</td><td>{{ ts .LastReload }}</td><td>{{ with .LastError }}<span class="error">{{ .Message }}</span>{{ else }}ok{{ end }}</td></tr>
+{{ end }}</table>
+
+{{ end }}<h2>Recent sync cycles</h2>
+<table>
+<tr><th>Start</th><th>Result</th><th>Duration</th><th>Changes</th><th>Reload</th></tr>
+{{ range .Cycles }}<tr>
+<td>{{ ts .Start }}</td>
+<td>{{ if .Error }}<span class="error">{{ .Error }}</span>{{ else }}ok{{ end }}</td>
+<td>{{ .Duration }}</td>
+<td>{{ range $tenant, $c := .Changes }}{{ if $tenant }}{{ $tenant }}: {{ end }}+{{ $c.Added }} -{{ $c.Removed }} ~{{ $c.Changed }}<br>{{ else }}none{{ end }}</td>
+<td>{{ if not .Reloaded }}-{{ else if .ReloadError }}<span class="error">{{ .ReloadError }}</span>{{ else }}ok{{ end }}</td>
+</tr>
+{{ else }}<tr><td colspan="5">No sync cycle finished yet.</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
+
+// pageHandler serves a human readable status page including the recent sync cycles.
+func (t *statusTracker) pageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := statusPage.Execute(&buf, struct {
+		Status syncStatus
+		Cycles []cycleRecord
+	}{
+		Status: t.snapshot(),
+		Cycles: t.recent(),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = buf.WriteTo(w)
+}
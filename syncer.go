@@ -0,0 +1,922 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// stageTimeouts holds the deadline of every stage of a sync cycle.
+// A zero value means the stage is only bound by the lifetime of the process.
+type stageTimeouts struct {
+	fetch    time.Duration
+	validate time.Duration
+	write    time.Duration
+	reload   time.Duration
+}
+
+// syncer fetches rules, validates them, writes them to disk and reloads Thanos Ruler.
+type syncer struct {
+	// pipeline names the syncer with -config.file.
+	pipeline string
+	fetcher  fetcher
+	// client presents the credentials of the flags, e.g. to the backend.
+	client   *http.Client
+	reloader *reloader
+	output   *output
+	tenant   string
+	tenants  tenantFilter
+	shard    shard
+	interval time.Duration
+	jitter   time.Duration
+	timeouts stageTimeouts
+	// stagger syncs at an offset within the interval derived from the pipeline or tenant, see -sync.stagger.
+	stagger bool
+	// align syncs on the multiples of the interval of the wall clock, see -interval.align.
+	align bool
+	// staleness is the time without a successful sync after which the rules are stale, see -sync.staleness-threshold.
+	staleness time.Duration
+	// shutdownGrace is how long a sync cycle in flight may go on once the syncer is stopped, see -shutdown.grace-period.
+	shutdownGrace time.Duration
+	// injectTenantLabel sets the tenant label of the rules to the tenant, see -observatorium.rules-endpoint.
+	injectTenantLabel bool
+	// jsonnet is set if payloads are evaluated as Jsonnet, see -fetch.format.
+	jsonnet *jsonnetEvaluator
+	// includes resolves the $include directives of payloads, if set.
+	includes *includeResolver
+	// captureHeaders are the response headers of the backend recorded in the history and the audit log, see -fetch.capture-headers.
+	captureHeaders []string
+	// bundleMode tells how the rules files of archives served by the backend are merged, see -fetch.bundle-mode.
+	bundleMode string
+	// headers are the captured headers of the last fetched payload.
+	headers map[string]string
+	// templatePolicy tells how to handle invalid alert templates, see -validate.templates.
+	templatePolicy string
+	// validatePolicy tells whether invalid groups refuse all rules or are dropped, see -validate.policy.
+	validatePolicy string
+	// rejections are those of the last validated payload.
+	rejections *rejectionTracker
+	// provenance labels the synced rules with where they came from, if set.
+	provenance *provenance
+	// runbooks checks the runbook links of the synced alerts, if set.
+	runbooks *runbookChecker
+	// maxTenantBytes is the most bytes of rules of a tenant, see -limits.max-bytes-per-tenant. 0 disables the limit.
+	maxTenantBytes int64
+	// rulerHealthCheck tells whether to check the health of Thanos Ruler before writing changed rules, see -write.ruler-health-check.
+	rulerHealthCheck string
+	// alertRelabel syncs the alert relabel configuration of Thanos Ruler along with the rules, if set.
+	alertRelabel *alertRelabelSyncer
+	// chaos injects failures, see chaosConfig.
+	chaos chaosConfig
+	// recorder keeps the fetched payloads, if set.
+	recorder *recorder
+	// overlay is merged into the synced rules, if set.
+	overlay *overlay
+	// crossCheck compares the rules with those of the Observatorium API, if set.
+	crossCheck *crossChecker
+	// preflight queries the expressions of new or changed recording rules, if set.
+	preflight *preflight
+	// rulerGlob validates the rules files together with the others Thanos Ruler loads, if set.
+	rulerGlob *rulerGlob
+	// transformers modify the rules before they are written.
+	transformers []transformer
+	// fetchSlots is shared by the pipelines and bounds their concurrent fetches.
+	fetchSlots fetchSlots
+	// syncNow cuts the wait for the next cycle short.
+	syncNow trigger
+	// synced is closed once the first sync cycle finished, whatever its result.
+	synced  chan struct{}
+	metrics *syncerMetrics
+	// errorLog logs the errors of failed cycles.
+	errorLog *errorDeduper
+	status   *statusTracker
+	// events is optional and receives an event whenever the rules change.
+	events *eventEmitter
+	// notifier is optional and notifies rule changes and failures, see notifyConfig.
+	notifier *notifier
+	// audit is optional and records every applied change, on behalf of source.
+	audit  *auditLog
+	source string
+
+	// paused is non-zero while syncing is paused.
+	paused int32
+	// cycleMu serializes sync cycles and rollbacks.
+	cycleMu sync.Mutex
+	// cycleStart is the start of the running sync cycle, the zero time.Time between cycles.
+	cycleStart atomic.Value
+	// previewing and lastPreview throttle the previews, as every one of them fetches the rules from the backend.
+	previewMu   sync.Mutex
+	previewing  bool
+	lastPreview time.Time
+
+	// hash and groups describe the rules written by the last successful cycle.
+	hash   string
+	groups map[string]string
+	// tenantRulesHashes are the hashes of the rules of every tenant written by the last successful cycle, see observeTenantChanges.
+	tenantRulesHashes map[string]string
+}
+
+// recoverFiles cleans up after a crash while writing. Temporary files are removed, and corrupt rules files, which fail to parse
+// or were cut short, are restored from the last cycle kept by the history store, so that Thanos Ruler evaluates them until the next successful cycle.
+// Valid files differing from those written, e.g. edited, are left as they are until the next cycle.
+func (s *syncer) recoverFiles(ctx context.Context) {
+	if s.output.resources != nil {
+		return
+	}
+	if err := s.output.removeTempFiles(); err != nil {
+		warnf("%s%v", s.logPrefix(), err)
+	}
+
+	files, err := s.output.current()
+	if err != nil {
+		// There are no rules files yet.
+		return
+	}
+	hash, err := s.status.lastWritten()
+	if err != nil {
+		for _, f := range files {
+			if f.groups == nil {
+				warnf("%sthe rules file %s is invalid and cannot be restored: %v", s.logPrefix(), f.path, err)
+			}
+		}
+		return
+	}
+	if filesHash(files) == hash {
+		return
+	}
+	written, err := s.status.files(hash)
+	if err != nil {
+		warnf("%sfailed to read the rules files written last: %v", s.logPrefix(), err)
+		return
+	}
+	byPath := make(map[string]ruleFile, len(written))
+	for _, f := range written {
+		byPath[f.path] = f
+	}
+
+	var restored []ruleFile
+	for _, f := range files {
+		w, ok := byPath[f.path]
+		switch {
+		case ok && (f.groups == nil || truncatedFile(f, w)):
+			restored = append(restored, w)
+		case !ok && f.groups == nil:
+			warnf("%sthe rules file %s is invalid and cannot be restored, as it was not written by the last cycle", s.logPrefix(), f.path)
+		}
+	}
+	if len(restored) == 0 {
+		debugf("%sthe rules files on disk differ from those of %s, but are valid and left as they are", s.logPrefix(), hash)
+		return
+	}
+
+	err = s.output.checkSpace(restored)
+	if err == nil {
+		_, err = s.output.writeFiles(ctx, restored)
+	}
+	if err != nil {
+		warnf("%sfailed to restore the rules files written last: %v", s.logPrefix(), err)
+		return
+	}
+	if err := s.reload(ctx); err != nil {
+		warnf("%sfailed to reload Thanos Ruler after restoring the rules files: %v", s.logPrefix(), err)
+	}
+	infof("%srestored %d corrupt rules files from those of %s", s.logPrefix(), len(restored), hash)
+}
+
+// loadCurrent initializes the state of the syncer from the rules files already on disk, if any,
+// so that restarts do not report the existing rules as a change.
+func (s *syncer) loadCurrent() {
+	files, err := s.output.current()
+	if err != nil {
+		return
+	}
+	s.hash = filesHash(files)
+	s.groups = filesGroupHashes(files)
+	s.loadTenantChanges(files)
+	if s.provenance != nil {
+		s.provenance.seed(files)
+	}
+	if s.preflight != nil {
+		s.preflight.seed(files)
+	}
+}
+
+// run syncs every interval until the context is done.
+func (s *syncer) run(ctx context.Context) error {
+	//nolint:gosec
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// due is the slot of the wall clock the cycle in progress is due at, when staggered or aligned.
+	// It holds no monotonic clock reading, so that it is compared with the wall clock.
+	var due time.Time
+	if s.stagger || s.align {
+		now := time.Now()
+		d := s.nextSlot(now)
+		due = now.Add(d).Round(0)
+		debugf("%sdelaying the first sync by %s to its slot at %s", s.logPrefix(), d, due.Format(time.RFC3339))
+		if !s.wait(ctx, d) {
+			return nil
+		}
+	}
+	if s.jitter > 0 {
+		d := time.Duration(rnd.Int63n(int64(s.jitter)))
+		debugf("%sdelaying the first sync by %s", s.logPrefix(), d)
+		if !s.wait(ctx, d) {
+			return nil
+		}
+	}
+
+	started := time.Now()
+	// throttledAttempts counts consecutive cycles the backend asked us to back off.
+	var throttledAttempts int
+	first := true
+	for {
+		delay := s.interval
+		if s.stagger || s.align {
+			// The slot keeps its place in the interval, however long the cycles take.
+			delay, due = s.nextDue(due, time.Now())
+		}
+		var spread time.Duration
+		if s.jitter > 0 {
+			// Spread the ticks evenly within [interval-jitter/2, interval+jitter/2).
+			spread = time.Duration(rnd.Int63n(int64(s.jitter))) - s.jitter/2
+			delay += spread
+		}
+
+		// The pause is checked with the cycles serialized, so that a rollback pausing syncing meanwhile is not overwritten by the cycle.
+		s.cycleMu.Lock()
+		if s.isPaused() {
+			s.cycleMu.Unlock()
+			debugf("%ssyncing is paused, skipping the sync cycle", s.logPrefix())
+			if !s.wait(ctx, delay) {
+				return nil
+			}
+			continue
+		}
+
+		start := time.Now()
+		s.cycleStart.Store(start)
+		cycleCtx, cancelCycle := s.cycleContext(ctx)
+		err := s.sync(cycleCtx)
+		cancelCycle()
+		s.cycleStart.Store(time.Time{})
+		s.status.finished(start, time.Since(start), err)
+		s.cycleMu.Unlock()
+		if err != nil {
+			s.metrics.errors.WithLabelValues(classify(err)).Inc()
+			s.errorLog.failed(time.Now(), err.Error())
+
+			var te *throttledError
+			if errors.As(err, &te) {
+				throttledAttempts++
+				s.metrics.throttled.WithLabelValues(strconv.Itoa(te.code)).Inc()
+				delay = te.delay(s.interval, throttledAttempts)
+				warnf("%sbacking off, next sync in %s", s.logPrefix(), delay)
+			} else {
+				throttledAttempts = 0
+			}
+		} else {
+			throttledAttempts = 0
+			s.errorLog.succeeded()
+		}
+		if s.notifier != nil {
+			s.notifier.cycleFinished(ctx, err)
+		}
+		s.checkStaleness(started, time.Now())
+		if first {
+			close(s.synced)
+			first = false
+		}
+
+		if (s.stagger || s.align) && throttledAttempts == 0 {
+			// The cycle took some of the time until the next slot.
+			if delay = time.Until(due); delay <= 0 {
+				delay, due = s.nextDue(due, time.Now())
+			}
+			delay += spread
+		}
+		if !s.wait(ctx, delay) {
+			return nil
+		}
+	}
+}
+
+// nextSlot returns the time until the syncer is due next when staggered or aligned.
+// Slots are aligned to the wall clock, so that they are the same across restarts and processes.
+// When staggered, their offset in the interval hashes the pipeline or tenant, spreading the syncers of many tenants across the interval,
+// and when aligned it is 0, e.g. every minute on :00.
+func (s *syncer) nextSlot(now time.Time) time.Duration {
+	var offset time.Duration
+	if s.stagger {
+		key := s.pipeline
+		if key == "" {
+			key = s.tenant
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		offset = time.Duration(h.Sum64() % uint64(s.interval))
+	}
+
+	d := (offset - time.Duration(now.UnixNano()%int64(s.interval)) + s.interval) % s.interval
+	if d == 0 {
+		d = s.interval
+	}
+
+	return d
+}
+
+// nextDue returns the time until the slot after the one the last cycle was due at, and that slot.
+// Slots are counted from the last one rather than from the time it is now, so that a timer firing a little early,
+// or the wall clock lagging behind that of the process, does not sync twice in the same slot.
+// Slots missed by long cycles are skipped, and the slots are aligned to the wall clock again if it jumped, e.g. as NTP stepped it.
+func (s *syncer) nextDue(last, now time.Time) (time.Duration, time.Time) {
+	due := last.Add(s.interval)
+	if d := due.Sub(now); d > 0 && d < 2*s.interval {
+		return d, due
+	}
+
+	d := s.nextSlot(now)
+	// Without the monotonic clock reading, the slot is compared with the wall clock.
+	return d, now.Add(d).Round(0)
+}
+
+// checkStaleness reports the rules as stale if no sync succeeded within the staleness threshold,
+// counting from the start of the syncer if none did yet.
+func (s *syncer) checkStaleness(started, now time.Time) {
+	if s.staleness <= 0 {
+		return
+	}
+
+	since := started
+	if last := s.status.snapshot().LastSuccess; last != nil {
+		since = *last
+	}
+	stale := now.Sub(since) > s.staleness
+	if !s.status.setStale(stale) {
+		return
+	}
+	if stale {
+		s.metrics.stale.Set(1)
+		warnf("%sthe rules are stale, no sync succeeded since %s, exceeding the staleness threshold of %s", s.logPrefix(), since.UTC().Format(time.RFC3339), s.staleness)
+	} else {
+		s.metrics.stale.Set(0)
+		infof("%sthe rules are no longer stale", s.logPrefix())
+	}
+}
+
+// setPaused pauses or resumes syncing. A cycle in progress is finished.
+func (s *syncer) setPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.paused, v) == v {
+		return
+	}
+	s.status.setPaused(paused)
+	if paused {
+		infof("%ssyncing paused", s.logPrefix())
+	} else {
+		infof("%ssyncing resumed", s.logPrefix())
+		s.syncNow.fire()
+	}
+}
+
+func (s *syncer) isPaused() bool {
+	return atomic.LoadInt32(&s.paused) != 0
+}
+
+func (s *syncer) logPrefix() string {
+	return pipelineLogPrefix(s.pipeline)
+}
+
+// rollback restores the rules files written by an earlier cycle from the history and pauses syncing,
+// so that the next cycle does not overwrite them. It is recorded in the history like a sync cycle.
+func (s *syncer) rollback(ctx context.Context, hash string) error {
+	files, err := s.status.files(hash)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.groups == nil {
+			return fmt.Errorf("the rules file %s of %s is invalid", f.path, hash)
+		}
+	}
+
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+	s.setPaused(true)
+
+	start := time.Now()
+	err = s.restore(ctx, hash, files)
+	s.status.finished(start, time.Since(start), err)
+	if err != nil {
+		return err
+	}
+	infof("%srolled back to the rules of %s", s.logPrefix(), hash)
+
+	return nil
+}
+
+func (s *syncer) restore(ctx context.Context, hash string, files []ruleFile) error {
+	if err := s.write(ctx, files); err != nil {
+		return &stageError{stage: stageWrite, err: err}
+	}
+	s.status.wrote(hash, files)
+	if s.output.resources == nil {
+		if err := s.reload(ctx); err != nil {
+			return &stageError{stage: stageReload, err: fmt.Errorf("failed to trigger thanos rule reload: %w", err)}
+		}
+	}
+
+	// The restored rules were not fetched in this cycle, so there are no headers to record.
+	delta := s.recordChange(ctx, hash, filesGroupHashes(files), nil)
+	s.observeTenantChanges(files, time.Now())
+	s.observeTenantBytes(files)
+	s.status.succeeded(time.Now(), hash, files, s.tenant, delta)
+
+	return nil
+}
+
+// stuck tells whether the running sync cycle exceeded the deadlines of its stages, with an interval of grace for waiting on a fetch slot.
+// A cycle with a stage without deadline is never stuck.
+func (s *syncer) stuck(now time.Time) bool {
+	start, _ := s.cycleStart.Load().(time.Time)
+	if start.IsZero() {
+		return false
+	}
+	limit := s.interval
+	for _, d := range []time.Duration{s.timeouts.fetch, s.timeouts.validate, s.timeouts.write, s.timeouts.reload} {
+		if d == 0 {
+			return false
+		}
+		limit += d
+	}
+
+	return now.Sub(start) > limit
+}
+
+// wait blocks for the given duration or until a sync is triggered.
+// It returns false if the context is done.
+func (s *syncer) wait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-s.syncNow:
+	case <-ctx.Done():
+		return false
+	}
+
+	return true
+}
+
+// cycleContext returns the context of a sync cycle, which outlives the given context by the shutdown grace period,
+// so that stopping the syncer lets the cycle in flight finish writing and reloading rather than cancelling it halfway.
+func (s *syncer) cycleContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.shutdownGrace <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	cycleCtx, cancel := context.WithCancel(detachedContext{parent: ctx})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-cycleCtx.Done():
+			return
+		}
+		infof("%sstopping, waiting up to %s for the sync cycle in flight to finish", s.logPrefix(), s.shutdownGrace)
+		t := time.NewTimer(s.shutdownGrace)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			warnf("%sthe sync cycle in flight did not finish within %s, cancelling it", s.logPrefix(), s.shutdownGrace)
+			cancel()
+		case <-cycleCtx.Done():
+		}
+	}()
+
+	return cycleCtx, cancel
+}
+
+// detachedContext carries the values of its parent, but is neither cancelled nor expires with it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// sync runs a single sync cycle. Every stage runs under its own deadline.
+func (s *syncer) sync(ctx context.Context) error {
+	payload, hash, contentType, err := s.fetch(ctx)
+	if err != nil {
+		return &stageError{stage: stageFetch, err: fmt.Errorf("failed to get rules from url: %w", err)}
+	}
+	s.status.fetched(s.headers)
+	s.metrics.rulesBytes.Set(float64(len(payload)))
+	if s.recorder != nil {
+		if err := s.recorder.record(payload, hash, contentType, time.Now()); err != nil {
+			warnf("%s%v", s.logPrefix(), err)
+		}
+	}
+
+	rgs, content, err := s.validate(ctx, payload, contentType)
+	if err != nil {
+		return &stageError{stage: stageValidate, err: fmt.Errorf("failed to validate rules: %w", err)}
+	}
+	if s.crossCheck != nil && s.crossCheck.due(time.Now()) {
+		s.crossCheckRules(ctx, rgs)
+	}
+	if rgs, content, err = s.transformRules(rgs, content, false); err != nil {
+		return err
+	}
+	s.metrics.observeRuleGroups(rgs)
+	converted := content != nil
+	if !converted {
+		content = payload
+	}
+
+	var relabelConfig []byte
+	if s.alertRelabel != nil {
+		fctx, cancel := withStageTimeout(ctx, s.timeouts.fetch)
+		relabelConfig, err = s.alertRelabel.fetch(fctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	files, err := s.output.render(rgs, content)
+	if err != nil {
+		return &stageError{stage: stageWrite, err: fmt.Errorf("failed to render rules files: %w", err)}
+	}
+	if err := s.checkTenantQuota(files, false); err != nil {
+		return err
+	}
+	if converted || s.output.layout == layoutPerTenant || s.output.resources != nil {
+		// What ends up on disk differs from the payload, so that is what we track.
+		hash = filesHash(files)
+	}
+	if s.rulerGlob != nil {
+		s.checkRulerGlob(files)
+	}
+
+	if hash != s.hash && s.rulerHealthCheck != healthCheckOff && s.output.resources == nil {
+		if err := s.checkRulers(ctx); err != nil {
+			if s.rulerHealthCheck == healthCheckDefer {
+				return &stageError{stage: stageWrite, code: codeUnhealthy, err: fmt.Errorf("deferring the write of changed rules: %w", err)}
+			}
+			warnf("%swriting changed rules although Thanos Ruler is not healthy: %v", s.logPrefix(), err)
+		}
+	}
+
+	if err := s.write(ctx, files); err != nil {
+		return &stageError{stage: stageWrite, err: err}
+	}
+	s.status.wrote(hash, files)
+	if s.alertRelabel != nil {
+		wctx, cancel := withStageTimeout(ctx, s.timeouts.write)
+		err := s.alertRelabel.write(wctx, relabelConfig)
+		cancel()
+		if err != nil {
+			return &stageError{stage: stageWrite, err: err}
+		}
+	}
+
+	// The Prometheus Operator reloads the rulers picking up PrometheusRule resources.
+	if s.output.resources == nil {
+		if err := s.reload(ctx); err != nil {
+			return &stageError{stage: stageReload, err: fmt.Errorf("failed to trigger thanos rule reload: %w", err)}
+		}
+	}
+
+	delta := s.recordChange(ctx, hash, filesGroupHashes(files), s.headers)
+	s.observeTenantChanges(files, time.Now())
+	s.observeTenantBytes(files)
+	s.status.succeeded(time.Now(), hash, files, s.tenant, delta)
+	if s.runbooks != nil {
+		s.runbooks.submit(s.runbookLinks(files))
+	}
+
+	return nil
+}
+
+// transformRules applies to the validated rules what the syncer does before writing them: the tenant label,
+// the selection of the tenants and shard, the overlay and the transformers.
+// It returns the rules and the content to write, which is nil if the payload is written as is. A preview leaves the state of the transformers as is.
+func (s *syncer) transformRules(rgs *ruleGroups, content []byte, preview bool) (*ruleGroups, []byte, error) {
+	// The raw rules of the Observatorium API lack the tenant label the rendered ones carry.
+	injected := s.injectTenantLabel && injectTenantLabel(rgs, s.output.tenantLabel, s.tenant)
+	selected, dropped := s.selectRules(rgs)
+	if dropped > 0 {
+		debugf("%sdropped %d rules that are not synced by this instance", s.logPrefix(), dropped)
+	}
+	rgs = selected
+	merged := false
+	if s.overlay != nil {
+		var err error
+		// The rules are refused rather than synced without the overlay.
+		if merged, err = s.overlay.merge(rgs); err != nil {
+			return nil, nil, &stageError{stage: stageValidate, code: codeInvalid, err: err}
+		}
+	}
+	transformed, err := transform(rgs, s.transformers, preview)
+	if err != nil {
+		return nil, nil, &stageError{stage: stageValidate, code: codeInvalid, err: fmt.Errorf("failed to transform rules: %w", err)}
+	}
+	if dropped > 0 || transformed || injected || merged {
+		if content, err = yaml.Marshal(rgs); err != nil {
+			return nil, nil, &stageError{stage: stageValidate, err: fmt.Errorf("failed to marshal filtered or transformed rules: %w", err)}
+		}
+	}
+
+	return rgs, content, nil
+}
+
+// selectRules drops the rules of tenants filtered out or owned by another shard.
+// It returns the number of dropped rules.
+func (s *syncer) selectRules(rgs *ruleGroups) (*ruleGroups, int) {
+	rgs, droppedByFilter := s.tenants.filter(rgs, s.output.tenantLabel)
+	rgs, droppedByShard := s.shard.filter(rgs, s.output.tenantLabel)
+
+	return rgs, droppedByFilter + droppedByShard
+}
+
+// recordChange remembers the rules that were just applied and emits an event, a notification and an audit record if they changed,
+// the record carrying the captured headers of the response the rules came with. It returns the groups that changed.
+func (s *syncer) recordChange(ctx context.Context, hash string, groups map[string]string, headers map[string]string) groupDelta {
+	oldHash, oldGroups := s.hash, s.groups
+	s.hash, s.groups = hash, groups
+	delta := diffGroups(oldGroups, groups)
+	if hash == oldHash {
+		return delta
+	}
+
+	change := rulesChange{
+		Tenant:  s.tenant,
+		OldHash: oldHash,
+		NewHash: hash,
+		Groups:  delta,
+	}
+	if s.events != nil {
+		if err := s.events.emitRulesChanged(ctx, change); err != nil {
+			warnf("%sfailed to emit rules changed event: %v", s.logPrefix(), err)
+		}
+	}
+	if s.notifier != nil {
+		s.notifier.rulesChanged(ctx, change)
+	}
+	if s.audit != nil {
+		record := auditRecord{
+			Time:     time.Now().UTC(),
+			Pipeline: s.pipeline,
+			Tenant:   s.tenant,
+			OldHash:  oldHash,
+			NewHash:  hash,
+			Groups:   delta,
+			Source:   s.source,
+			Headers:  headers,
+		}
+		if err := s.audit.record(record); err != nil {
+			errorf("%sfailed to audit the applied change: %v", s.logPrefix(), err)
+		}
+	}
+
+	return delta
+}
+
+// fetch returns the rules payload, its hash and its content type, keeping the captured headers of the response for the cycle.
+func (s *syncer) fetch(ctx context.Context) ([]byte, string, string, error) {
+	if err := s.chaos.fetch(); err != nil {
+		return nil, "", "", err
+	}
+	payload, hash, contentType, header, err := s.fetchPayload(ctx)
+	if err != nil {
+		return nil, "", "", err
+	}
+	s.headers = capturedHeaders(header, s.captureHeaders)
+
+	return payload, hash, contentType, nil
+}
+
+// fetchPayload fetches the rules like fetch without the chaos and without keeping the headers, e.g. for a preview,
+// which may run concurrently with a cycle. It returns the headers of the response.
+func (s *syncer) fetchPayload(ctx context.Context) ([]byte, string, string, http.Header, error) {
+	// Waiting for a slot is not bounded by the fetch deadline, so that slow pipelines delay the others without failing them.
+	if err := s.fetchSlots.acquire(ctx); err != nil {
+		return nil, "", "", nil, err
+	}
+	defer s.fetchSlots.release()
+
+	ctx, cancel := withStageTimeout(ctx, s.timeouts.fetch)
+	defer cancel()
+
+	rules, err := s.fetcher.getRules(ctx)
+	if err != nil {
+		return nil, "", "", nil, err
+	}
+	defer rules.body.Close()
+
+	// The hash is computed while the response is read, so the payload is not read a second time.
+	h := sha256.New()
+	content, err := io.ReadAll(io.TeeReader(rules.body, h))
+	if err != nil {
+		return nil, "", "", nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	debugf("%sfetched %d bytes of rules of content type %q", s.logPrefix(), len(content), rules.contentType)
+
+	if isBundle(content, rules.contentType) {
+		unpacked, files, err := unpackBundle(content, s.bundleMode, s.output.tenantLabel)
+		if err != nil {
+			return nil, "", "", nil, err
+		}
+		debugf("%sunpacked %d rules files from a bundle of %d bytes", s.logPrefix(), files, len(content))
+		// The hash is that of the rules rather than of the archive, which changes with the times of its files.
+		sum := sha256.Sum256(unpacked)
+		return unpacked, hex.EncodeToString(sum[:]), "application/yaml", rules.header, nil
+	}
+
+	return content, hex.EncodeToString(h.Sum(nil)), rules.contentType, rules.header, nil
+}
+
+// validate parses and validates the payload.
+// It returns the rule groups and the content to write, which is nil if the payload is written as is.
+func (s *syncer) validate(ctx context.Context, payload []byte, contentType string) (*ruleGroups, []byte, error) {
+	return s.validatePayload(ctx, payload, contentType, false)
+}
+
+// validatePayload validates the payload like validate. A preview neither records the rejections nor logs or counts the dropped groups,
+// as the payload is not synced, nor runs the preflight.
+func (s *syncer) validatePayload(ctx context.Context, payload []byte, contentType string, preview bool) (*ruleGroups, []byte, error) {
+	ctx, cancel := withStageTimeout(ctx, s.timeouts.validate)
+	defer cancel()
+
+	if s.jsonnet != nil {
+		evaluated, err := s.jsonnet.evaluate(ctx, payload)
+		if err != nil {
+			return nil, nil, &stageError{stage: stageValidate, code: codeParse, err: err}
+		}
+		// The evaluated JSON is converted to YAML like a JSON payload.
+		payload, contentType = evaluated, "application/json"
+	}
+	included := false
+	if s.includes != nil {
+		resolved, ok, err := s.includes.resolve(ctx, payload)
+		if err != nil {
+			if !preview {
+				s.rejections.set(time.Now(), []ruleRejection{{Tenant: s.tenant, Index: -1, Reason: err.Error()}})
+			}
+			return nil, nil, &stageError{stage: stageValidate, code: codeParse, err: err}
+		}
+		if ok {
+			payload, contentType, included = resolved, "application/yaml", true
+		}
+	}
+
+	rgs, content, err := decodeRuleGroups(payload, contentType)
+	if err != nil {
+		if !preview {
+			s.rejections.set(time.Now(), []ruleRejection{{Tenant: s.tenant, Index: -1, Reason: err.Error()}})
+		}
+		return nil, nil, &stageError{stage: stageValidate, code: codeParse, err: err}
+	}
+	// The fetched payload holds the includes rather than the rules they resolve to.
+	if included && content == nil {
+		if content, err = yaml.Marshal(rgs); err != nil {
+			return nil, nil, &stageError{stage: stageValidate, err: fmt.Errorf("failed to marshal the rules with their includes: %w", err)}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rejected := s.rejectedGroups(rgs)
+	if s.preflight != nil && !preview {
+		s.preflightRules(ctx, rgs, rejected)
+	}
+	if !preview {
+		s.rejections.set(time.Now(), flattenRejections(rgs, rejected))
+	}
+	if len(rejected) > 0 {
+		if s.validatePolicy != validateDropInvalid {
+			return nil, nil, &stageError{stage: stageValidate, code: codeInvalid, err: fmt.Errorf("invalid rules: %s", joinRejections(rgs, rejected))}
+		}
+		// The rules are still refused if all groups are invalid, as that is rather a broken payload than broken groups.
+		if len(rejected) == len(rgs.Groups) {
+			return nil, nil, &stageError{stage: stageValidate, code: codeInvalid, err: fmt.Errorf("all %d groups are invalid: %s", len(rgs.Groups), joinRejections(rgs, rejected))}
+		}
+		if !preview {
+			s.logInvalidGroups(rgs, rejected)
+		}
+		dropGroups(rgs, rejected)
+		// The payload no longer matches the rules, which are encoded again.
+		if content, err = yaml.Marshal(rgs); err != nil {
+			return nil, nil, &stageError{stage: stageValidate, err: fmt.Errorf("failed to marshal the valid rules: %w", err)}
+		}
+	}
+	if s.templatePolicy == templatesWarn && !preview {
+		for _, r := range rgs.validateTemplates() {
+			warnf("%s%s", s.logPrefix(), r)
+		}
+	}
+	debugf("%svalidated %d rule groups", s.logPrefix(), len(rgs.Groups))
+
+	return rgs, content, nil
+}
+
+// logInvalidGroups logs and counts the groups dropped with -validate.policy=drop-invalid.
+func (s *syncer) logInvalidGroups(rgs *ruleGroups, rejected map[int][]ruleRejection) {
+	for i, g := range rgs.Groups {
+		if rejections, ok := rejected[i]; ok {
+			reasons := make([]string, 0, len(rejections))
+			for _, r := range rejections {
+				reasons = append(reasons, r.String())
+			}
+			warnf("%sdropping the invalid group %q: %s", s.logPrefix(), g.Name, strings.Join(reasons, "; "))
+		}
+	}
+	s.metrics.invalidGroupsDropped.Add(float64(len(rejected)))
+}
+
+// dropGroups drops the rejected groups.
+func dropGroups(rgs *ruleGroups, rejected map[int][]ruleRejection) {
+	valid := make([]ruleGroup, 0, len(rgs.Groups)-len(rejected))
+	for i, g := range rgs.Groups {
+		if _, ok := rejected[i]; !ok {
+			valid = append(valid, g)
+		}
+	}
+	rgs.Groups = valid
+}
+
+func (s *syncer) write(ctx context.Context, files []ruleFile) error {
+	ctx, cancel := withStageTimeout(ctx, s.timeouts.write)
+	defer cancel()
+
+	if err := s.chaos.write(ctx); err != nil {
+		return err
+	}
+	// The existing rules files are left untouched rather than truncated by a full disk.
+	if err := s.output.checkSpace(files); err != nil {
+		s.metrics.diskFull.Set(1)
+		return err
+	}
+	s.metrics.diskFull.Set(0)
+
+	return s.output.write(ctx, files)
+}
+
+// checkRulers checks the health of the Rulers, so that they do not start with half of a rollout of rules.
+func (s *syncer) checkRulers(ctx context.Context) error {
+	ctx, cancel := withStageTimeout(ctx, s.timeouts.reload)
+	defer cancel()
+
+	if err := s.reloader.checkHealth(ctx); err != nil {
+		return fmt.Errorf("thanos rule is not healthy: %w", err)
+	}
+
+	return nil
+}
+
+func (s *syncer) reload(ctx context.Context) error {
+	ctx, cancel := withStageTimeout(ctx, s.timeouts.reload)
+	defer cancel()
+
+	if err := s.chaos.reload(); err != nil {
+		return err
+	}
+	results, err := s.reloader.reload(ctx)
+	s.status.reloaded(time.Now(), results, err)
+	if err != nil {
+		return err
+	}
+	debugf("%sreloaded %d Thanos Rulers", s.logPrefix(), len(results))
+
+	return nil
+}
+
+// withStageTimeout derives the context of a stage from the context of the cycle.
+func withStageTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
+}
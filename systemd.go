@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotifySocketEnv is set by systemd for services of Type=notify, see sd_notify(3).
+const sdNotifySocketEnv = "NOTIFY_SOCKET"
+
+// sdNotify sends the state to systemd. A socket name starting with @ is in the abstract namespace, which net handles.
+func sdNotify(state string) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: os.Getenv(sdNotifySocketEnv), Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+
+	return nil
+}
+
+// sdWatchdogInterval returns the interval to ping the watchdog at, half its timeout as recommended by sd_watchdog_enabled(3),
+// and false if the watchdog is not enabled for this process.
+func sdWatchdogInterval() (time.Duration, bool) {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
+
+// runSystemdNotifier reports the syncers ready to systemd once started, so that a backend down at start does not fail
+// the start of the unit, and reports in the status when they finished their first sync cycle. It pings the watchdog
+// as long as none of them is stuck in a sync cycle, so that systemd restarts a stuck syncer.
+func runSystemdNotifier(ctx context.Context, syncers func() []*syncer) error {
+	if err := sdNotify("READY=1\nSTATUS=Waiting for the first sync cycle"); err != nil {
+		warnf("%v", err)
+	}
+	defer func() {
+		if err := sdNotify("STOPPING=1"); err != nil {
+			warnf("%v", err)
+		}
+	}()
+
+	synced := make(chan struct{})
+	go func(synced chan<- struct{}) {
+		for _, s := range syncers() {
+			select {
+			case <-s.synced:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(synced)
+	}(synced)
+
+	// The watchdog is not pinged if it is not enabled, its channel staying nil.
+	var tick <-chan time.Time
+	if interval, ok := sdWatchdogInterval(); ok {
+		infof("pinging the systemd watchdog every %s", interval)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-synced:
+			if err := sdNotify("STATUS=Syncing rules"); err != nil {
+				warnf("%v", err)
+			}
+			// A closed channel is always ready, the status is reported once.
+			synced = nil
+		case now := <-tick:
+			if s := stuckSyncer(syncers(), now); s != nil {
+				warnf("%snot pinging the systemd watchdog, a sync cycle is stuck", s.logPrefix())
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				warnf("%v", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func stuckSyncer(syncers []*syncer, now time.Time) *syncer {
+	for _, s := range syncers {
+		if s.stuck(now) {
+			return s
+		}
+	}
+
+	return nil
+}
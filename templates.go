@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Policies of -validate.templates.
+const (
+	templatesReject = "reject"
+	templatesWarn   = "warn"
+	templatesOff    = "off"
+)
+
+// templateHeader defines the variables Prometheus makes available to alert templates.
+const templateHeader = "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$externalURL := .ExternalURL}}{{$value := .Value}}"
+
+// templateFuncs are the functions Prometheus provides to alert templates. Templates are only parsed, never executed,
+// so the functions only need to exist, see https://prometheus.io/docs/prometheus/latest/configuration/template_reference/.
+var templateFuncs = func() template.FuncMap {
+	names := []string{
+		"query", "first", "label", "value", "strvalue", "args", "reReplaceAll", "safeHtml", "match", "title", "toUpper", "toLower",
+		"graphLink", "tableLink", "sortByLabel", "humanize", "humanize1024", "humanizeDuration", "humanizePercentage",
+		"humanizeTimestamp", "toTime", "pathPrefix", "externalURL", "parseDuration", "stripPort", "stripDomain", "toDuration", "now",
+	}
+	funcs := make(template.FuncMap, len(names))
+	for _, name := range names {
+		funcs[name] = func(...interface{}) interface{} { return nil }
+	}
+
+	return funcs
+}()
+
+// checkTemplate parses a label or annotation value as Prometheus would when an alert fires.
+func checkTemplate(name, text string) error {
+	if !strings.Contains(text, "{{") {
+		return nil
+	}
+
+	_, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(templateHeader + text)
+
+	return err //nolint:wrapcheck
+}
+
+// validateTemplates checks the templates in the labels and annotations of all alerting rules.
+func (rgs *ruleGroups) validateTemplates() []ruleRejection {
+	var rejected []ruleRejection
+	for _, g := range rgs.Groups {
+		rejected = append(rejected, g.templateErrors()...)
+	}
+
+	return rejected
+}
+
+// templateErrors checks the templates in the labels and annotations of the alerting rules of the group.
+func (g ruleGroup) templateErrors() []ruleRejection {
+	var rejected []ruleRejection
+	for i, r := range g.Rules {
+		if r.Alert == "" {
+			continue
+		}
+		for _, kind := range []struct {
+			name   string
+			values map[string]string
+		}{{"label", r.Labels}, {"annotation", r.Annotations}} {
+			keys := make([]string, 0, len(kind.values))
+			for k := range kind.values {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if err := checkTemplate(k, kind.values[k]); err != nil {
+					rejected = append(rejected, newRuleRejection(g, i, fmt.Sprintf("invalid template in %s %q: %v", kind.name, k, err)))
+				}
+			}
+		}
+	}
+
+	return rejected
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tenantMatcher matches a tenant either exactly or, if given with a ~ prefix, by an anchored regular expression.
+type tenantMatcher struct {
+	exact string
+	re    *regexp.Regexp
+}
+
+func newTenantMatcher(s string) (tenantMatcher, error) {
+	if !strings.HasPrefix(s, "~") {
+		return tenantMatcher{exact: s}, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + strings.TrimPrefix(s, "~") + ")$")
+	if err != nil {
+		return tenantMatcher{}, fmt.Errorf("invalid tenant regex %q: %w", s, err)
+	}
+
+	return tenantMatcher{re: re}, nil
+}
+
+func (m tenantMatcher) matches(tenant string) bool {
+	if m.re != nil {
+		return m.re.MatchString(tenant)
+	}
+
+	return m.exact == tenant
+}
+
+func (m tenantMatcher) String() string {
+	if m.re != nil {
+		return "~" + strings.TrimSuffix(strings.TrimPrefix(m.re.String(), "^(?:"), ")$")
+	}
+
+	return m.exact
+}
+
+// tenantMatchers is a flag.Value collecting matchers given as a comma-separated list or by repeating the flag.
+type tenantMatchers []tenantMatcher
+
+func (ms *tenantMatchers) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		m, err := newTenantMatcher(v)
+		if err != nil {
+			return err
+		}
+		*ms = append(*ms, m)
+	}
+
+	return nil
+}
+
+func (ms *tenantMatchers) String() string {
+	s := make([]string, 0, len(*ms))
+	for _, m := range *ms {
+		s = append(s, m.String())
+	}
+
+	return strings.Join(s, ",")
+}
+
+func (ms tenantMatchers) matches(tenant string) bool {
+	for _, m := range ms {
+		if m.matches(tenant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tenantFilter decides which tenants' rules are synced.
+// A tenant is synced if it matches the allowlist, or the allowlist is empty, and does not match the denylist.
+type tenantFilter struct {
+	allow tenantMatchers
+	deny  tenantMatchers
+}
+
+func (f tenantFilter) enabled() bool {
+	return len(f.allow) > 0 || len(f.deny) > 0
+}
+
+func (f tenantFilter) allowed(tenant string) bool {
+	if len(f.allow) > 0 && !f.allow.matches(tenant) {
+		return false
+	}
+
+	return !f.deny.matches(tenant)
+}
+
+// filter drops the rules of tenants that are not allowed, identifying the tenant of a rule by the given label.
+// Groups left without rules are dropped as well. It returns the number of dropped rules.
+func (f tenantFilter) filter(rgs *ruleGroups, tenantLabel string) (*ruleGroups, int) {
+	if !f.enabled() {
+		return rgs, 0
+	}
+
+	filtered := &ruleGroups{Groups: make([]ruleGroup, 0, len(rgs.Groups))}
+	dropped := 0
+	for _, g := range rgs.Groups {
+		rules := make([]rule, 0, len(g.Rules))
+		for _, r := range g.Rules {
+			if f.allowed(r.Labels[tenantLabel]) {
+				rules = append(rules, r)
+			} else {
+				dropped++
+			}
+		}
+		if len(rules) == 0 && len(g.Rules) > 0 {
+			continue
+		}
+		g.Rules = rules
+		filtered.Groups = append(filtered.Groups, g)
+	}
+
+	return filtered, dropped
+}
+
+// injectTenantLabel sets the tenant label of every rule to the tenant, as the Observatorium API does when rendering the rules of a tenant.
+// A rule claiming another tenant is overridden. It tells whether any rule changed.
+func injectTenantLabel(rgs *ruleGroups, tenantLabel, tenant string) bool {
+	changed := false
+	for gi := range rgs.Groups {
+		for ri := range rgs.Groups[gi].Rules {
+			r := &rgs.Groups[gi].Rules[ri]
+			if v, ok := r.Labels[tenantLabel]; ok && v == tenant {
+				continue
+			}
+			if r.Labels == nil {
+				r.Labels = make(map[string]string, 1)
+			}
+			r.Labels[tenantLabel] = tenant
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// tenantLabelRewriter replaces the values of the tenant label of the rules, e.g. tenant IDs injected by the Observatorium API by friendly names.
+// It runs after the tenants are selected, so that filters and shards keep matching the values as fetched.
+type tenantLabelRewriter struct {
+	label   string
+	rewrite map[string]string
+}
+
+// validateTenantRewrite rejects rewrites merging tenants, whose rules would then be mistaken for one another's.
+func validateTenantRewrite(rewrite map[string]string) error {
+	olds := make([]string, 0, len(rewrite))
+	for old := range rewrite {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+
+	from := make(map[string]string, len(rewrite))
+	for _, old := range olds {
+		tenant := rewrite[old]
+		if tenant == "" {
+			return fmt.Errorf("invalid -tenant-label.rewrite of %s, the new value must not be empty", old)
+		}
+		if other, ok := from[tenant]; ok {
+			return fmt.Errorf("invalid -tenant-label.rewrite, both %s and %s are rewritten to %s", other, old, tenant)
+		}
+		from[tenant] = old
+	}
+
+	return nil
+}
+
+func (t tenantLabelRewriter) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	for gi := range rgs.Groups {
+		for ri := range rgs.Groups[gi].Rules {
+			r := &rgs.Groups[gi].Rules[ri]
+			tenant, ok := t.rewrite[r.Labels[t.label]]
+			if !ok {
+				continue
+			}
+			// The labels may be shared with a copy of the rule.
+			labels := make(map[string]string, len(r.Labels))
+			for k, v := range r.Labels {
+				labels[k] = v
+			}
+			labels[t.label] = tenant
+			r.Labels = labels
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// tenantNamePrefixer prefixes the names of alerts and groups with their tenant, e.g. tenantA_HighLatency,
+// so that the alerts of tenants sharing a Ruler do not collide in Alertmanager.
+// A group holding rules of several tenants keeps its name, and names already carrying the prefix are left untouched.
+type tenantNamePrefixer struct {
+	label string
+}
+
+func (p tenantNamePrefixer) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	for gi := range rgs.Groups {
+		g := &rgs.Groups[gi]
+		groupTenant, shared := "", true
+		for ri := range g.Rules {
+			r := &g.Rules[ri]
+			tenant := r.Labels[p.label]
+			if ri == 0 {
+				groupTenant = tenant
+			} else if tenant != groupTenant {
+				shared = false
+			}
+			if tenant == "" || r.Alert == "" {
+				continue
+			}
+			if prefixed, ok := tenantPrefixed(tenant, r.Alert); ok {
+				r.Alert = prefixed
+				changed = true
+			}
+		}
+
+		if !shared || groupTenant == "" {
+			continue
+		}
+		if prefixed, ok := tenantPrefixed(groupTenant, g.Name); ok {
+			g.Name = prefixed
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// tenantPrefixed prefixes the name with the tenant, turned into a valid part of an alert name. It is false if the name already has the prefix.
+func tenantPrefixed(tenant, name string) (string, bool) {
+	prefix := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, tenant) + "_"
+	if strings.HasPrefix(name, prefix) {
+		return name, false
+	}
+
+	return prefix + name, true
+}
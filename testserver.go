@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// testRulesPath is the path of the rules of the rules backend API, followed by /<tenant> for the rules of a single tenant.
+const testRulesPath = "/api/v1/rules"
+
+// runTestserver serves rules over the rules backend API from memory, for end-to-end tests of the syncer and Thanos Ruler
+// without an Observatorium deployment. The payload is replaced with a PUT of the rules, and responses can be delayed or failed.
+func runTestserver(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("testserver", flag.ExitOnError)
+	address := fs.String("listen", ":8080", "The address to listen on, a unix:///path/to.sock address included.")
+	rulesFile := fs.String("rules.file", "", "A rules file served until a PUT of "+testRulesPath+" replaces the rules. If empty, no rules are served.")
+	tenantLabel := fs.String("tenant-label", "tenant_id", "The label identifying the tenant of a rule, to serve the rules of a tenant on "+testRulesPath+"/<tenant>.")
+	latency := fs.Duration("latency", 0, "The delay of every response.")
+	failureRate := fs.Float64("failure-rate", 0, "The share of requests for rules that fail, between 0 and 1.")
+	failureStatus := fs.Int("failure-status", http.StatusServiceUnavailable, "The status of failed requests.")
+	_ = fs.Parse(args)
+
+	if *failureRate < 0 || *failureRate > 1 {
+		return fmt.Errorf("invalid -failure-rate %v, must be between 0 and 1", *failureRate)
+	}
+	if *failureStatus < 400 || *failureStatus > 599 {
+		return fmt.Errorf("invalid -failure-status %d, must be an error status", *failureStatus)
+	}
+
+	s := &testServer{
+		tenantLabel:   *tenantLabel,
+		latency:       *latency,
+		failureRate:   *failureRate,
+		failureStatus: *failureStatus,
+		payload:       []byte("groups: []\n"),
+	}
+	if *rulesFile != "" {
+		b, err := os.ReadFile(*rulesFile)
+		if err != nil {
+			return fmt.Errorf("failed to read -rules.file: %w", err)
+		}
+		if _, _, err := parseRuleGroups(b); err != nil {
+			return fmt.Errorf("invalid -rules.file: %w", err)
+		}
+		s.payload = b
+	}
+
+	l, err := listen(*address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", *address, err)
+	}
+	fmt.Fprintf(stdout, "serving rules at %s%s\n", *address, testRulesPath)
+
+	m := http.NewServeMux()
+	m.HandleFunc(testRulesPath, s.handler)
+	m.HandleFunc(testRulesPath+"/", s.handler)
+
+	return http.Serve(l, m) //nolint:wrapcheck
+}
+
+// testServer is the in-memory rules backend of the testserver subcommand.
+type testServer struct {
+	tenantLabel   string
+	latency       time.Duration
+	failureRate   float64
+	failureStatus int
+
+	mu      sync.RWMutex
+	payload []byte
+}
+
+func (s *testServer) handler(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.latency)
+	tenant := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, testRulesPath), "/")
+
+	switch {
+	case r.Method == http.MethodPut && tenant == "":
+		s.put(w, r)
+	case r.Method == http.MethodGet:
+		if s.failureRate > 0 && rand.Float64() < s.failureRate { //nolint:gosec
+			debugf("failing %s %s with %d", r.Method, r.URL.Path, s.failureStatus)
+			http.Error(w, "injected failure", s.failureStatus)
+			return
+		}
+		s.get(w, r, tenant)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// get serves the rules, or those of a tenant, with an ETag, answering 304 if they did not change.
+func (s *testServer) get(w http.ResponseWriter, r *http.Request, tenant string) {
+	s.mu.RLock()
+	content := s.payload
+	s.mu.RUnlock()
+
+	if tenant != "" {
+		rgs, _, err := parseRuleGroups(content)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if content, err = tenantRules(rgs, tenant, s.tenantLabel, testRulesPath); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	sum := sha256.Sum256(content)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(content)
+}
+
+// put replaces the served rules.
+func (s *testServer) put(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, err := parseRuleGroups(b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.payload = b
+	s.mu.Unlock()
+	infof("replaced the rules with %d bytes", len(b))
+	w.WriteHeader(http.StatusNoContent)
+}
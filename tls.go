@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientTLSFiles are the files the TLS configuration of the Observatorium client is read from.
+type clientTLSFiles struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	// caDir holds CA bundles trusted in addition to -observatorium-ca if given, or else to the system certificates,
+	// see -observatorium-ca-dir.
+	caDir string
+	// The references take the place of the files if set, see -observatorium-ca-ref.
+	caRef, certRef, keyRef *secretRef
+	secrets                *kubeSecrets
+}
+
+func (f clientTLSFiles) enabled() bool {
+	return f.caFile != "" || f.caDir != "" || f.certFile != "" || f.caRef != nil || f.certRef != nil
+}
+
+// read returns the content of the file, or of the key of the Secret if referenced.
+func (f clientTLSFiles) read(path string, ref *secretRef) ([]byte, error) {
+	if ref != nil {
+		return f.secrets.get(*ref)
+	}
+
+	return os.ReadFile(path)
+}
+
+// load reads the files into a TLS configuration. It also returns the hash of their content.
+func (f clientTLSFiles) load() (*tls.Config, string, error) {
+	h := sha256.New()
+	//nolint:exhaustivestruct
+	cfg := &tls.Config{}
+
+	if f.caFile != "" || f.caRef != nil {
+		ca, err := f.read(f.caFile, f.caRef)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read Observatorium CA file: %w", err)
+		}
+		h.Write(ca)
+
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(ca) {
+			return nil, "", fmt.Errorf("no certificate found in the Observatorium CA")
+		}
+		cfg.RootCAs = certPool
+	}
+
+	if f.caDir != "" {
+		pool, err := f.loadCADir(h, cfg.RootCAs)
+		if err != nil {
+			return nil, "", err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if f.certFile != "" || f.certRef != nil {
+		cert, err := f.read(f.certFile, f.certRef)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		key, err := f.read(f.keyFile, f.keyRef)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read client key: %w", err)
+		}
+		h.Write(cert)
+		h.Write(key)
+
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	return cfg, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadCADir returns the certificates of the pool and those of the files in the CA directory, or the system roots instead of
+// the pool if there is none, as a CA file pins the CAs trusted for the Observatorium API. Hidden files are skipped, like
+// the ..data directories of Kubernetes volumes whose files are linked from the directory, and so are files without
+// certificates, e.g. a README of the bundle.
+func (f clientTLSFiles) loadCADir(h hash.Hash, pool *x509.CertPool) (*x509.CertPool, error) {
+	entries, err := os.ReadDir(f.caDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the Observatorium CA directory: %w", err)
+	}
+
+	var roots *x509.CertPool
+	if pool != nil {
+		// The pool does not expose its certificates, so the CA file is added again.
+		ca, err := f.read(f.caFile, f.caRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Observatorium CA file: %w", err)
+		}
+		roots = x509.NewCertPool()
+		roots.AppendCertsFromPEM(ca)
+	} else if roots, err = x509.SystemCertPool(); err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	found := 0
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(f.caDir, e.Name())
+		// Stat follows the symlinks the files of Kubernetes volumes are.
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the Observatorium CA bundle %s: %w", path, err)
+		}
+		if roots.AppendCertsFromPEM(pem) {
+			found++
+			h.Write([]byte(e.Name()))
+			h.Write(pem)
+		}
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("no certificate found in the Observatorium CA directory %s", f.caDir)
+	}
+
+	return roots, nil
+}
+
+// reloadingTransport is an http.RoundTripper trusting the CA and presenting the client certificate read from files.
+// The underlying transport is rebuilt whenever the content of the files changes,
+// so that rotated certificates are picked up without a restart.
+type reloadingTransport struct {
+	base  *http.Transport
+	files clientTLSFiles
+
+	mu      sync.RWMutex
+	current *http.Transport
+	hash    string
+}
+
+func newReloadingTransport(base *http.Transport, files clientTLSFiles) (*reloadingTransport, error) {
+	t := &reloadingTransport{base: base, files: files}
+	if _, err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// reload rebuilds the transport if the files changed and tells whether they did.
+func (t *reloadingTransport) reload() (bool, error) {
+	cfg, hash, err := t.files.load()
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.Lock()
+	if hash == t.hash {
+		t.mu.Unlock()
+		return false, nil
+	}
+	old := t.current
+	t.current = t.base.Clone()
+	if b := t.base.TLSClientConfig; b != nil {
+		cfg.MinVersion, cfg.CipherSuites, cfg.VerifyConnection = b.MinVersion, b.CipherSuites, b.VerifyConnection
+	}
+	t.current.TLSClientConfig = cfg
+	t.hash = hash
+	t.mu.Unlock()
+
+	if old != nil {
+		// Connections established with the old certificates are not reused.
+		old.CloseIdleConnections()
+	}
+
+	return true, nil
+}
+
+// watch checks the files for changes every interval, 0 disabling the checks, and whenever changed fires, until the context is done.
+func (t *reloadingTransport) watch(ctx context.Context, interval time.Duration, changed <-chan struct{}) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+
+		reloaded, err := t.reload()
+		if err != nil {
+			warnf("failed to reload TLS files, keeping the previous ones: %v", err)
+			continue
+		}
+		if reloaded {
+			infof("reloaded changed TLS files of the Observatorium client")
+		}
+	}
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	current := t.current
+	t.mu.RUnlock()
+
+	return current.RoundTrip(req) //nolint:wrapcheck
+}
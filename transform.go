@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// transformer modifies the rule groups at sync time. It reports whether it changed anything.
+type transformer interface {
+	transform(rgs *ruleGroups) (bool, error)
+}
+
+// previewer is implemented by the transformers keeping state between the cycles, e.g. the times they first saw the rules,
+// or reporting about the rules, e.g. with metrics or warnings. preview transforms the rules like transform without changing
+// the state nor reporting, as the rules of a preview are not synced.
+type previewer interface {
+	preview(rgs *ruleGroups) (bool, error)
+}
+
+// transform applies the transformers in order and tells whether any of them changed the rule groups.
+func transform(rgs *ruleGroups, transformers []transformer, preview bool) (bool, error) {
+	changed := false
+	for _, t := range transformers {
+		var (
+			c   bool
+			err error
+		)
+		if p, ok := t.(previewer); ok && preview {
+			c, err = p.preview(rgs)
+		} else {
+			c, err = t.transform(rgs)
+		}
+		if err != nil {
+			return false, err
+		}
+		changed = changed || c
+	}
+
+	return changed, nil
+}
+
+// sourceLinkData is the data the template of a source link is executed with.
+type sourceLinkData struct {
+	Group  string
+	Alert  string
+	Record string
+	Expr   string
+	Tenant string
+	Labels map[string]string
+}
+
+// sourceLinkAnnotator adds an annotation linking to the source of every alert, e.g. a Thanos Query or Grafana page with the expression filled in.
+// Alerts already carrying the annotation are left untouched.
+type sourceLinkAnnotator struct {
+	annotation  string
+	tmpl        *template.Template
+	tenantLabel string
+}
+
+func newSourceLinkAnnotator(annotation, urlTemplate, tenantLabel string) (*sourceLinkAnnotator, error) {
+	tmpl, err := template.New(annotation).Option("missingkey=zero").Parse(urlTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse source link template: %w", err)
+	}
+
+	return &sourceLinkAnnotator{annotation: annotation, tmpl: tmpl, tenantLabel: tenantLabel}, nil
+}
+
+func (a *sourceLinkAnnotator) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	for gi := range rgs.Groups {
+		g := &rgs.Groups[gi]
+		for ri := range g.Rules {
+			r := &g.Rules[ri]
+			if r.Alert == "" {
+				continue
+			}
+			if _, ok := r.Annotations[a.annotation]; ok {
+				continue
+			}
+
+			var buf bytes.Buffer
+			if err := a.tmpl.Execute(&buf, sourceLinkData{
+				Group:  g.Name,
+				Alert:  r.Alert,
+				Expr:   r.Expr,
+				Tenant: r.Labels[a.tenantLabel],
+				Labels: r.Labels,
+			}); err != nil {
+				return false, fmt.Errorf("failed to render %s annotation of alert %s in group %s: %w", a.annotation, r.Alert, g.Name, err)
+			}
+			if r.Annotations == nil {
+				r.Annotations = make(map[string]string, 1)
+			}
+			r.Annotations[a.annotation] = buf.String()
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// partialResponseKey is the Thanos specific field of a group telling how queries handle partial responses of Store APIs.
+const partialResponseKey = "partial_response_strategy"
+
+// Modes of -groups.partial-response-strategy-mode.
+const (
+	partialResponseDefault = "default"
+	partialResponseForce   = "force"
+)
+
+// partialResponseSetter sets the partial response strategy of groups lacking one or, if forced, of every group.
+type partialResponseSetter struct {
+	strategy string
+	force    bool
+}
+
+func (p partialResponseSetter) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	for i := range rgs.Groups {
+		g := &rgs.Groups[i]
+		current, ok := g.Extra[partialResponseKey]
+		if ok && (!p.force || current == p.strategy) {
+			continue
+		}
+
+		// Groups split by -limits.max-rules-per-group share their fields, so they are copied rather than modified.
+		extra := make(map[string]interface{}, len(g.Extra)+1)
+		for k, v := range g.Extra {
+			extra[k] = v
+		}
+		extra[partialResponseKey] = p.strategy
+		g.Extra = extra
+		changed = true
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// Types of the transformers of the transformers list of a pipeline.
+const (
+	transformInjectLabels = "inject-labels"
+	transformRelabel      = "relabel"
+	transformFilter       = "filter"
+	transformPrefix       = "prefix"
+	transformTemplate     = "template"
+	transformPolicy       = "policy"
+)
+
+// Actions of the filter transformer.
+const (
+	filterKeep = "keep"
+	filterDrop = "drop"
+)
+
+// Actions of the policy transformer.
+const (
+	policyReject = "reject"
+	policyDrop   = "drop"
+	policyWarn   = "warn"
+)
+
+// Kinds of rules the filter transformer matches.
+const (
+	kindAlerting  = "alerting"
+	kindRecording = "recording"
+)
+
+// transformerSpec configures a transformer of the transformers list of a pipeline. Its parameters depend on its type.
+type transformerSpec struct {
+	Type   string                 `yaml:"type"`
+	Params map[string]interface{} `yaml:",inline"`
+}
+
+// buildTransformers returns the transformers of the list, in order.
+func buildTransformers(specs []transformerSpec, tenantLabel, logPrefix string) ([]transformer, error) {
+	transformers := make([]transformer, 0, len(specs))
+	for i, spec := range specs {
+		t, err := spec.build(tenantLabel, logPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("transformer %d (%s): %w", i, spec.Type, err)
+		}
+		transformers = append(transformers, t)
+	}
+
+	return transformers, nil
+}
+
+func (spec transformerSpec) build(tenantLabel, logPrefix string) (transformer, error) {
+	switch spec.Type {
+	case transformInjectLabels:
+		var p struct {
+			Labels   map[string]string `yaml:"labels"`
+			Override bool              `yaml:"override"`
+		}
+		if err := spec.params(&p); err != nil {
+			return nil, err
+		}
+		if len(p.Labels) == 0 {
+			return nil, fmt.Errorf("labels must be set")
+		}
+		for name := range p.Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("invalid label name %q", name)
+			}
+		}
+		return labelInjector{labels: p.Labels, override: p.Override}, nil
+	case transformRelabel:
+		var p struct {
+			Configs []*relabel.Config `yaml:"relabel_configs"`
+		}
+		if err := spec.params(&p); err != nil {
+			return nil, err
+		}
+		if len(p.Configs) == 0 {
+			return nil, fmt.Errorf("relabel_configs must be set")
+		}
+		return ruleRelabeler{configs: p.Configs}, nil
+	case transformFilter:
+		var p struct {
+			Action string            `yaml:"action"`
+			Groups string            `yaml:"groups"`
+			Kind   string            `yaml:"kind"`
+			Labels map[string]string `yaml:"labels"`
+		}
+		if err := spec.params(&p); err != nil {
+			return nil, err
+		}
+		return newRuleFilter(p.Action, p.Groups, p.Kind, p.Labels)
+	case transformPrefix:
+		var p ruleNamePrefixer
+		if err := spec.params(&p); err != nil {
+			return nil, err
+		}
+		if p.Group == "" && p.Alert == "" && p.Record == "" {
+			return nil, fmt.Errorf("one of group, alert or record must be set")
+		}
+		return p, nil
+	case transformTemplate:
+		var p struct {
+			Labels      map[string]string `yaml:"labels"`
+			Annotations map[string]string `yaml:"annotations"`
+			Override    bool              `yaml:"override"`
+		}
+		if err := spec.params(&p); err != nil {
+			return nil, err
+		}
+		return newRuleTemplater(p.Labels, p.Annotations, p.Override, tenantLabel)
+	case transformPolicy:
+		var p struct {
+			Action             string   `yaml:"action"`
+			RequireLabels      []string `yaml:"require_labels"`
+			RequireAnnotations []string `yaml:"require_annotations"`
+			ForbidLabels       []string `yaml:"forbid_labels"`
+		}
+		if err := spec.params(&p); err != nil {
+			return nil, err
+		}
+		switch p.Action {
+		case "":
+			p.Action = policyReject
+		case policyReject, policyDrop, policyWarn:
+		default:
+			return nil, fmt.Errorf("invalid action %q, must be one of %s, %s or %s", p.Action, policyReject, policyDrop, policyWarn)
+		}
+		if len(p.RequireLabels)+len(p.RequireAnnotations)+len(p.ForbidLabels) == 0 {
+			return nil, fmt.Errorf("one of require_labels, require_annotations or forbid_labels must be set")
+		}
+		return &rulePolicy{
+			action:             p.Action,
+			requireLabels:      p.RequireLabels,
+			requireAnnotations: p.RequireAnnotations,
+			forbidLabels:       p.ForbidLabels,
+			logPrefix:          logPrefix,
+		}, nil
+	case "":
+		return nil, fmt.Errorf("type must be set")
+	}
+
+	return nil, fmt.Errorf("unknown type, must be one of %s", strings.Join([]string{
+		transformInjectLabels, transformRelabel, transformFilter, transformPrefix, transformTemplate, transformPolicy,
+	}, ", "))
+}
+
+// params decodes the parameters of the transformer into p, refusing unknown ones.
+func (spec transformerSpec) params(p interface{}) error {
+	b, err := yaml.Marshal(spec.Params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal parameters: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(b, p); err != nil {
+		return fmt.Errorf("invalid parameters: %w", err)
+	}
+
+	return nil
+}
+
+// dropRules keeps the rules for which keep returns true. Groups left without rules are dropped as well.
+// It returns the number of dropped rules.
+func dropRules(rgs *ruleGroups, keep func(g *ruleGroup, r *rule) bool) int {
+	groups := make([]ruleGroup, 0, len(rgs.Groups))
+	dropped := 0
+	for _, g := range rgs.Groups {
+		rules := make([]rule, 0, len(g.Rules))
+		for ri := range g.Rules {
+			if keep(&g, &g.Rules[ri]) {
+				rules = append(rules, g.Rules[ri])
+			} else {
+				dropped++
+			}
+		}
+		if len(rules) == 0 && len(g.Rules) > 0 {
+			continue
+		}
+		g.Rules = rules
+		groups = append(groups, g)
+	}
+	rgs.Groups = groups
+
+	return dropped
+}
+
+// copyLabels returns a copy of the labels to modify, as they may be shared with a copy of the rule.
+func copyLabels(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
+
+// labelInjector sets static labels on every rule, e.g. the team or the environment.
+// Labels the rules already carry are kept unless overridden.
+type labelInjector struct {
+	labels   map[string]string
+	override bool
+}
+
+func (l labelInjector) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	for gi := range rgs.Groups {
+		for ri := range rgs.Groups[gi].Rules {
+			r := &rgs.Groups[gi].Rules[ri]
+			var updated map[string]string
+			for name, value := range l.labels {
+				if current, ok := r.Labels[name]; current == value || ok && !l.override {
+					continue
+				}
+				if updated == nil {
+					updated = copyLabels(r.Labels)
+				}
+				updated[name] = value
+			}
+			if updated != nil {
+				r.Labels = updated
+				changed = true
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+// ruleRelabeler applies Prometheus relabel configurations to the labels of every rule, along with __name__ holding the alert or record.
+// Rules dropped by the relabeling are dropped, setting __name__ renames them, and the other labels starting with __ are discarded.
+type ruleRelabeler struct {
+	configs []*relabel.Config
+}
+
+func (t ruleRelabeler) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	var err error
+	dropped := dropRules(rgs, func(g *ruleGroup, r *rule) bool {
+		if err != nil {
+			return true
+		}
+		name := r.Alert
+		if name == "" {
+			name = r.Record
+		}
+		in := copyLabels(r.Labels)
+		in[model.MetricNameLabel] = name
+
+		out := relabel.Process(labels.FromMap(in), t.configs...)
+		if out == nil {
+			return false
+		}
+		relabeled := make(map[string]string, len(out))
+		for _, l := range out {
+			if !strings.HasPrefix(l.Name, model.ReservedLabelPrefix) {
+				relabeled[l.Name] = l.Value
+			}
+		}
+
+		if newName := out.Get(model.MetricNameLabel); newName != name {
+			if newName == "" {
+				err = fmt.Errorf("relabeling removed the name of %s in group %q", ruleKind(*r), g.Name)
+				return true
+			}
+			if r.Alert != "" {
+				r.Alert = newName
+			} else {
+				r.Record = newName
+			}
+			changed = true
+		}
+		if !labels.Equal(labels.FromMap(relabeled), labels.FromMap(r.Labels)) {
+			if len(relabeled) == 0 {
+				relabeled = nil
+			}
+			r.Labels = relabeled
+			changed = true
+		}
+
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return changed || dropped > 0, nil
+}
+
+// ruleFilter keeps or drops the rules matching all of its matchers: an anchored regular expression on the group name,
+// the kind of rule, and anchored regular expressions on labels, a missing label matching as empty.
+type ruleFilter struct {
+	drop   bool
+	groups *regexp.Regexp
+	kind   string
+	labels map[string]*regexp.Regexp
+}
+
+func newRuleFilter(action, groups, kind string, labels map[string]string) (*ruleFilter, error) {
+	f := &ruleFilter{kind: kind, labels: make(map[string]*regexp.Regexp, len(labels))}
+	switch action {
+	case "", filterKeep:
+	case filterDrop:
+		f.drop = true
+	default:
+		return nil, fmt.Errorf("invalid action %q, must be one of %s or %s", action, filterKeep, filterDrop)
+	}
+	switch kind {
+	case "", kindAlerting, kindRecording:
+	default:
+		return nil, fmt.Errorf("invalid kind %q, must be one of %s or %s", kind, kindAlerting, kindRecording)
+	}
+	if groups == "" && kind == "" && len(labels) == 0 {
+		return nil, fmt.Errorf("one of groups, kind or labels must be set")
+	}
+
+	var err error
+	if groups != "" {
+		if f.groups, err = regexp.Compile("^(?:" + groups + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid groups regex %q: %w", groups, err)
+		}
+	}
+	for name, re := range labels {
+		if f.labels[name], err = regexp.Compile("^(?:" + re + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid regex %q of label %s: %w", re, name, err)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *ruleFilter) matches(g *ruleGroup, r *rule) bool {
+	if f.groups != nil && !f.groups.MatchString(g.Name) {
+		return false
+	}
+	if f.kind == kindAlerting && r.Alert == "" || f.kind == kindRecording && r.Record == "" {
+		return false
+	}
+	for name, re := range f.labels {
+		if !re.MatchString(r.Labels[name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *ruleFilter) transform(rgs *ruleGroups) (bool, error) {
+	dropped := dropRules(rgs, func(g *ruleGroup, r *rule) bool {
+		return f.matches(g, r) != f.drop
+	})
+
+	return dropped > 0, nil
+}
+
+// ruleNamePrefixer prefixes the names of groups, alerts and recording rules. Names already carrying the prefix are left untouched.
+type ruleNamePrefixer struct {
+	Group  string `yaml:"group"`
+	Alert  string `yaml:"alert"`
+	Record string `yaml:"record"`
+}
+
+func (p ruleNamePrefixer) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	prefix := func(name *string, prefix string) {
+		if prefix != "" && *name != "" && !strings.HasPrefix(*name, prefix) {
+			*name = prefix + *name
+			changed = true
+		}
+	}
+	for gi := range rgs.Groups {
+		g := &rgs.Groups[gi]
+		prefix(&g.Name, p.Group)
+		for ri := range g.Rules {
+			prefix(&g.Rules[ri].Alert, p.Alert)
+			prefix(&g.Rules[ri].Record, p.Record)
+		}
+	}
+
+	return changed, nil
+}
+
+// ruleTemplater sets labels and annotations rendered from Go templates, executed with the data of source links, e.g. a runbook
+// annotation derived from the alert. Recording rules only get the labels. Labels and annotations already set are kept unless overridden.
+type ruleTemplater struct {
+	labels      map[string]*template.Template
+	annotations map[string]*template.Template
+	override    bool
+	tenantLabel string
+}
+
+func newRuleTemplater(labels, annotations map[string]string, override bool, tenantLabel string) (*ruleTemplater, error) {
+	if len(labels)+len(annotations) == 0 {
+		return nil, fmt.Errorf("one of labels or annotations must be set")
+	}
+	t := &ruleTemplater{
+		labels:      make(map[string]*template.Template, len(labels)),
+		annotations: make(map[string]*template.Template, len(annotations)),
+		override:    override,
+		tenantLabel: tenantLabel,
+	}
+	for _, m := range []struct {
+		kind      string
+		templates map[string]string
+		dst       map[string]*template.Template
+	}{
+		{kind: "label", templates: labels, dst: t.labels},
+		{kind: "annotation", templates: annotations, dst: t.annotations},
+	} {
+		for name, text := range m.templates {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("invalid %s name %q", m.kind, name)
+			}
+			tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse template of %s %s: %w", m.kind, name, err)
+			}
+			m.dst[name] = tmpl
+		}
+	}
+
+	return t, nil
+}
+
+// render returns the values rendered from the templates that the rule lacks or, if overridden, whose values differ.
+func (t *ruleTemplater) render(templates map[string]*template.Template, current map[string]string, data sourceLinkData) (map[string]string, error) {
+	var rendered map[string]string
+	for name, tmpl := range templates {
+		if _, ok := current[name]; ok && !t.override {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to render %s: %w", name, err)
+		}
+		if value, ok := current[name]; ok && value == buf.String() {
+			continue
+		}
+		if rendered == nil {
+			rendered = copyLabels(current)
+		}
+		rendered[name] = buf.String()
+	}
+
+	return rendered, nil
+}
+
+func (t *ruleTemplater) transform(rgs *ruleGroups) (bool, error) {
+	changed := false
+	for gi := range rgs.Groups {
+		g := &rgs.Groups[gi]
+		for ri := range g.Rules {
+			r := &g.Rules[ri]
+			data := sourceLinkData{
+				Group:  g.Name,
+				Alert:  r.Alert,
+				Record: r.Record,
+				Expr:   r.Expr,
+				Tenant: r.Labels[t.tenantLabel],
+				Labels: r.Labels,
+			}
+			rendered, err := t.render(t.labels, r.Labels, data)
+			if err != nil {
+				return false, fmt.Errorf("%s in group %q: %w", ruleKind(*r), g.Name, err)
+			}
+			annotations := map[string]string(nil)
+			if r.Alert != "" {
+				if annotations, err = t.render(t.annotations, r.Annotations, data); err != nil {
+					return false, fmt.Errorf("%s in group %q: %w", ruleKind(*r), g.Name, err)
+				}
+			}
+			if rendered != nil {
+				r.Labels = rendered
+				changed = true
+			}
+			if annotations != nil {
+				r.Annotations = annotations
+				changed = true
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+// rulePolicy enforces conventions on the rules, e.g. that every alert has a severity and a summary, by refusing the rules,
+// dropping the offending rules or only warning. Required annotations only apply to alerts.
+// Its state is only accessed by the sync cycles, not by the previews.
+type rulePolicy struct {
+	action             string
+	requireLabels      []string
+	requireAnnotations []string
+	forbidLabels       []string
+	logPrefix          string
+
+	// warned are the last violations logged as warnings, so that they are logged once rather than every cycle.
+	warned string
+}
+
+// violations returns the conventions the rule breaks.
+func (p *rulePolicy) violations(r *rule) []string {
+	var violations []string
+	for _, l := range p.requireLabels {
+		if r.Labels[l] == "" {
+			violations = append(violations, "missing label "+l)
+		}
+	}
+	if r.Alert != "" {
+		for _, a := range p.requireAnnotations {
+			if r.Annotations[a] == "" {
+				violations = append(violations, "missing annotation "+a)
+			}
+		}
+	}
+	for _, l := range p.forbidLabels {
+		if _, ok := r.Labels[l]; ok {
+			violations = append(violations, "forbidden label "+l)
+		}
+	}
+
+	return violations
+}
+
+func (p *rulePolicy) transform(rgs *ruleGroups) (bool, error) {
+	return p.apply(rgs, true)
+}
+
+// preview applies the policy without logging the violations nor remembering them.
+func (p *rulePolicy) preview(rgs *ruleGroups) (bool, error) {
+	return p.apply(rgs, false)
+}
+
+func (p *rulePolicy) apply(rgs *ruleGroups, log bool) (bool, error) {
+	var violations []string
+	dropped := dropRules(rgs, func(g *ruleGroup, r *rule) bool {
+		v := p.violations(r)
+		if len(v) == 0 {
+			return true
+		}
+		violations = append(violations, fmt.Sprintf("%s in group %q: %s", ruleKind(*r), g.Name, strings.Join(v, ", ")))
+		return p.action != policyDrop
+	})
+
+	switch {
+	case p.action == policyReject && len(violations) > 0:
+		return false, fmt.Errorf("rules violate the policy: %s", strings.Join(violations, "; "))
+	case p.action == policyDrop:
+		if dropped > 0 && log {
+			debugf("%sdropped %d rules violating the policy: %s", p.logPrefix, dropped, strings.Join(violations, "; "))
+		}
+		return dropped > 0, nil
+	}
+
+	if !log {
+		return false, nil
+	}
+	sort.Strings(violations)
+	if joined := strings.Join(violations, "; "); joined != p.warned {
+		p.warned = joined
+		for _, v := range violations {
+			warnf("%srule violates the policy: %s", p.logPrefix, v)
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IP families of -http.ip-family.
+const (
+	ipFamilyDual = "dual"
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+)
+
+// ipFamilyNetworks are the networks dialed for the IP families.
+var ipFamilyNetworks = map[string]string{
+	ipFamilyDual: "tcp",
+	ipFamilyIPv4: "tcp4",
+	ipFamilyIPv6: "tcp6",
+}
+
+const (
+	// dialTimeout and dialKeepAlive are those of http.DefaultTransport.
+	dialTimeout   = 30 * time.Second
+	dialKeepAlive = 30 * time.Second
+)
+
+// tlsVersions are the values of -http.tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// transportConfig tunes the connections of the HTTP clients, e.g. to close idle connections before a load balancer does.
+type transportConfig struct {
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+	disableHTTP2    bool
+	tlsMinVersion   string
+	// tlsCipherSuites are the names of the cipher suites of TLS 1.2 and below the clients offer, those of Go if empty.
+	tlsCipherSuites listValue
+	// tlsPins are the host=pin pairs of -http.tls-pin-sha256.
+	tlsPins  listValue
+	ipFamily string
+	// fallbackDelay is how long a dual-stack dial waits for IPv6 before racing IPv4, see RFC 6555. 0 disables the race.
+	fallbackDelay time.Duration
+}
+
+func (c transportConfig) apply(t *http.Transport) {
+	if c.maxIdleConns == 0 {
+		t.DisableKeepAlives = true
+	}
+	t.MaxIdleConns = c.maxIdleConns
+	t.MaxIdleConnsPerHost = c.maxIdleConns
+	t.IdleConnTimeout = c.idleConnTimeout
+	if c.disableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		// A non-nil empty map turns off HTTP/2 for TLS connections.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	//nolint:exhaustivestruct
+	t.TLSClientConfig = &tls.Config{}
+	c.applyTLS(t.TLSClientConfig)
+	t.DialContext = c.dialContext()
+}
+
+// applyTLS sets the minimum version, the cipher suites and the pinned keys of the hosts on the TLS configuration of a client.
+// The flags are validated before.
+func (c transportConfig) applyTLS(cfg *tls.Config) {
+	if v, ok := tlsVersions[c.tlsMinVersion]; ok {
+		cfg.MinVersion = v
+	}
+	ids := tlsCipherSuiteIDs()
+	for _, name := range c.tlsCipherSuites {
+		cfg.CipherSuites = append(cfg.CipherSuites, ids[name])
+	}
+	if pins, err := parseTLSPins(c.tlsPins); err == nil && len(pins) > 0 {
+		cfg.VerifyConnection = verifyTLSPins(pins)
+	}
+}
+
+// tlsCipherSuiteIDs maps the names of the cipher suites Go considers secure to their IDs.
+func tlsCipherSuiteIDs() map[string]uint16 {
+	ids := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		ids[s.Name] = s.ID
+	}
+
+	return ids
+}
+
+// checkTLSCipherSuites returns an error if one of the names is not that of a secure cipher suite of TLS 1.2 and below,
+// as those of TLS 1.3 are not configurable.
+func checkTLSCipherSuites(names []string) error {
+	var valid []string
+	for _, s := range tls.CipherSuites() {
+		for _, v := range s.SupportedVersions {
+			if v != tls.VersionTLS13 {
+				valid = append(valid, s.Name)
+				break
+			}
+		}
+	}
+	for _, name := range names {
+		known := false
+		for _, v := range valid {
+			known = known || v == name
+		}
+		if !known {
+			return fmt.Errorf("invalid -http.tls-cipher-suites %q, must be one of %s", name, strings.Join(valid, ", "))
+		}
+	}
+
+	return nil
+}
+
+// parseTLSPins parses host=pin pairs into the pins of every host, a pin being the base64 of the SHA-256 of the subject public key info
+// of a certificate, like those of HTTP Public Key Pinning. Several pins of a host, e.g. a backup key, are given as several pairs.
+func parseTLSPins(pairs []string) (map[string]map[string]struct{}, error) {
+	pins := make(map[string]map[string]struct{})
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid -http.tls-pin-sha256 %q, must be like host=pin", pair)
+		}
+		host, pin := strings.ToLower(parts[0]), parts[1]
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid -http.tls-pin-sha256 pin %q of %s, must be the base64 of a SHA-256", pin, host)
+		}
+		if pins[host] == nil {
+			pins[host] = make(map[string]struct{})
+		}
+		pins[host][pin] = struct{}{}
+	}
+
+	return pins, nil
+}
+
+// verifyTLSPins returns the check of the connections to the pinned hosts, after the verification of their certificates,
+// one of whose verified chains must hold a certificate with one of the pinned keys. Hosts without pins are not checked.
+func verifyTLSPins(pins map[string]map[string]struct{}) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		host := strings.ToLower(cs.ServerName)
+		want, ok := pins[host]
+		// IP addresses are not sent as server names, the certificate having been verified for the one dialed instead.
+		if host == "" && len(cs.PeerCertificates) > 0 {
+			for _, ip := range cs.PeerCertificates[0].IPAddresses {
+				if want, ok = pins[ip.String()]; ok {
+					host = ip.String()
+					break
+				}
+			}
+		}
+		if !ok {
+			return nil
+		}
+		// Only the verified chains count, as a server can send any certificate along with its own, e.g. a pinned intermediate
+		// that did not issue it. Without verification, there are no chains and the connection fails.
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if _, ok := want[base64.StdEncoding.EncodeToString(sum[:])]; ok {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("the certificate of %s matches none of the keys pinned by -http.tls-pin-sha256", host)
+	}
+}
+
+// dialContext dials TCP connections of the IP family, racing IPv6 and IPv4 for dual-stack hosts.
+func (c transportConfig) dialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	//nolint:exhaustivestruct
+	d := &net.Dialer{Timeout: dialTimeout, KeepAlive: dialKeepAlive, FallbackDelay: c.fallbackDelay}
+	if c.fallbackDelay == 0 {
+		// The dialer takes 0 for the default delay, and a negative one for no race.
+		d.FallbackDelay = -1
+	}
+	family := ipFamilyNetworks[c.ipFamily]
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" && family != "" {
+			network = family
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// checkTargetURL returns an error if the URL of the flag does not parse or lacks a host,
+// pointing out IPv6 addresses not enclosed in brackets, e.g. http://fd00::1:10902 instead of http://[fd00::1]:10902.
+func checkTargetURL(name, rawURL string) error {
+	if _, ok := unixSocketPath(rawURL); ok {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	// Depending on the Go version, hosts like fd00::1:10902 are refused for their port, or taken for a host and a port failing to dial.
+	if (err != nil && strings.Contains(err.Error(), "invalid port") && !strings.Contains(rawURL, "[")) ||
+		(err == nil && strings.Contains(u.Hostname(), ":") && !strings.HasPrefix(u.Host, "[")) {
+		return fmt.Errorf("invalid -%s %q, IPv6 addresses must be enclosed in brackets, e.g. http://[fd00::1]:10902", name, redactURL(rawURL))
+	}
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid -%s %q, must be a URL like http://host:port", name, redactURL(rawURL))
+	}
+
+	return nil
+}
+
+func tlsVersionNames() string {
+	names := make([]string, 0, len(tlsVersions))
+	for name := range tlsVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
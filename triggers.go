@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// triggerReconnectBackoff is the pause between two attempts to (re)connect a trigger source.
+	triggerReconnectBackoff = 5 * time.Second
+	// triggerDialTimeout bounds establishing the connection to a trigger source.
+	triggerDialTimeout = 10 * time.Second
+	// maxTriggerPayload bounds the size of a message of a trigger source, the default maximum payload of NATS.
+	maxTriggerPayload = 1 << 20
+	// maxRESPArray and maxRESPDepth bound the number of elements of a RESP array and how deeply arrays nest.
+	maxRESPArray = 1024
+	maxRESPDepth = 8
+)
+
+// trigger requests an immediate sync cycle.
+// Requests arriving while one is already pending are coalesced into a single cycle.
+type trigger chan struct{}
+
+func newTrigger() trigger {
+	return make(trigger, 1)
+}
+
+func (t trigger) fire() {
+	select {
+	case t <- struct{}{}:
+	default:
+	}
+}
+
+// matchesTenant tells whether a "rules changed" message concerns the given tenant.
+// The message may be empty, carry the plain tenant name, or be a JSON object with a "tenant" field.
+// Every message matches when no tenant is configured, e.g. when syncing from the Rules Storage Backend.
+func matchesTenant(payload []byte, tenant string) bool {
+	payload = bytes.TrimSpace(payload)
+	if tenant == "" || len(payload) == 0 {
+		return true
+	}
+
+	var msg struct {
+		Tenant string `json:"tenant"`
+	}
+	if err := json.Unmarshal(payload, &msg); err == nil {
+		return msg.Tenant == "" || msg.Tenant == tenant
+	}
+
+	return string(payload) == tenant
+}
+
+// runTriggerSource keeps a subscription alive until the context is done, reconnecting after failures.
+func runTriggerSource(ctx context.Context, name string, subscribe func(ctx context.Context) error) error {
+	for {
+		err := subscribe(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		warnf("%s trigger subscription failed, reconnecting in %s: %v", name, triggerReconnectBackoff, err)
+
+		select {
+		case <-time.After(triggerReconnectBackoff):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// natsSubscriber subscribes to a NATS subject, speaking the text based client protocol,
+// see https://docs.nats.io/reference/reference-protocols/nats-protocol.
+type natsSubscriber struct {
+	url     *url.URL
+	subject string
+	tenant  string
+	trigger trigger
+}
+
+func newNATSSubscriber(rawURL, subject, tenant string, t trigger) (*natsSubscriber, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse NATS URL: %w", err)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	return &natsSubscriber{
+		url:     u,
+		subject: subject,
+		tenant:  tenant,
+		trigger: t,
+	}, nil
+}
+
+func (n *natsSubscriber) subscribe(ctx context.Context) error {
+	d := net.Dialer{Timeout: triggerDialTimeout}
+	raw, err := d.DialContext(ctx, "tcp", n.url.Host)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	defer raw.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			raw.Close()
+		case <-done:
+		}
+	}()
+
+	// The TLS connection wraps the dialed one, which the goroutine above closes.
+	conn := raw
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read NATS server info: %w", err)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "INFO ")), &info); err != nil {
+		return fmt.Errorf("failed to parse NATS server info: %w", err)
+	}
+
+	if info.TLSRequired || n.url.Scheme == "tls" {
+		//nolint:exhaustivestruct
+		tlsConn := tls.Client(raw, &tls.Config{ServerName: n.url.Hostname()})
+		_ = tlsConn.SetDeadline(time.Now().Add(triggerDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("failed TLS handshake with NATS: %w", err)
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	connect := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "thanos-rule-syncer",
+	}
+	if u := n.url.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			connect["user"] = u.Username()
+			connect["pass"] = pass
+		} else {
+			connect["auth_token"] = u.Username()
+		}
+	}
+	opts, err := json.Marshal(connect)
+	if err != nil {
+		return fmt.Errorf("failed to marshal NATS connect options: %w", err)
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s 1\r\nPING\r\n", opts, n.subject); err != nil {
+		return fmt.Errorf("failed to subscribe to NATS subject %s: %w", n.subject, err)
+	}
+	infof("subscribed to NATS subject %s at %s", n.subject, n.url.Host)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read from NATS: %w", err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return fmt.Errorf("failed to answer NATS ping: %w", err)
+			}
+		case "-ERR":
+			return fmt.Errorf("NATS server error: %s", strings.TrimSpace(line))
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || len(fields) < 4 || size < 0 {
+				return fmt.Errorf("malformed NATS message: %s", strings.TrimSpace(line))
+			}
+			if size > maxTriggerPayload {
+				return fmt.Errorf("NATS message of %d bytes exceeds the maximum of %d bytes", size, maxTriggerPayload)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return fmt.Errorf("failed to read NATS message payload: %w", err)
+			}
+			if matchesTenant(payload[:size], n.tenant) {
+				debugf("NATS message on %s triggers a sync", fields[1])
+				n.trigger.fire()
+			}
+		}
+	}
+}
+
+// kafkaSubscriber consumes a Kafka topic.
+// Every syncer should use its own consumer group, so that all of them see every message.
+type kafkaSubscriber struct {
+	brokers []string
+	topic   string
+	groupID string
+	tenant  string
+	trigger trigger
+}
+
+func newKafkaSubscriber(brokers []string, topic, groupID, tenant string, t trigger) *kafkaSubscriber {
+	return &kafkaSubscriber{
+		brokers: brokers,
+		topic:   topic,
+		groupID: groupID,
+		tenant:  tenant,
+		trigger: t,
+	}
+}
+
+func (k *kafkaSubscriber) subscribe(ctx context.Context) error {
+	//nolint:exhaustivestruct
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: k.brokers,
+		Topic:   k.topic,
+		GroupID: k.groupID,
+		// Changes published before we joined are already covered by the periodic sync.
+		StartOffset: kafka.LastOffset,
+	})
+	defer r.Close()
+	infof("subscribed to Kafka topic %s as consumer group %s", k.topic, k.groupID)
+
+	for {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read from Kafka: %w", err)
+		}
+		if matchesTenant(m.Value, k.tenant) {
+			debugf("Kafka message at offset %d triggers a sync", m.Offset)
+			k.trigger.fire()
+		}
+	}
+}
+
+const (
+	// redisPingInterval is how often a subscribed Redis connection is checked for liveness.
+	redisPingInterval = 30 * time.Second
+	// redisReadTimeout is how long a subscribed Redis connection may stay silent before we consider it dead.
+	redisReadTimeout = 3 * redisPingInterval
+)
+
+// redisSubscriber subscribes to a Redis pub/sub channel, speaking RESP,
+// see https://redis.io/docs/reference/protocol-spec/.
+type redisSubscriber struct {
+	url     *url.URL
+	channel string
+	tenant  string
+	trigger trigger
+}
+
+func newRedisSubscriber(rawURL, channel, tenant string, t trigger) (*redisSubscriber, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported Redis URL scheme %q, must be redis or rediss", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	return &redisSubscriber{
+		url:     u,
+		channel: channel,
+		tenant:  tenant,
+		trigger: t,
+	}, nil
+}
+
+func (rs *redisSubscriber) subscribe(ctx context.Context) error {
+	d := net.Dialer{Timeout: triggerDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", rs.url.Host)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	if rs.url.Scheme == "rediss" {
+		//nolint:exhaustivestruct
+		conn = tls.Client(conn, &tls.Config{ServerName: rs.url.Hostname()})
+	}
+	defer conn.Close()
+	// The deadline covers authentication and subscription, reads are bounded by redisReadTimeout afterwards.
+	_ = conn.SetDeadline(time.Now().Add(triggerDialTimeout))
+
+	r := bufio.NewReader(conn)
+	if u := rs.url.User; u != nil {
+		args := []string{"AUTH", u.Username()}
+		if pass, ok := u.Password(); ok {
+			args = []string{"AUTH", pass}
+			if u.Username() != "" {
+				args = []string{"AUTH", u.Username(), pass}
+			}
+		}
+		if err := writeRESPCommand(conn, args...); err != nil {
+			return fmt.Errorf("failed to authenticate with Redis: %w", err)
+		}
+		if _, err := readRESP(r); err != nil {
+			return fmt.Errorf("failed to authenticate with Redis: %w", err)
+		}
+	}
+
+	if err := writeRESPCommand(conn, "SUBSCRIBE", rs.channel); err != nil {
+		return fmt.Errorf("failed to subscribe to Redis channel %s: %w", rs.channel, err)
+	}
+	infof("subscribed to Redis channel %s at %s", rs.channel, rs.url.Host)
+	_ = conn.SetWriteDeadline(time.Time{})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(redisPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				// A PING is answered even in subscribed mode, keeping the read deadline from expiring.
+				_ = writeRESPCommand(conn, "PING")
+			}
+		}
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(redisReadTimeout))
+		v, err := readRESP(r)
+		if err != nil {
+			return fmt.Errorf("failed to read from Redis: %w", err)
+		}
+		// Published messages are pushed as ["message", <channel>, <payload>].
+		msg, ok := v.([]interface{})
+		if !ok || len(msg) != 3 {
+			continue
+		}
+		if kind, _ := msg[0].(string); kind != "message" {
+			continue
+		}
+		payload, _ := msg[2].(string)
+		if matchesTenant([]byte(payload), rs.tenant) {
+			debugf("Redis message triggers a sync")
+			rs.trigger.fire()
+		}
+	}
+}
+
+func writeRESPCommand(w io.Writer, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// readRESP reads a single RESP value. Strings are returned as string, integers as int64 and arrays as []interface{},
+// null bulk strings and arrays as nil. Bulk strings larger than maxTriggerPayload and arrays larger or deeper than maxRESPArray
+// and maxRESPDepth are refused, as the messages of the trigger are small.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	return readRESPValue(r, 0)
+}
+
+func readRESPValue(r *bufio.Reader, depth int) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("malformed RESP value")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed RESP bulk string length: %w", err)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		if n < 0 || n > maxTriggerPayload {
+			return nil, fmt.Errorf("invalid RESP bulk string length %d, must be -1 or from 0 to %d", n, maxTriggerPayload)
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed RESP array length: %w", err)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		if n < 0 || n > maxRESPArray {
+			return nil, fmt.Errorf("invalid RESP array length %d, must be -1 or from 0 to %d", n, maxRESPArray)
+		}
+		if depth >= maxRESPDepth {
+			return nil, fmt.Errorf("RESP arrays nested deeper than %d", maxRESPDepth)
+		}
+		values := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readRESPValue(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported RESP type %q", line[0])
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// unixScheme prefixes addresses and URLs that point at a unix domain socket, e.g. unix:///run/thanos-rule.sock.
+const unixScheme = "unix://"
+
+// unixSocketPath returns the socket path of a unix:// address and whether the address is one.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// listen listens on a TCP address or, given a unix:// address, on a unix domain socket.
+// A socket file left behind by a previous run is removed first.
+func listen(addr string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr) //nolint:wrapcheck
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+
+	return net.Listen("unix", path) //nolint:wrapcheck
+}
+
+// unixSocketTransport returns a copy of the transport dialing the given unix domain socket for every request.
+func unixSocketTransport(t *http.Transport, path string) *http.Transport {
+	t = t.Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+
+	return t
+}
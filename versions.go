@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// versionsDirSuffix ends the hidden directory of the content-addressed versions of the rules files, next to them,
+	// which Thanos Ruler does not pick up with a glob like *.yaml.
+	versionsDirSuffix = ".versions"
+	versionPrefix     = "rules-"
+)
+
+// versionsDir is the directory of the content-addressed versions with -write.content-addressed:
+// .versions in the output directory of the per-tenant layout, named after the rules file otherwise,
+// as the rules files of several pipelines may share a directory.
+func (o *output) versionsDir() string {
+	if o.layout == layoutPerTenant {
+		return filepath.Join(o.dir, versionsDirSuffix)
+	}
+
+	return filepath.Join(filepath.Dir(o.file), "."+filepath.Base(o.file)+versionsDirSuffix)
+}
+
+// writeVersion writes the content to the versions directory as rules-<hash>.yaml, then points the rules file at it
+// with a symlink renamed over the rules file, so that a reader opens either the previous or the new version, never a mix.
+func (o *output) writeVersion(ctx context.Context, path string, content []byte) error {
+	dir := o.versionsDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create the versions directory %s: %w", dir, err)
+	}
+
+	version := filepath.Join(dir, versionPrefix+contentHash(content)+ruleFileExt)
+	_, err := os.Stat(version)
+	switch {
+	case os.IsNotExist(err):
+		// Versions are written through a temporary file, so an existing one is complete.
+		if err := writeFile(ctx, version, content); err != nil {
+			return err
+		}
+	case err != nil:
+		return fmt.Errorf("failed to check the version %s: %w", version, err)
+	default:
+		// The modification time orders the versions to retain.
+		now := time.Now()
+		if err := os.Chtimes(version, now, now); err != nil {
+			return fmt.Errorf("failed to touch the version %s: %w", version, err)
+		}
+	}
+
+	// The link is relative, so that it holds wherever the directory is mounted.
+	target, err := filepath.Rel(filepath.Dir(path), version)
+	if err != nil {
+		return fmt.Errorf("failed to link the rules file %s: %w", path, err)
+	}
+	if current, err := os.Readlink(path); err == nil && current == target {
+		return nil
+	}
+	tmp, err := tempFilePath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("failed to link the rules file %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace the rules file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// pruneVersions removes the versions no rules file points at, except for the most recent ones kept for rollback.
+func (o *output) pruneVersions(paths []string) error {
+	dir := o.versionsDir()
+	active := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		if target, err := os.Readlink(p); err == nil {
+			active[filepath.Base(target)] = struct{}{}
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list the versions in %s: %w", dir, err)
+	}
+	var previous []os.FileInfo
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, versionPrefix) || !strings.HasSuffix(name, ruleFileExt) {
+			continue
+		}
+		if _, ok := active[name]; ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		previous = append(previous, info)
+	}
+	if len(previous) <= o.retainVersions {
+		return nil
+	}
+
+	sort.Slice(previous, func(i, j int) bool { return previous[i].ModTime().After(previous[j].ModTime()) })
+	for _, info := range previous[o.retainVersions:] {
+		p := filepath.Join(dir, info.Name())
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove the version %s: %w", p, err)
+		}
+		debugf("%sremoved version %s", o.logPrefix, p)
+	}
+
+	return nil
+}